@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"jaypod/pkg/engine"
+	"jaypod/pkg/state"
+	"jaypod/pkg/subscription"
+)
+
+const backfillUsage = "usage: backfill [-n count] [-order oldest|newest] feed\n"
+
+// backfillCommand queues a batch of a feed's older episodes, those its
+// initial policy left out, and downloads them along with anything else
+// that's queued.  Each run carries on from where the last left off.
+func backfillCommand(e *engine.Engine, subscriptionDir, secretsFile, stateFile, dir string, testmode bool, args []string) int {
+	name, n, order, err := parseBackfillArgs(args)
+	if err != nil {
+		return 1
+	}
+
+	feeds, playlists, err := loadFeeds(subscriptionDir, secretsFile)
+	if err != nil {
+		slog.Error("error loading feeds",
+			"error", err)
+	}
+	var feed *subscription.Feed
+	for _, f := range feeds {
+		if f.Name == name {
+			feed = f
+		}
+	}
+	if feed == nil {
+		fmt.Fprintf(os.Stderr, "unknown feed %s\n", name)
+		return 1
+	}
+
+	st, err := state.LoadState(stateFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	queued, err := e.Backfill(feed, st, dir, n, order == subscription.OrderNewest, testmode)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	if queued == 0 {
+		fmt.Printf("nothing left to backfill for %s\n", feed.Name)
+		return 0
+	}
+	if testmode {
+		return 0
+	}
+
+	downloads, err := e.Drain(feeds, st, dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	if err := engine.WritePlaylists(feeds, playlists, st, dir); err != nil {
+		slog.Error("error writing playlists",
+			"error", err)
+	}
+
+	fmt.Printf("queued %d episodes of %s, downloaded %d\n", queued, feed.Name, downloads)
+	return 0
+}
+
+// parseBackfillArgs parses backfill's arguments, which can have flags after
+// the feed's name as well as before it.  What's wrong with them is written
+// to stderr.
+func parseBackfillArgs(args []string) (string, int, string, error) {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	n := flags.Int("n", 10, "episodes to queue this run, or 0 for all of them")
+	order := flags.String("order", subscription.OrderOldest, "which episodes to start from, oldest or newest")
+	if err := flags.Parse(args); err != nil {
+		return "", 0, "", err
+	}
+	if flags.NArg() == 0 {
+		fmt.Fprint(os.Stderr, backfillUsage)
+		return "", 0, "", errors.New("no feed given")
+	}
+	// parsing stops at the feed's name, so carry on after it
+	name := flags.Arg(0)
+	if err := flags.Parse(flags.Args()[1:]); err != nil {
+		return "", 0, "", err
+	}
+	if flags.NArg() != 0 {
+		fmt.Fprint(os.Stderr, backfillUsage)
+		return "", 0, "", fmt.Errorf("unexpected arguments %v", flags.Args())
+	}
+	if *order != subscription.OrderOldest && *order != subscription.OrderNewest {
+		fmt.Fprintf(os.Stderr, "unknown order %s\n%s", *order, backfillUsage)
+		return "", 0, "", fmt.Errorf("unknown order %s", *order)
+	}
+	return name, *n, *order, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestParseBackfillArgs(t *testing.T) {
+	var cases = []struct {
+		args  []string
+		name  string
+		n     int
+		order string
+		ok    bool
+	}{
+		{[]string{"Show"}, "Show", 10, "oldest", true},
+		{[]string{"-n", "5", "Show"}, "Show", 5, "oldest", true},
+		{[]string{"Show", "-n", "5"}, "Show", 5, "oldest", true},
+		{[]string{"-order", "newest", "Show", "-n", "0"}, "Show", 0, "newest", true},
+		{[]string{}, "", 0, "", false},
+		{[]string{"Show", "Other"}, "", 0, "", false},
+		{[]string{"Show", "-order", "random"}, "", 0, "", false},
+	}
+
+	for i, x := range cases {
+		name, n, order, err := parseBackfillArgs(x.args)
+		if (err == nil) != x.ok {
+			t.Errorf("cases[%d] - expected ok %v, got %v", i, x.ok, err)
+			continue
+		}
+		if name != x.name || n != x.n || order != x.order {
+			t.Errorf("cases[%d] - expected %s %d %s, got %s %d %s", i, x.name, x.n, x.order, name, n, order)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"jaypod/pkg/engine"
+	"jaypod/pkg/subscription"
+)
+
+const (
+	// Editors tend to write a file in several steps, so changes are only
+	// acted on once things have been quiet for a moment.
+	reloadDelay = 500 * time.Millisecond
+
+	// Bounds on how long the daemon sleeps between pulls.  The upper one
+	// is only reached if the next wakeup can't be worked out.
+	minSleep = time.Minute
+	maxSleep = time.Hour
+)
+
+// daemon sleeps until some feed is due to be polled or a queued download
+// can be attempted, and pulls, until killed.
+func daemon(e *engine.Engine, subscriptionDir, stateFile, secretsFile, dir string, testmode bool) {
+	subs := loadSubscriptions(subscriptionDir, secretsFile)
+	subs.serve(func(feeds []*subscription.Feed, playlists []*subscription.Playlist, force bool) time.Time {
+		return pull(e, feeds, playlists, stateFile, dir, testmode, force)
+	}, nil)
+}
+
+// subscriptions are the feeds and playlists the daemon works from, along
+// with where they're loaded from.
+type subscriptions struct {
+	dir         string
+	secretsFile string
+	feeds       []*subscription.Feed
+	playlists   []*subscription.Playlist
+}
+
+func loadSubscriptions(dir, secretsFile string) *subscriptions {
+	s := &subscriptions{dir: dir, secretsFile: secretsFile}
+
+	var err error
+	s.feeds, s.playlists, err = loadFeeds(dir, secretsFile)
+	if err != nil {
+		slog.Error("error loading feeds",
+			"error", err)
+	}
+	return s
+}
+
+// reload loads the subscriptions afresh.  If that turns up problems and
+// some were loaded before, those are kept.  It says whether the
+// subscriptions were replaced.
+func (s *subscriptions) reload(why string) bool {
+	feeds, playlists, err := loadFeeds(s.dir, s.secretsFile)
+	if err != nil && s.feeds != nil {
+		slog.Error("invalid subscriptions, keeping previous ones",
+			"reason", why,
+			"error", err)
+		return false
+	}
+	if err != nil {
+		slog.Error("error loading feeds",
+			"error", err)
+	}
+	s.feeds = feeds
+	s.playlists = playlists
+	slog.Info("reloaded subscriptions",
+		"reason", why,
+		"feeds", len(s.feeds),
+		"playlists", len(s.playlists))
+	return true
+}
+
+// serve calls pull whenever there's something to do, until stop is
+// closed.  pull returns when it should next be called.  Subscriptions are
+// reloaded when anything under the subscription directory or the secrets
+// file changes, or on SIGHUP, and SIGUSR1 forces a pull of every feed
+// straight away.
+func (s *subscriptions) serve(pull func(feeds []*subscription.Feed, playlists []*subscription.Playlist, force bool) time.Time, stop <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR1)
+	defer signal.Stop(signals)
+
+	dirs := map[string]bool{}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Error("can't watch subscriptions, use SIGHUP to reload",
+			"error", err)
+	} else {
+		defer watcher.Close()
+		watchTree(watcher, s.dir, dirs)
+		if s.secretsFile != "" {
+			if err := watcher.Add(filepath.Dir(s.secretsFile)); err != nil {
+				slog.Warn("can't watch secrets file",
+					"filename", s.secretsFile,
+					"error", err)
+			}
+		}
+	}
+
+	settle := time.NewTimer(reloadDelay)
+	settle.Stop()
+
+	wake := time.NewTimer(0)
+	defer wake.Stop()
+	sleep := func(next time.Time) {
+		d := time.Until(next)
+		if next.IsZero() || d > maxSleep {
+			d = maxSleep
+		}
+		if d < minSleep {
+			d = minSleep
+		}
+		slog.Info("sleeping",
+			"until", time.Now().Add(d).Format(time.DateTime))
+		resetTimer(wake, d)
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+
+		case <-wake.C:
+			sleep(pull(s.feeds, s.playlists, false))
+
+		case sig := <-signals:
+			switch sig {
+			case syscall.SIGHUP:
+				s.reload("SIGHUP")
+				resetTimer(wake, 0)
+			case syscall.SIGUSR1:
+				sleep(pull(s.feeds, s.playlists, true))
+			}
+
+		case event := <-watcherEvents(watcher):
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					watchTree(watcher, event.Name, dirs)
+				}
+			}
+			if relevant(event.Name, s.dir, s.secretsFile, dirs) {
+				settle.Reset(reloadDelay)
+			}
+			if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+				delete(dirs, event.Name)
+			}
+
+		case err := <-watcherErrors(watcher):
+			slog.Warn("error watching subscriptions",
+				"error", err)
+
+		case <-settle.C:
+			s.reload("subscriptions changed")
+			// new feeds are due straight away
+			resetTimer(wake, 0)
+		}
+	}
+}
+
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// watchTree watches dir and every directory beneath it, since inotify
+// doesn't watch recursively, and adds them to dirs.
+func watchTree(watcher *fsnotify.Watcher, dir string, dirs map[string]bool) {
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() {
+			return nil
+		}
+		if path != dir && strings.HasPrefix(entry.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if err := watcher.Add(path); err != nil {
+			slog.Warn("can't watch directory",
+				"dir", path,
+				"error", err)
+			return nil
+		}
+		dirs[path] = true
+		return nil
+	})
+}
+
+// relevant reports whether a change to path could affect the loaded
+// subscriptions, ignoring editor swap files and the like.  dirs are the
+// directories being watched, so that one going away is noticed.
+func relevant(path, subscriptionDir, secretsFile string, dirs map[string]bool) bool {
+	if secretsFile != "" && filepath.Clean(path) == filepath.Clean(secretsFile) {
+		return true
+	}
+	if rel, err := filepath.Rel(subscriptionDir, path); err != nil || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	name := filepath.Base(path)
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	if strings.HasSuffix(name, ".yaml") {
+		return true
+	}
+	// a directory appearing or going away
+	if dirs[path] {
+		return true
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// A nil watcher's channels are nil, so its cases never fire.
+func watcherEvents(watcher *fsnotify.Watcher) chan fsnotify.Event {
+	if watcher == nil {
+		return nil
+	}
+	return watcher.Events
+}
+
+func watcherErrors(watcher *fsnotify.Watcher) chan error {
+	if watcher == nil {
+		return nil
+	}
+	return watcher.Errors
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"jaypod/pkg/subscription"
+)
+
+func TestRelevant(t *testing.T) {
+	root := t.TempDir()
+	subs := filepath.Join(root, "subs")
+	secrets := filepath.Join(root, "secrets.yaml")
+	if err := os.MkdirAll(filepath.Join(subs, "Comedy"), 0777); err != nil {
+		t.Fatalf("failed creating dirs: %v", err)
+	}
+	dirs := map[string]bool{subs: true, filepath.Join(subs, "Gone"): true}
+
+	var paths = []struct {
+		path     string
+		expected bool
+	}{
+		{"news.yaml", true},
+		{"Comedy/_defaults.yaml", true},
+		// a new directory, and a watched one going away
+		{"Comedy", true},
+		{"Gone", true},
+		// editor swap, backup and temporary files
+		{".news.yaml.swp", false},
+		{"news.yaml~", false},
+		{"4913", false},
+		{"#news.yaml#", false},
+		{".#news.yaml", false},
+		{"news.yaml.tmp", false},
+		{".git/index", false},
+		{"../other.yaml", false},
+		{"../secrets.yaml", true},
+	}
+
+	for i, x := range paths {
+		if got := relevant(filepath.Join(subs, x.path), subs, secrets, dirs); got != x.expected {
+			t.Errorf("paths[%d] - %s: expected %v, got %v", i, x.path, x.expected, got)
+		}
+	}
+}
+
+func writeFeeds(t *testing.T, filename string, names ...string) {
+	doc := "feeds:\n"
+	for _, name := range names {
+		doc += fmt.Sprintf("  - name: %s\n    url: http://example.com/${SHOW}/%s\n", name, name)
+	}
+	if err := os.WriteFile(filename, []byte(doc), 0666); err != nil {
+		t.Fatalf("failed writing %s: %v", filename, err)
+	}
+}
+
+func TestReloadKeepsLastGood(t *testing.T) {
+	t.Setenv("SHOW", "show")
+	dir := t.TempDir()
+	writeFeeds(t, filepath.Join(dir, "a.yaml"), "A")
+
+	subs := loadSubscriptions(dir, "")
+	if len(subs.feeds) != 1 {
+		t.Fatalf("expected 1 feed, got %d", len(subs.feeds))
+	}
+
+	writeFeeds(t, filepath.Join(dir, "b.yaml"), "B", "C")
+	if !subs.reload("test") || len(subs.feeds) != 3 {
+		t.Fatalf("expected 3 feeds after reload, got %d", len(subs.feeds))
+	}
+
+	var broken = []string{
+		"feeds:\n  - name: D\n    url: [\n",
+		"feeds:\n  - name: D\n    url: http://example.com/d\n    colision: skip\n",
+		"feeds:\n  - name: A\n    url: http://example.com/again\n",
+		"playlists:\n  - name: bad/name\n",
+	}
+	for i, doc := range broken {
+		if err := os.WriteFile(filepath.Join(dir, "c.yaml"), []byte(doc), 0666); err != nil {
+			t.Fatalf("broken[%d] - failed writing: %v", i, err)
+		}
+		if subs.reload("test") {
+			t.Errorf("broken[%d] - expected invalid subscriptions to be rejected", i)
+		}
+		if len(subs.feeds) != 3 || subs.feeds[0].Name != "A" {
+			t.Errorf("broken[%d] - expected the previous feeds kept, got %d", i, len(subs.feeds))
+		}
+	}
+
+	os.Remove(filepath.Join(dir, "c.yaml"))
+	os.Remove(filepath.Join(dir, "a.yaml"))
+	if !subs.reload("test") || len(subs.feeds) != 2 {
+		t.Fatalf("expected 2 feeds once fixed, got %d", len(subs.feeds))
+	}
+}
+
+func TestServeReloads(t *testing.T) {
+	t.Setenv("SHOW", "first")
+	dir := t.TempDir()
+	writeFeeds(t, filepath.Join(dir, "a.yaml"), "A")
+
+	pulls := make(chan string, 10)
+	pull := func(feeds []*subscription.Feed, playlists []*subscription.Playlist, force bool) time.Time {
+		pulled := fmt.Sprint(len(feeds))
+		if len(feeds) > 0 {
+			pulled += " " + feeds[0].RequestUrl()
+		}
+		pulls <- pulled
+		return time.Now().Add(time.Hour)
+	}
+	next := func(what string, expected string) {
+		t.Helper()
+		select {
+		case got := <-pulls:
+			if got != expected {
+				t.Fatalf("%s: expected pull of %q, got %q", what, expected, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: expected a pull", what)
+		}
+	}
+
+	subs := loadSubscriptions(dir, "")
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		subs.serve(pull, stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	next("start", "1 http://example.com/first/A")
+
+	// editor droppings don't cause a reload
+	for _, name := range []string{".a.yaml.swp", "a.yaml~", "4913"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("junk"), 0666); err != nil {
+			t.Fatalf("failed writing %s: %v", name, err)
+		}
+	}
+	select {
+	case got := <-pulls:
+		t.Fatalf("expected no reload for temporary files, got pull of %q", got)
+	case <-time.After(3 * reloadDelay):
+	}
+
+	writeFeeds(t, filepath.Join(dir, "a.yaml"), "A", "B")
+	next("edited", "2 http://example.com/first/A")
+
+	if err := os.WriteFile(filepath.Join(dir, "a.yaml"), []byte("feeds:\n  - name: A\n    url: [\n"), 0666); err != nil {
+		t.Fatalf("failed writing a.yaml: %v", err)
+	}
+	next("broken", "2 http://example.com/first/A")
+
+	// nothing the watcher sees, so only SIGHUP picks it up
+	writeFeeds(t, filepath.Join(dir, "a.yaml"), "A", "B")
+	next("fixed", "2 http://example.com/first/A")
+	os.Setenv("SHOW", "second")
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatalf("failed sending SIGHUP: %v", err)
+	}
+	next("SIGHUP", "2 http://example.com/second/A")
+}
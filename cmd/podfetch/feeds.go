@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"jaypod/pkg/engine"
+	"jaypod/pkg/state"
+	"jaypod/pkg/subscription"
+)
+
+// feedsCommand shows each feed's polling schedule: when it was last
+// polled, when it's next due and why, and the publishing cadence learned
+// from its history.
+func feedsCommand(subscriptionDir, stateFile string) int {
+	feeds, _, err := subscription.ParseDir(subscriptionDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		if feeds == nil {
+			return 1
+		}
+	}
+
+	st, err := state.LoadState(stateFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "FEED\tLAST POLL\tNEXT POLL\tREASON\tCADENCE\n")
+	for _, feed := range feeds {
+		last := "never"
+		if t := st.LastPoll(feed.Name); !t.IsZero() {
+			last = t.Format("01-02 15:04")
+		}
+
+		next := "due"
+		if t := st.NextPoll(feed.Name); t.After(now) {
+			next = t.Format("01-02 15:04")
+		}
+
+		cadence := "not enough history"
+		if feed.Interval() > 0 {
+			cadence = "fixed"
+		} else if c := engine.LearnCadence(st.Published(feed.Name), now); c != nil {
+			cadence = c.String()
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			feed.Name, last, next, st.PollReason(feed.Name), cadence)
+	}
+	w.Flush()
+	return 0
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
@@ -18,13 +19,35 @@ func main() {
 	var stateFile = flag.String("s", "", "subscriptions state file")
 	var dir = flag.String("d", "", "directory into which podcasts should be saved")
 	var testmode = flag.Bool("t", false, "log output without downloading files")
-	var wakeInterval = flag.Int("w", 0, "if > 0, number of minutes to wait between rss pulls")
+	var wakeInterval = flag.Int("w", 0, "if > 0, run as a daemon polling feeds every this many minutes, unless they say otherwise")
+	var secretsFile = flag.String("secrets", "", "optional file of secrets referenced by subscriptions")
+	var connectTimeout = flag.Duration("connect-timeout", 30*time.Second, "timeout for establishing connections")
+	var headerTimeout = flag.Duration("header-timeout", time.Minute, "timeout waiting for response headers")
+	var idleTimeout = flag.Duration("idle-timeout", 90*time.Second, "how long idle connections are kept for reuse")
+	var proxy = flag.String("proxy", "", "http, https or socks5 proxy url (default from environment)")
+	var caBundle = flag.String("ca-bundle", "", "PEM file of additional CA certificates")
+	var userAgent = flag.String("user-agent", "podfetch/1.0", "default User-Agent header")
+	var maxRedirects = flag.Int("max-redirects", 10, "maximum redirects to follow per request, or 0 to follow none")
+	var rate = flag.String("rate", "", "global download bandwidth cap, e.g. 512k or 2m bytes/sec")
+	var hostRates = flag.String("host-rates", "", "per-host bandwidth caps, e.g. libsyn.com=256k,acast.com=1m")
+	var windows = flag.String("windows", "", "daily local-time download windows, e.g. 01:00-07:00,22:00-23:30")
+	var maxAttempts = flag.Int("max-attempts", 5, "download attempts before a queued episode is marked failed")
+	var maxFeedSize = flag.String("max-feed-size", "50m", "largest feed to read, once decompressed, e.g. 20m")
+	var maxFeedPages = flag.Int("max-feed-pages", 20, "most pages of a paged or archived feed to read at once, or 0 to read only the first")
 
 	flag.Parse()
 
-	if *subscriptionDir == "" {
-		fmt.Fprintf(os.Stderr, "missing required feeds directory\n")
-		os.Exit(1)
+	command := "pull"
+	if args := flag.Args(); len(args) > 0 {
+		command = args[0]
+	}
+
+	if command == "validate" {
+		if *subscriptionDir == "" {
+			fmt.Fprintf(os.Stderr, "missing required feeds directory\n")
+			os.Exit(1)
+		}
+		os.Exit(validateCommand(*subscriptionDir, *secretsFile))
 	}
 
 	if *stateFile == "" {
@@ -32,6 +55,26 @@ func main() {
 		os.Exit(1)
 	}
 
+	switch command {
+	case "pull", "backfill":
+	case "queue":
+		os.Exit(queueCommand(*stateFile, flag.Args()[1:]))
+	case "feeds":
+		if *subscriptionDir == "" {
+			fmt.Fprintf(os.Stderr, "missing required feeds directory\n")
+			os.Exit(1)
+		}
+		os.Exit(feedsCommand(*subscriptionDir, *stateFile))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %s\n", command)
+		os.Exit(1)
+	}
+
+	if *subscriptionDir == "" {
+		fmt.Fprintf(os.Stderr, "missing required feeds directory\n")
+		os.Exit(1)
+	}
+
 	if *dir == "" {
 		fmt.Fprintf(os.Stderr, "missing required output dir\n")
 		os.Exit(1)
@@ -39,45 +82,138 @@ func main() {
 
 	//	slog.SetDefault(
 
-	if *wakeInterval > 0 {
-		tick := time.NewTicker(time.Duration(*wakeInterval) * time.Minute)
-		for ; ; <-tick.C {
-			pull(*subscriptionDir, *stateFile, *dir, *testmode)
+	var globalRate int64
+	if *rate != "" {
+		r, err := engine.ParseRate(*rate)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
 		}
-	} else {
-		pull(*subscriptionDir, *stateFile, *dir, *testmode)
+		globalRate = r
 	}
 
-}
+	perHost, err := engine.ParseHostRates(*hostRates)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
 
-func pull(subscriptionDir, stateFile, dir string, testmode bool) {
+	feedSize, err := engine.ParseSize(*maxFeedSize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
 
-	start := time.Now()
+	downloadWindows, err := engine.ParseWindows(*windows)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
 
-	feeds, err := subscription.ParseDir(subscriptionDir)
+	e, err := engine.New(engine.Config{
+		ConnectTimeout: *connectTimeout,
+		HeaderTimeout:  *headerTimeout,
+		IdleTimeout:    *idleTimeout,
+		Proxy:          *proxy,
+		CABundle:       *caBundle,
+		UserAgent:      *userAgent,
+		MaxRedirects:   maxRedirects,
+		Rate:           globalRate,
+		HostRates:      perHost,
+		Windows:        downloadWindows,
+		MaxAttempts:    *maxAttempts,
+		PollInterval:   time.Duration(*wakeInterval) * time.Minute,
+		MaxFeedSize:    feedSize,
+		MaxFeedPages:   maxFeedPages,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	if command == "backfill" {
+		os.Exit(backfillCommand(e, *subscriptionDir, *secretsFile, *stateFile, *dir, *testmode, flag.Args()[1:]))
+	}
+
+	if *wakeInterval > 0 {
+		daemon(e, *subscriptionDir, *stateFile, *secretsFile, *dir, *testmode)
+		return
+	}
+
+	feeds, playlists, err := loadFeeds(*subscriptionDir, *secretsFile)
 	if err != nil {
 		slog.Error("error loading feeds",
 			"error", err)
-		return
+	}
+	pull(e, feeds, playlists, *stateFile, *dir, *testmode, true)
+}
+
+// pull polls the feeds that are due, or all of them if force is set,
+// downloads what's queued and updates the playlists.  It returns when there
+// will next be something to do, or the zero time if that couldn't be worked
+// out.
+func pull(e *engine.Engine, feeds []*subscription.Feed, playlists []*subscription.Playlist, stateFile, dir string, testmode bool, force bool) time.Time {
+
+	if len(feeds) == 0 {
+		slog.Warn("no feeds to pull")
+		return time.Time{}
 	}
 
+	start := time.Now()
+
 	state, err := state.LoadState(stateFile)
 	if err != nil {
 		slog.Error("error loading state file",
 			"filename", stateFile,
 			"error", err)
-		return
+		return time.Time{}
 	}
 
-	downloads, err := engine.Fetch(feeds, state, dir, testmode)
+	downloads, err := e.Fetch(feeds, state, dir, testmode, force)
 	if err != nil {
 		slog.Error("error during fetch",
 			"error", err)
-		return
+	}
+
+	if !testmode {
+		if err := engine.WritePlaylists(feeds, playlists, state, dir); err != nil {
+			slog.Error("error writing playlists",
+				"error", err)
+		}
 	}
 
 	slog.Info("wakeup",
 		"elapsed", time.Now().Sub(start),
 		"downloads", downloads)
-	return
+	return e.NextWake(feeds, state, time.Now())
+}
+
+// loadFeeds parses the subscriptions and fills in their secrets, returning
+// the feeds and smart playlists they define.  Feeds with problems are left
+// out and reported in the error.
+func loadFeeds(subscriptionDir, secretsFile string) ([]*subscription.Feed, []*subscription.Playlist, error) {
+	feeds, playlists, err := subscription.ParseDir(subscriptionDir)
+	if feeds == nil {
+		return nil, playlists, err
+	}
+	errs := []error{err}
+
+	secrets := subscription.Secrets{}
+	if secretsFile != "" {
+		secrets, err = subscription.LoadSecrets(secretsFile)
+		if err != nil {
+			return nil, playlists, errors.Join(append(errs, err)...)
+		}
+	}
+
+	resolved := make([]*subscription.Feed, 0, len(feeds))
+	for _, feed := range feeds {
+		if err := feed.Resolve(secrets); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		resolved = append(resolved, feed)
+	}
+
+	return resolved, playlists, errors.Join(errs...)
 }
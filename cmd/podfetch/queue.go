@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"jaypod/pkg/state"
+)
+
+func queueCommand(stateFile string, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: queue list | queue retry [id...] | queue drop id...\n")
+		return 1
+	}
+
+	st, err := state.LoadState(stateFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	switch args[0] {
+	case "list":
+		queueList(st)
+		return 0
+	case "retry":
+		if !queueRetry(st, args[1:]) {
+			return 1
+		}
+	case "drop":
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "usage: queue drop id...\n")
+			return 1
+		}
+		if !queueDrop(st, args[1:]) {
+			return 1
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown queue command %s\n", args[0])
+		return 1
+	}
+
+	if err := st.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func queueList(st *state.State) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tSTATUS\tPRIORITY\tFEED\tPUBLISHED\tATTEMPTS\tTITLE\tLAST ERROR\n")
+	for _, q := range st.Queue() {
+		status := "queued"
+		if q.Failed {
+			status = "failed"
+		} else if time.Now().Before(q.NextAttempt) {
+			status = "retry " + q.NextAttempt.Format("01-02 15:04")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%d\t%s\t%s\n",
+			q.ID, status, q.Priority, q.Feed, q.PubDate.Format("2006-01-02"),
+			q.Attempts, q.Title, q.LastError)
+	}
+	w.Flush()
+}
+
+// queueRetry resets the given items, or every failed item if none are
+// named, so they are attempted on the next pull.
+func queueRetry(st *state.State, ids []string) bool {
+	items := []*state.QueueItem{}
+	if len(ids) == 0 {
+		for _, q := range st.Queue() {
+			if q.Failed {
+				items = append(items, q)
+			}
+		}
+	}
+	for _, id := range ids {
+		q := st.Queued(id)
+		if q == nil {
+			fmt.Fprintf(os.Stderr, "no queued item %s\n", id)
+			return false
+		}
+		items = append(items, q)
+	}
+
+	for _, q := range items {
+		q.Failed = false
+		q.Attempts = 0
+		q.NextAttempt = time.Time{}
+		fmt.Printf("retrying %s %s\n", q.ID, q.Title)
+	}
+	return true
+}
+
+func queueDrop(st *state.State, ids []string) bool {
+	for _, id := range ids {
+		q := st.Queued(id)
+		if q == nil {
+			fmt.Fprintf(os.Stderr, "no queued item %s\n", id)
+			return false
+		}
+		st.Dequeue(q)
+		fmt.Printf("dropped %s %s\n", q.ID, q.Title)
+	}
+	return true
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"jaypod/pkg/subscription"
+)
+
+// validateCommand checks every subscription file, printing each problem
+// found.  Secret references are only checked if a secrets file is given,
+// since the environment they'd otherwise come from may not be the one
+// podfetch runs in.
+func validateCommand(subscriptionDir, secretsFile string) int {
+	feeds, playlists, err := subscription.ParseDir(subscriptionDir)
+	if feeds == nil && err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	problems := flatten(err)
+
+	if secretsFile != "" {
+		secrets, err := subscription.LoadSecrets(secretsFile)
+		if err != nil {
+			problems = append(problems, err)
+		} else {
+			for _, feed := range feeds {
+				if err := feed.Resolve(secrets); err != nil {
+					problems = append(problems, err)
+				}
+			}
+		}
+	}
+
+	for _, p := range problems {
+		fmt.Fprintf(os.Stderr, "%v\n", p)
+	}
+	fmt.Printf("%d feeds, %d playlists, %d problems\n", len(feeds), len(playlists), len(problems))
+
+	if len(problems) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func flatten(err error) []error {
+	if err == nil {
+		return nil
+	}
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return []error{err}
+	}
+
+	var errs []error
+	for _, e := range joined.Unwrap() {
+		errs = append(errs, flatten(e)...)
+	}
+	return errs
+}
@@ -2,7 +2,12 @@ module jaypod
 
 go 1.22.0
 
-require github.com/goccy/go-yaml v1.11.3
+require (
+	github.com/andybalholm/brotli v1.1.1
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/goccy/go-yaml v1.11.3
+	golang.org/x/text v0.21.0
+)
 
 require (
 	github.com/fatih/color v1.10.0 // indirect
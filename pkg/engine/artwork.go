@@ -0,0 +1,165 @@
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"jaypod/pkg/state"
+	"jaypod/pkg/subscription"
+)
+
+const (
+	// Covers are saved as cover.jpg, cover.png and so on
+	coverStem = "cover"
+	// Images bigger than this aren't saved
+	maxImageSize = 20 << 20
+)
+
+// Extensions images are saved with, by MIME type
+var imageTypes = map[string]string{
+	"image/jpeg": "jpg",
+	"image/jpg":  "jpg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+}
+
+// saveArtwork saves the artwork the feed asks for alongside an episode just
+// downloaded to path.  Artwork is a nicety, so failures are only logged.
+func (e *Engine) saveArtwork(q *state.QueueItem, feed *subscription.Feed, st *state.State, rootdir string, path string, sublog *slog.Logger) {
+	if feed.Artwork == nil {
+		return
+	}
+
+	if feed.Artwork.Cover {
+		if url := st.Image(feed.Name); url != "" {
+			dir := filepath.Dir(path)
+			cover := savedCover(st, feed.Name, relPath(rootdir, dir))
+			a, ok := st.Artwork(cover)
+			if _, err := os.Stat(filepath.Join(rootdir, cover)); err != nil || !ok || a.Url != url {
+				e.saveCover(feed, st, rootdir, dir, cover, url, sublog)
+			}
+		}
+	}
+
+	if feed.Artwork.Episodes && q.Image != "" {
+		if _, err := e.fetchImage(feed, q.Image, strings.TrimSuffix(path, filepath.Ext(path))); err != nil {
+			sublog.Warn("failed saving episode artwork", "url", q.Image, "err", err)
+		}
+	}
+}
+
+// savedCover returns the library-relative path of the cover saved from a
+// feed into a library-relative directory, or "" if there isn't one.
+func savedCover(st *state.State, name string, dir string) string {
+	for _, rel := range st.FeedArtwork(name) {
+		if filepath.Dir(rel) == dir && isCover(rel) {
+			return rel
+		}
+	}
+	return ""
+}
+
+func isCover(path string) bool {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base)) == coverStem
+}
+
+// refreshCovers fetches the covers saved from a feed again if its image has
+// changed since.
+func (e *Engine) refreshCovers(feed *subscription.Feed, st *state.State, rootdir string) {
+	url := st.Image(feed.Name)
+	if feed.Artwork == nil || !feed.Artwork.Cover || url == "" {
+		return
+	}
+	for _, rel := range st.FeedArtwork(feed.Name) {
+		if a, _ := st.Artwork(rel); isCover(rel) && a.Url != url {
+			e.saveCover(feed, st, rootdir, filepath.Join(rootdir, filepath.Dir(rel)), rel, url,
+				slog.With("feed", feed.Name))
+		}
+	}
+}
+
+// saveCover saves a feed's cover into dir, replacing old, the
+// library-relative path of the cover saved there before if there was one.
+func (e *Engine) saveCover(feed *subscription.Feed, st *state.State, rootdir string, dir string, old string, url string, sublog *slog.Logger) {
+	cover, err := e.fetchImage(feed, url, filepath.Join(dir, coverStem))
+	if err != nil {
+		sublog.Warn("failed saving cover", "url", url, "err", err)
+		return
+	}
+	// a new image of another type leaves the old one behind otherwise
+	if rel := relPath(rootdir, cover); old != "" && old != rel {
+		os.Remove(filepath.Join(rootdir, old))
+		st.ForgetArtwork(old)
+	}
+	st.RecordArtwork(relPath(rootdir, cover), state.Artwork{Feed: feed.Name, Url: url})
+	sublog.Info("saved cover", "path", cover)
+}
+
+// fetchImage downloads an image to stem with the extension its type calls
+// for, replacing whatever was there, and returns the path it was saved to.
+func (e *Engine) fetchImage(feed *subscription.Feed, url string, stem string) (string, error) {
+	req, err := e.newRequest(feed, url)
+	if err != nil {
+		return "", err
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("bad response code %d: %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	body := bufio.NewReader(resp.Body)
+	dst := stem + "." + imageExtension(resp, body)
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".podfetch-*.part")
+	if err != nil {
+		return "", err
+	}
+	n, err := io.Copy(tmp, io.LimitReader(body, maxImageSize+1))
+	if err == nil && n > maxImageSize {
+		err = fmt.Errorf("image is larger than %d bytes", maxImageSize)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return dst, nil
+}
+
+// imageExtension works out what an image should be saved as from its
+// Content-Type, or failing that its first bytes.  Anything else is taken
+// to be a jpeg, as most podcast artwork is.
+func imageExtension(resp *http.Response, body *bufio.Reader) string {
+	t, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if ext, ok := imageTypes[t]; ok {
+		return ext
+	}
+	head, _ := body.Peek(512)
+	t, _, _ = mime.ParseMediaType(http.DetectContentType(head))
+	if ext, ok := imageTypes[t]; ok {
+		return ext
+	}
+	return "jpg"
+}
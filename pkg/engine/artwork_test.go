@@ -0,0 +1,96 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"jaypod/pkg/subscription"
+)
+
+func TestArtwork(t *testing.T) {
+	cover := "/cover1.jpg"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rss":
+			w.Write([]byte(`<rss version="2.0" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd"><channel>
+<title>Art</title>
+<image><url>http://` + r.Host + `/small.jpg</url></image>
+<itunes:image href="http://` + r.Host + cover + `"/>
+<item><title>One</title><pubDate>Mon, 01 Jan 2024 06:00:00 GMT</pubDate>
+  <itunes:image href="http://` + r.Host + `/one.jpg"/>
+  <enclosure url="http://` + r.Host + `/one.mp3" type="audio/mpeg"/></item>
+<item><title>Two</title><pubDate>Tue, 02 Jan 2024 06:00:00 GMT</pubDate>
+  <enclosure url="http://` + r.Host + `/two.mp3" type="audio/mpeg"/></item>
+</channel></rss>`))
+		case "/one.jpg", "/cover2.png":
+			// whatever the url says
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(r.URL.Path))
+		default:
+			w.Write([]byte(r.URL.Path))
+		}
+	}))
+	defer srv.Close()
+
+	rootdir := t.TempDir()
+	st := newTestState(t)
+
+	feeds, err := subscription.ParseFeeds([]byte(`
+feeds:
+  - name: Art
+    url: ` + srv.URL + `/rss
+    artwork:
+      cover: true
+      episodes: true
+    filters:
+      - title_regex: ".*"
+`))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	e := newTestEngine(t, Config{})
+
+	read := func(name string) string {
+		b, _ := os.ReadFile(filepath.Join(rootdir, "Art", name))
+		return string(b)
+	}
+
+	if _, err := e.Fetch(feeds, st, rootdir, false, true); err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	if read("cover.jpg") != "/cover1.jpg" || read("one.png") != "/one.jpg" {
+		t.Errorf("expected cover and episode art, got %q and %q", read("cover.jpg"), read("one.png"))
+	}
+	if _, err := os.Stat(filepath.Join(rootdir, "Art", "two.jpg")); err == nil {
+		t.Errorf("expected no art for an episode without its own image")
+	}
+
+	cover = "/cover2.jpg"
+	if _, err := e.Fetch(feeds, st, rootdir, false, true); err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	if read("cover.jpg") != "/cover2.jpg" {
+		t.Errorf("expected cover refreshed when the feed's image changed, got %q", read("cover.jpg"))
+	}
+	if a, ok := st.Artwork("Art/cover.jpg"); !ok || a.Url != srv.URL+"/cover2.jpg" {
+		t.Errorf("expected the new cover recorded, got %+v", a)
+	}
+
+	cover = "/cover2.png"
+	if _, err := e.Fetch(feeds, st, rootdir, false, true); err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	if read("cover.png") != "/cover2.png" {
+		t.Errorf("expected a png cover, got %q", read("cover.png"))
+	}
+	if _, err := os.Stat(filepath.Join(rootdir, "Art", "cover.jpg")); err == nil {
+		t.Errorf("expected the jpeg cover replaced")
+	}
+	if _, ok := st.Artwork("Art/cover.jpg"); ok || len(st.FeedArtwork("Art")) != 1 {
+		t.Errorf("expected only the png cover recorded, got %v", st.FeedArtwork("Art"))
+	}
+}
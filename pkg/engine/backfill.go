@@ -0,0 +1,137 @@
+package engine
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"jaypod/pkg/rss"
+	"jaypod/pkg/state"
+	"jaypod/pkg/subscription"
+)
+
+// Backfill queues up to n of a feed's matching episodes older than those
+// its first poll started from, oldest or newest first, and records how far
+// it got so the next run carries on from there.  Progress is kept apart
+// from the feed's watermark, which only ever moves forward.  It returns
+// how many episodes were queued, zero once there are none left.
+func (e *Engine) Backfill(feed *subscription.Feed, st *state.State, rootdir string, n int, newestFirst bool, testmode bool) (int, error) {
+	after, before := st.Backfill(feed.Name)
+	if before.IsZero() {
+		// feeds first polled before backfill kept track start from their
+		// watermark, and anything downloaded already is passed over below
+		before = st.Last(feed.Name)
+	}
+	if before.IsZero() {
+		return 0, fmt.Errorf("feed %s hasn't been polled yet", feed.Name)
+	}
+
+	rc, _, err := e.readFeed(feed, time.Time{}, func(items []*rss.RssItem) bool {
+		return oldest(items).After(after)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// undated episodes are left to polling, which keeps track of them
+	var older []*rss.RssItem
+	for _, p := range acceptedPodcasts(rc, feed) {
+		if !p.Undated && p.PubDate.After(after) && p.PubDate.Before(before) {
+			older = append(older, p)
+		}
+	}
+	downloaded := alreadyDownloaded(feed.Name, st, rootdir)
+	var matched []episode
+	for _, m := range matchEpisodes(feed, older) {
+		if downloaded(m) {
+			slog.Debug("already downloaded, not backfilling",
+				"feed", feed.Name,
+				"podcast", m.p.Url())
+			continue
+		}
+		matched = append(matched, m)
+	}
+
+	batch := backfillBatch(matched, n, newestFirst)
+	queued := 0
+	for _, m := range batch {
+		if e.queueEpisode(m, feed, &rc.Feed, st, rootdir, testmode) {
+			queued++
+		}
+	}
+
+	if len(batch) > 0 && !testmode {
+		if newestFirst {
+			before = batch[0].p.PubDate
+		} else {
+			after = batch[len(batch)-1].p.PubDate
+		}
+		st.SetBackfill(feed.Name, after, before)
+	}
+	slog.Info("backfilled feed",
+		"feed", feed.Name,
+		"queued", queued,
+		"remaining", len(matched)-len(batch))
+
+	return queued, st.Flush()
+}
+
+// alreadyDownloaded returns a test of whether a matched episode of a feed
+// is in the library already, so backfill can pass over it: recorded as one
+// of the feed's episodes, or among the files whose hashes are kept, named
+// as it would be in its directory.
+func alreadyDownloaded(feed string, st *state.State, rootdir string) func(m episode) bool {
+	recorded := map[string]bool{}
+	for _, ep := range st.Episodes() {
+		if ep.Feed == feed {
+			recorded[ep.Title+"\x00"+ep.PubDate.UTC().String()] = true
+		}
+	}
+
+	// by directory and name without its extension, which the download
+	// might have been given by its type
+	hashed := map[string]string{}
+	for _, path := range st.HashedPaths() {
+		base := filepath.Base(path)
+		hashed[filepath.Join(filepath.Dir(path), strings.TrimSuffix(base, filepath.Ext(base)))] = path
+	}
+
+	return func(m episode) bool {
+		if recorded[m.p.Title()+"\x00"+m.p.PubDate.UTC().String()] {
+			return true
+		}
+		name := m.basename
+		if name == "" {
+			name = m.p.FileBaseName()
+		}
+		path, ok := hashed[filepath.Join(filepath.Clean(filepath.FromSlash(m.dest)), escape(name))]
+		if !ok {
+			return false
+		}
+		_, err := os.Stat(filepath.Join(rootdir, path))
+		return err == nil
+	}
+}
+
+// backfillBatch takes n episodes from the oldest or newest end of matched,
+// which is sorted oldest first, along with any published at the same time
+// as the last one taken so that none are skipped by the next batch.
+func backfillBatch(matched []episode, n int, newestFirst bool) []episode {
+	if n <= 0 || n >= len(matched) {
+		return matched
+	}
+	if newestFirst {
+		i := len(matched) - n
+		for i > 0 && matched[i-1].p.PubDate.Equal(matched[i].p.PubDate) {
+			i--
+		}
+		return matched[i:]
+	}
+	for n < len(matched) && matched[n].p.PubDate.Equal(matched[n-1].p.PubDate) {
+		n++
+	}
+	return matched[:n]
+}
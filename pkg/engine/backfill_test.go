@@ -0,0 +1,174 @@
+package engine
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"jaypod/pkg/state"
+	"jaypod/pkg/subscription"
+)
+
+// backfillServer serves a feed of six episodes a day apart, and a seventh
+// published at the same time as the second.
+func backfillServer() *httptest.Server {
+	var items strings.Builder
+	for i := 1; i <= 6; i++ {
+		fmt.Fprintf(&items, `<item><title>Episode %d</title><pubDate>%s</pubDate>
+  <enclosure url="http://HOST/%d.mp3" type="audio/mpeg"/></item>`,
+			i, time.Date(2024, 1, i, 6, 0, 0, 0, time.UTC).Format(time.RFC1123), i)
+	}
+	// two episodes published at the same time shouldn't be split by a batch
+	fmt.Fprintf(&items, `<item><title>Episode 2b</title><pubDate>%s</pubDate>
+  <enclosure url="http://HOST/2b.mp3" type="audio/mpeg"/></item>`,
+		time.Date(2024, 1, 2, 6, 0, 0, 0, time.UTC).Format(time.RFC1123))
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.ReplaceAll(`<rss version="2.0"><channel><title>Show</title>`+items.String()+`</channel></rss>`, "HOST", r.Host)))
+	}))
+}
+
+// queuedTitles empties the queue, returning the titles that were in it.
+func queuedTitles(st *state.State) []string {
+	var titles []string
+	for _, q := range slices.Clone(st.Queue()) {
+		titles = append(titles, q.Title)
+		st.Dequeue(q)
+	}
+	slices.Sort(titles)
+	return titles
+}
+
+func TestBackfill(t *testing.T) {
+	srv := backfillServer()
+	defer srv.Close()
+	st := newTestState(t)
+
+	feeds, err := subscription.ParseFeeds([]byte(`
+feeds:
+  - name: Show
+    url: ` + srv.URL + `/rss
+    initial: latest 2
+    filters:
+      - title_regex: ".*"
+`))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	feed := feeds[0]
+
+	e := newTestEngine(t, Config{})
+	if _, err := e.Backfill(feed, st, t.TempDir(), 2, false, false); err == nil {
+		t.Errorf("expected backfill of an unpolled feed to fail")
+	}
+
+	if err := e.Poll(feeds, st, t.TempDir(), false); err != nil {
+		t.Fatalf("poll failed: %v", err)
+	}
+	if got := queuedTitles(st); !slices.Equal(got, []string{"Episode 5", "Episode 6"}) {
+		t.Errorf("expected the latest two episodes initially, got %v", got)
+	}
+	if !st.Last("Show").Equal(time.Date(2024, 1, 6, 6, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected watermark at the newest episode, got %v", st.Last("Show"))
+	}
+
+	var batches = []struct {
+		n           int
+		newestFirst bool
+		expected    []string
+	}{
+		{2, false, []string{"Episode 1", "Episode 2", "Episode 2b"}},
+		{1, true, []string{"Episode 4"}},
+		{5, false, []string{"Episode 3"}},
+		{5, false, nil},
+	}
+	for i, x := range batches {
+		n, err := e.Backfill(feed, st, t.TempDir(), x.n, x.newestFirst, false)
+		if got := queuedTitles(st); err != nil || n != len(x.expected) || !slices.Equal(got, x.expected) {
+			t.Errorf("batches[%d] - expected %v, got %d %v: %v", i, x.expected, n, got, err)
+		}
+	}
+	if !st.Last("Show").Equal(time.Date(2024, 1, 6, 6, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected backfill to leave the watermark alone, got %v", st.Last("Show"))
+	}
+}
+
+func TestBackfillAfterInitialNone(t *testing.T) {
+	srv := backfillServer()
+	defer srv.Close()
+	st := newTestState(t)
+
+	feeds, err := subscription.ParseFeeds([]byte(`
+feeds:
+  - name: Show
+    url: ` + srv.URL + `/rss
+    initial: none
+    filters:
+      - title_regex: ".*"
+`))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	e := newTestEngine(t, Config{})
+	if err := e.Poll(feeds, st, t.TempDir(), false); err != nil {
+		t.Fatalf("poll failed: %v", err)
+	}
+	if got := queuedTitles(st); got != nil {
+		t.Errorf("expected nothing initially, got %v", got)
+	}
+
+	// the newest episode included
+	n, err := e.Backfill(feeds[0], st, t.TempDir(), 0, false, false)
+	if got := queuedTitles(st); err != nil || n != 7 || len(got) != 7 || got[6] != "Episode 6" {
+		t.Errorf("expected every episode backfilled, got %d %v: %v", n, got, err)
+	}
+}
+
+func TestBackfillSkipsDownloaded(t *testing.T) {
+	srv := backfillServer()
+	defer srv.Close()
+	st := newTestState(t)
+
+	feeds, err := subscription.ParseFeeds([]byte(`
+feeds:
+  - name: Show
+    url: ` + srv.URL + `/rss
+    filters:
+      - title_regex: ".*"
+`))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	// polled before backfill kept track, with some of the back catalog
+	// downloaded: one episode recorded, and two only known by their
+	// hashes, one of them dated the same as an episode that isn't
+	rootdir := t.TempDir()
+	st.Update("Show", time.Date(2024, 1, 6, 6, 0, 0, 0, time.UTC))
+	st.RecordEpisode(&state.Episode{Path: "Show/1.mp3", Feed: "Show", Title: "Episode 1",
+		PubDate: time.Date(2024, 1, 1, 6, 0, 0, 0, time.UTC)})
+	for name, day := range map[string]int{"2.mp3": 2, "3.mp3": 3} {
+		path := filepath.Join(rootdir, "Show", name)
+		os.MkdirAll(filepath.Dir(path), 0777)
+		if err := os.WriteFile(path, []byte(name), 0666); err != nil {
+			t.Fatalf("failed writing %s: %v", name, err)
+		}
+		date := time.Date(2024, 1, day, 6, 0, 0, 0, time.UTC)
+		os.Chtimes(path, date, date)
+		st.RecordHash(name, filepath.Join("Show", name))
+	}
+
+	e := newTestEngine(t, Config{})
+	n, err := e.Backfill(feeds[0], st, rootdir, 0, false, false)
+	expected := []string{"Episode 2b", "Episode 4", "Episode 5"}
+	if got := queuedTitles(st); err != nil || n != len(expected) || !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %d %v: %v", expected, n, got, err)
+	}
+}
@@ -0,0 +1,177 @@
+package engine
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// Only this much recent history is used to learn a feed's cadence,
+	// and only once there are enough episodes in it
+	cadenceLookback   = 26 * 7 * 24 * time.Hour
+	cadenceMinSamples = 5
+	// An hour of the week becomes a release slot once episodes have come
+	// out in it this many times
+	slotMinCount = 3
+
+	// Around an expected release, polling starts a little early and keeps
+	// going for a while, since publishers run late
+	releaseLead   = 30 * time.Minute
+	releaseWindow = 3 * time.Hour
+	releasePoll   = 15 * time.Minute
+)
+
+// Slot is an hour of the week, in UTC, when a feed tends to publish.
+type Slot struct {
+	Weekday time.Weekday
+	Hour    int
+}
+
+// Cadence is a feed's publishing pattern as learned from its pubDates.
+type Cadence struct {
+	Slots []Slot
+	// Typical time between episodes
+	Gap     time.Duration
+	Samples int
+}
+
+// LearnCadence works out when a feed publishes from the pubDates it has
+// been seen with.  It returns nil if there isn't enough recent history.
+func LearnCadence(dates []time.Time, now time.Time) *Cadence {
+	var recent []time.Time
+	for _, d := range dates {
+		if !d.IsZero() && now.Sub(d) < cadenceLookback && !d.After(now) {
+			recent = append(recent, d.UTC())
+		}
+	}
+	slices.SortFunc(recent, time.Time.Compare)
+	recent = slices.CompactFunc(recent, time.Time.Equal)
+	if len(recent) < cadenceMinSamples {
+		return nil
+	}
+
+	c := &Cadence{Samples: len(recent)}
+
+	gaps := make([]time.Duration, 0, len(recent)-1)
+	for i := 1; i < len(recent); i++ {
+		gaps = append(gaps, recent[i].Sub(recent[i-1]))
+	}
+	slices.Sort(gaps)
+	c.Gap = gaps[len(gaps)/2]
+
+	counts := map[Slot]int{}
+	for _, d := range recent {
+		d = d.Add(30 * time.Minute)
+		counts[Slot{Weekday: d.Weekday(), Hour: d.Hour()}]++
+	}
+
+	covered := 0
+	for slot, n := range counts {
+		if n >= slotMinCount {
+			c.Slots = append(c.Slots, slot)
+			covered += n
+		}
+	}
+	// a few coincidences in an irregular feed don't make a schedule
+	if covered*2 < len(recent) {
+		c.Slots = nil
+	}
+	slices.SortFunc(c.Slots, func(a, b Slot) int {
+		return (int(a.Weekday)*24 + a.Hour) - (int(b.Weekday)*24 + b.Hour)
+	})
+
+	return c
+}
+
+// start returns the start of the slot's release window that contains t,
+// or failing that the next one.
+func (s Slot) start(t time.Time) time.Time {
+	t = t.UTC()
+	start := time.Date(t.Year(), t.Month(), t.Day(), s.Hour, 0, 0, 0, time.UTC)
+	start = start.AddDate(0, 0, (int(s.Weekday)-int(t.Weekday())+7)%7)
+	if prev := start.AddDate(0, 0, -7); prev.Add(releaseWindow).After(t) {
+		return prev
+	}
+	if !start.Add(releaseWindow).After(t) {
+		start = start.AddDate(0, 0, 7)
+	}
+	return start
+}
+
+// NextRelease is when the next episode is expected, or the start of the
+// release window t is in.  It's the zero time for feeds with no slots.
+func (c *Cadence) NextRelease(t time.Time) time.Time {
+	var next time.Time
+	for _, s := range c.Slots {
+		if start := s.start(t); next.IsZero() || start.Before(next) {
+			next = start
+		}
+	}
+	return next
+}
+
+// nextPoll picks when to poll a feed after polling it at now: often around
+// its expected releases, and otherwise not until the next one, or at most
+// every half its usual gap between episodes.  base is the interval the
+// feed would get if nothing was known about it.
+func (c *Cadence) nextPoll(now time.Time, base time.Duration) (time.Time, string) {
+	quiet := min(c.Gap/2, maxHintInterval)
+	if quiet < base {
+		quiet = base
+	}
+
+	release := c.NextRelease(now)
+	if release.IsZero() {
+		return now.Add(quiet), fmt.Sprintf("no regular release time, publishes about every %s", approx(c.Gap))
+	}
+
+	if !now.Before(release.Add(-releaseLead)) {
+		return now.Add(min(releasePoll, base)), "expected release " + release.Format("Mon 15:04 MST")
+	}
+
+	wake := release.Add(-releaseLead)
+	if wake.After(now.Add(quiet)) {
+		return now.Add(quiet), "checking in before expected release " + release.Format("Mon 15:04 MST")
+	}
+	return wake, "waiting for expected release " + release.Format("Mon 15:04 MST")
+}
+
+// String summarises the cadence, like "Mon, Thu 06:00 UTC, about every 3.5d".
+func (c *Cadence) String() string {
+	var parts []string
+
+	hours := map[int][]string{}
+	var order []int
+	for _, s := range c.Slots {
+		if _, ok := hours[s.Hour]; !ok {
+			order = append(order, s.Hour)
+		}
+		hours[s.Hour] = append(hours[s.Hour], s.Weekday.String()[:3])
+	}
+	for _, h := range order {
+		days := strings.Join(hours[h], ", ")
+		if len(hours[h]) == 7 {
+			days = "daily"
+		}
+		parts = append(parts, fmt.Sprintf("%s %02d:00", days, h))
+	}
+	if len(parts) > 0 {
+		parts[len(parts)-1] += " UTC"
+	}
+
+	parts = append(parts, "about every "+approx(c.Gap))
+	return strings.Join(parts, ", ")
+}
+
+// approx formats a duration to the nearest hour, or tenth of a day.
+func approx(d time.Duration) string {
+	if d >= 48*time.Hour {
+		return fmt.Sprintf("%.1fd", d.Hours()/24)
+	}
+	if d >= time.Hour {
+		return fmt.Sprintf("%dh", int(d.Round(time.Hour).Hours()))
+	}
+	return fmt.Sprintf("%dm", int(d.Round(time.Minute).Minutes()))
+}
@@ -0,0 +1,75 @@
+package engine
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLearnCadence(t *testing.T) {
+	// Mondays and Thursdays around 06:00 UTC for ten weeks
+	monday := time.Date(2024, 1, 1, 6, 0, 0, 0, time.UTC)
+	var twiceWeekly []time.Time
+	for week := 0; week < 10; week++ {
+		start := monday.AddDate(0, 0, 7*week)
+		twiceWeekly = append(twiceWeekly, start.Add(-2*time.Minute), start.AddDate(0, 0, 3).Add(5*time.Minute))
+	}
+	now := monday.AddDate(0, 0, 71).Add(6 * time.Hour) // Tuesday 12:00
+
+	c := LearnCadence(twiceWeekly, now)
+	if c == nil {
+		t.Fatalf("expected a cadence")
+	}
+	expected := []Slot{{time.Monday, 6}, {time.Thursday, 6}}
+	if len(c.Slots) != len(expected) || c.Slots[0] != expected[0] || c.Slots[1] != expected[1] {
+		t.Errorf("expected slots %v, got %v", expected, c.Slots)
+	}
+	if !strings.HasPrefix(c.String(), "Mon, Thu 06:00 UTC, about every ") {
+		t.Errorf("unexpected summary %q", c.String())
+	}
+
+	var polls = []struct {
+		now      time.Time
+		expected time.Time
+		reason   string
+	}{
+		{now, now.Add(24 * time.Hour), "checking in before expected release Thu 06:00 UTC"},
+		{now.Add(24 * time.Hour), now.Add(41*time.Hour + 30*time.Minute), "waiting for expected release Thu 06:00 UTC"},
+		{now.Add(41*time.Hour + 45*time.Minute), now.Add(42 * time.Hour), "expected release Thu 06:00 UTC"},
+		{now.Add(44 * time.Hour), now.Add(44*time.Hour + 15*time.Minute), "expected release Thu 06:00 UTC"},
+		{now.Add(45*time.Hour + 30*time.Minute), now.Add(69*time.Hour + 30*time.Minute), "checking in before expected release Mon 06:00 UTC"},
+	}
+	for i, x := range polls {
+		next, reason := c.nextPoll(x.now, time.Hour)
+		if !next.Equal(x.expected) || reason != x.reason {
+			t.Errorf("polls[%d] - at %v expected %v %q, got %v %q", i, x.now, x.expected, x.reason, next, reason)
+		}
+	}
+
+	var daily []time.Time
+	for day := 0; day < 28; day++ {
+		daily = append(daily, monday.AddDate(0, 0, day))
+	}
+	if c := LearnCadence(daily, monday.AddDate(0, 0, 28)); c == nil || c.String() != "daily 06:00 UTC, about every 24h" {
+		t.Errorf("expected a daily cadence, got %v", c)
+	}
+
+	irregular := []time.Time{
+		monday, monday.Add(50 * time.Hour), monday.Add(200 * time.Hour),
+		monday.Add(230 * time.Hour), monday.Add(390 * time.Hour), monday.Add(500 * time.Hour),
+	}
+	c = LearnCadence(irregular, monday.AddDate(0, 0, 30))
+	if c == nil || len(c.Slots) != 0 {
+		t.Fatalf("expected no release slots, got %v", c)
+	}
+	if next, _ := c.nextPoll(now, time.Hour); !next.Equal(now.Add(24 * time.Hour)) {
+		t.Errorf("expected an irregular feed to be polled daily, got %v", next)
+	}
+
+	if c := LearnCadence(twiceWeekly[:4], now); c != nil {
+		t.Errorf("expected too little history to give no cadence, got %v", c)
+	}
+	if c := LearnCadence(twiceWeekly, now.AddDate(1, 0, 0)); c != nil {
+		t.Errorf("expected old history to be ignored, got %v", c)
+	}
+}
@@ -0,0 +1,202 @@
+package engine
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"jaypod/pkg/subscription"
+)
+
+const (
+	defaultUserAgent    = "podfetch/1.0"
+	defaultMaxRedirects = 10
+)
+
+type Config struct {
+	ConnectTimeout time.Duration
+	HeaderTimeout  time.Duration
+	IdleTimeout    time.Duration
+	// http, https, socks5 or socks5h url.  If empty, the usual proxy
+	// environment variables apply.
+	Proxy string
+	// PEM file of CA certificates to trust in addition to the system pool
+	CABundle  string
+	UserAgent string
+	// Redirects to follow per request, with nil meaning the default of 10
+	// and zero not following any
+	MaxRedirects *int
+
+	// Bandwidth caps in bytes per second; zero means unlimited
+	Rate      int64
+	HostRates map[string]int64
+	// When downloads may run.  Outside these, matched episodes are queued
+	// in the state file until a window opens.
+	Windows []Window
+
+	// Download attempts before a queued episode is marked failed
+	MaxAttempts int
+
+	// How often feeds without a poll_interval of their own are polled
+	PollInterval time.Duration
+	// Largest feed, in bytes once decompressed, that will be read
+	MaxFeedSize int64
+	// Most pages of a paged or archived feed that will be read at once,
+	// with nil meaning the default of 20 and zero reading only the first
+	MaxFeedPages *int
+}
+
+type Engine struct {
+	client    *http.Client
+	userAgent string
+	rate      *rateLimiter
+	hostRates map[string]*rateLimiter
+	windows   []Window
+
+	maxAttempts  int
+	pollInterval time.Duration
+	maxFeedSize  int64
+	maxFeedPages int
+}
+
+func New(cfg Config) (*Engine, error) {
+	if cfg.ConnectTimeout == 0 {
+		cfg.ConnectTimeout = 30 * time.Second
+	}
+	if cfg.HeaderTimeout == 0 {
+		cfg.HeaderTimeout = time.Minute
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = 90 * time.Second
+	}
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = defaultUserAgent
+	}
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = defaultMaxAttempts
+	}
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = defaultPollInterval
+	}
+	if cfg.MaxFeedSize == 0 {
+		cfg.MaxFeedSize = defaultMaxFeedSize
+	}
+	maxRedirects := defaultMaxRedirects
+	if cfg.MaxRedirects != nil {
+		maxRedirects = *cfg.MaxRedirects
+	}
+	maxFeedPages := defaultMaxFeedPages
+	if cfg.MaxFeedPages != nil {
+		maxFeedPages = *cfg.MaxFeedPages
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy != "" {
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("bad proxy url %s: %v", cfg.Proxy, err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %s", u.Scheme)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	tlsConfig := &tls.Config{}
+	if cfg.CABundle != "" {
+		pem, err := os.ReadFile(cfg.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", cfg.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   cfg.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   cfg.ConnectTimeout,
+		ResponseHeaderTimeout: cfg.HeaderTimeout,
+		IdleConnTimeout:       cfg.IdleTimeout,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   4,
+		ForceAttemptHTTP2:     true,
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if feed, ok := req.Context().Value(feedKey{}).(*subscription.Feed); ok {
+				feed.Authorize(req)
+			}
+			return nil
+		},
+	}
+
+	e := &Engine{
+		client:    client,
+		userAgent: cfg.UserAgent,
+		hostRates: map[string]*rateLimiter{},
+		windows:   cfg.Windows,
+
+		maxAttempts:  cfg.MaxAttempts,
+		pollInterval: cfg.PollInterval,
+		maxFeedSize:  cfg.MaxFeedSize,
+		maxFeedPages: maxFeedPages,
+	}
+	if cfg.Rate > 0 {
+		e.rate = newRateLimiter(cfg.Rate)
+	}
+	for host, rate := range cfg.HostRates {
+		e.hostRates[host] = newRateLimiter(rate)
+	}
+
+	return e, nil
+}
+
+// feedKey is the context key for the feed a request was made for, so that
+// redirects can work out whether its auth and headers should follow.
+type feedKey struct{}
+
+// newRequest builds a GET for either a feed or one of its enclosures,
+// carrying the feed's user agent, and its auth and headers if they're
+// meant for the host.
+func (e *Engine) newRequest(feed *subscription.Feed, u string) (*http.Request, error) {
+	ctx := context.WithValue(context.Background(), feedKey{}, feed)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ua := e.userAgent
+	if feed.UserAgent != "" {
+		ua = feed.UserAgent
+	}
+	req.Header.Set("User-Agent", ua)
+	feed.Authorize(req)
+
+	return req, nil
+}
@@ -0,0 +1,154 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"jaypod/pkg/subscription"
+)
+
+func TestClientUserAgentAndRedirects(t *testing.T) {
+	var agent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/loop" {
+			http.Redirect(w, r, "/loop", http.StatusFound)
+			return
+		}
+		agent = r.Header.Get("User-Agent")
+	}))
+	defer srv.Close()
+
+	maxRedirects := 3
+	e, err := New(Config{UserAgent: "engine-agent", MaxRedirects: &maxRedirects})
+	if err != nil {
+		t.Fatalf("failed creating engine: %v", err)
+	}
+
+	var agents = []struct {
+		feed     *subscription.Feed
+		expected string
+	}{
+		{&subscription.Feed{}, "engine-agent"},
+		{&subscription.Feed{UserAgent: "feed-agent"}, "feed-agent"},
+	}
+
+	for i, x := range agents {
+		req, err := e.newRequest(x.feed, srv.URL+"/ok")
+		if err != nil {
+			t.Fatalf("agents[%d] - failed creating request: %v", i, err)
+		}
+		resp, err := e.client.Do(req)
+		if err != nil {
+			t.Fatalf("agents[%d] - request failed: %v", i, err)
+		}
+		resp.Body.Close()
+		if agent != x.expected {
+			t.Errorf("agents[%d] - expected user agent %s, got %s", i, x.expected, agent)
+		}
+	}
+
+	req, _ := e.newRequest(&subscription.Feed{}, srv.URL+"/loop")
+	if _, err := e.client.Do(req); err == nil {
+		t.Errorf("expected redirect loop to fail")
+	}
+
+	maxRedirects = 0
+	e, err = New(Config{MaxRedirects: &maxRedirects})
+	if err != nil {
+		t.Fatalf("failed creating engine: %v", err)
+	}
+	req, _ = e.newRequest(&subscription.Feed{}, srv.URL+"/loop")
+	if _, err := e.client.Do(req); err == nil || !strings.Contains(err.Error(), "stopped after 0 redirects") {
+		t.Errorf("expected redirects to be disabled, got %v", err)
+	}
+
+	if _, err := New(Config{Proxy: "ftp://proxy.example.com"}); err == nil {
+		t.Errorf("expected error for unsupported proxy scheme")
+	}
+}
+
+func TestClientAuthStaysOnFeedHost(t *testing.T) {
+	var cdnHeader string
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cdnHeader = r.Header.Get("X-Client") + r.Header.Get("Authorization")
+	}))
+	defer cdn.Close()
+
+	var feedHeader string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ep.mp3" {
+			// the same server under another name
+			http.Redirect(w, r, strings.Replace(cdn.URL, "127.0.0.1", "localhost", 1)+"/ep.mp3", http.StatusFound)
+			return
+		}
+		feedHeader = r.Header.Get("X-Client")
+	}))
+	defer srv.Close()
+
+	e, err := New(Config{})
+	if err != nil {
+		t.Fatalf("failed creating engine: %v", err)
+	}
+	feed := &subscription.Feed{
+		Url:     srv.URL + "/rss",
+		Headers: map[string]string{"X-Client": "podfetch-test"},
+		Auth:    &subscription.Auth{Type: "bearer", Token: "${TOKEN}"},
+	}
+	if err := feed.Resolve(subscription.Secrets{"TOKEN": "hunter2"}); err != nil {
+		t.Fatalf("failed resolving feed: %v", err)
+	}
+
+	for _, u := range []string{srv.URL + "/rss", srv.URL + "/ep.mp3"} {
+		req, err := e.newRequest(feed, u)
+		if err != nil {
+			t.Fatalf("failed creating request: %v", err)
+		}
+		resp, err := e.client.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+	if feedHeader != "podfetch-test" {
+		t.Errorf("expected headers sent to the feed's host, got %q", feedHeader)
+	}
+	if cdnHeader != "" {
+		t.Errorf("expected no auth or headers sent to another host, got %q", cdnHeader)
+	}
+
+	feed.AuthHosts = []string{"localhost"}
+	req, _ := e.newRequest(feed, srv.URL+"/ep.mp3")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if cdnHeader != "podfetch-testBearer hunter2" {
+		t.Errorf("expected auth and headers sent to auth_hosts, got %q", cdnHeader)
+	}
+}
+
+func TestFeedErrorsHideSecrets(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	e, err := New(Config{})
+	if err != nil {
+		t.Fatalf("failed creating engine: %v", err)
+	}
+	feed := &subscription.Feed{Name: "Test", Url: srv.URL + "/rss?auth=${TOKEN}"}
+	if err := feed.Resolve(subscription.Secrets{"TOKEN": "hunter2"}); err != nil {
+		t.Fatalf("failed resolving feed: %v", err)
+	}
+
+	_, _, err = e.readFeed(feed, time.Time{}, nil)
+	if err == nil {
+		t.Fatalf("expected an error from a closed server")
+	}
+	if strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("expected the secret kept out of the error, got %v", err)
+	}
+}
@@ -1,7 +1,10 @@
 package engine
 
 import (
-	"context"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -10,36 +13,67 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"jaypod/pkg/rss"
+	"jaypod/pkg/state"
+	"jaypod/pkg/subscription"
 )
 
-func download(podcast *rss.RssItem, rootdir string, dest string, basename string, incoming bool, sublog *slog.Logger) error {
+// Episodes whose filters say so are also copied here, under the output
+// directory
+const incomingDir = "Incoming"
 
-	destDir := fmt.Sprintf("%s/%s", rootdir, dest)
-	if err := os.MkdirAll(destDir, 0777); err != nil {
-		return fmt.Errorf("failed creating %s: %v", destDir, err)
+// errSkipped is returned for downloads that turned out to be duplicates of
+// files already in the library, or that the collision policy dropped.
+var errSkipped = errors.New("download skipped")
+
+// saved is where a download ended up: its path, and the path of its copy
+// in Incoming if it has one.
+type saved struct {
+	path     string
+	incoming string
+}
+
+// download fetches a queued episode, falling back through its alternate
+// versions if it can't be had from its url.  It returns where it was
+// saved, or errSkipped if there was no need to keep it.
+func (e *Engine) download(q *state.QueueItem, feed *subscription.Feed, st *state.State, rootdir string, sublog *slog.Logger) (saved, error) {
+	var errs []error
+	for i, src := range q.Sources() {
+		if i > 0 {
+			sublog.Warn("trying alternate enclosure", "url", src.Url, "err", errs[i-1])
+		}
+		s, err := e.downloadFrom(q, src, feed, st, rootdir, sublog)
+		if err == nil || errors.Is(err, errSkipped) {
+			return s, err
+		}
+		errs = append(errs, err)
 	}
+	return saved{}, errors.Join(errs...)
+}
 
-	cl := &http.Client{}
+func (e *Engine) downloadFrom(q *state.QueueItem, src state.Source, feed *subscription.Feed, st *state.State, rootdir string, sublog *slog.Logger) (saved, error) {
 
-	req, err := http.NewRequestWithContext(context.Background(),
-		"GET", podcast.Url(), nil)
-	if err != nil {
-		return fmt.Errorf("failed creating request %v: %v", podcast.Url(), err)
+	destDir := fmt.Sprintf("%s/%s", rootdir, q.Dest)
+	if err := os.MkdirAll(destDir, 0777); err != nil {
+		return saved{}, fmt.Errorf("failed creating %s: %v", destDir, err)
 	}
 
-	req.Header.Set("User-Agent", "podfetch/1.0")
+	req, err := e.newRequest(feed, src.Url)
+	if err != nil {
+		return saved{}, fmt.Errorf("failed creating request %v: %v", src.Url, err)
+	}
 
-	resp, err := cl.Do(req)
+	resp, err := e.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed getting %s: %v", podcast.Url(), err)
+		return saved{}, fmt.Errorf("failed getting %s: %v", src.Url, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad response code from %s: %d: %s\n",
-			podcast.Url(), resp.StatusCode, http.StatusText(resp.StatusCode))
+		return saved{}, fmt.Errorf("bad response code from %s: %d: %s\n",
+			src.Url, resp.StatusCode, http.StatusText(resp.StatusCode))
 	}
 
 	filenameWithExt := contentDispositionFilename(resp, sublog)
@@ -49,12 +83,27 @@ func download(podcast *rss.RssItem, rootdir string, dest string, basename string
 
 	fname, extension := split(filenameWithExt)
 
+	buffered := bufio.NewReader(resp.Body)
+	if src.Type == "" {
+		// queued without knowing what it is, so it's checked now
+		mimeType := sniffType(resp, buffered)
+		if mimeType == "" {
+			mimeType = rss.TypeForExtension(extension)
+		}
+		if !feed.Accepts(mimeType) {
+			sublog.Info("not a wanted type of media, skipping", "type", mimeType)
+			return saved{}, errSkipped
+		}
+	}
+	if extension == "" {
+		extension = rss.ExtensionForType(src.Type)
+	}
 	if extension == "" {
-		extension = podcast.ExtensionFromMimeType()
+		extension = sniffExtension(resp, buffered)
 	}
 
-	if basename != "" {
-		fname = basename
+	if q.Basename != "" {
+		fname = q.Basename
 	}
 
 	fname = escape(fname)
@@ -63,60 +112,176 @@ func download(podcast *rss.RssItem, rootdir string, dest string, basename string
 		fname = fname[:250]
 	}
 
-	fullpath := fmt.Sprintf("%s/%s.%s", destDir, fname, extension)
-	exists := func(path string) bool {
-		_, err := os.Lstat(fullpath)
-		return err == nil
+	tmp, err := os.CreateTemp(destDir, ".podfetch-*.part")
+	if err != nil {
+		return saved{}, fmt.Errorf("failed to create temp file in %s: %v", destDir, err)
 	}
-	i := 1
-	for exists(fullpath) {
-		// File already exists.  Try to uniquify
-		fullpath = fmt.Sprintf("%s/dupe%d_%s.%s", destDir, i, fname, extension)
-		i++
+	tmpPath := tmp.Name()
+
+	h := sha256.New()
+	body := e.limitReader(buffered, resp.Request.URL.Hostname())
+	_, err = io.Copy(io.MultiWriter(tmp, h), body)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return saved{}, fmt.Errorf("failed to write podcast file %s: %v", tmpPath, err)
 	}
 
-	out, err := os.OpenFile(fullpath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	err = tmp.Close()
 	if err != nil {
-		return fmt.Errorf("failed to create podcast file %s: %v", fullpath, err)
+		os.Remove(tmpPath)
+		return saved{}, fmt.Errorf("failed to close podcast file %s: %v", tmpPath, err)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	if prev, ok := st.HashPath(sum); ok {
+		// The file may have since been removed or replaced
+		if same, _, _ := sameContents(rootdir+"/"+prev, sum); same {
+			sublog.Info("duplicate of existing file, skipping", "existing", prev)
+			os.Remove(tmpPath)
+			return saved{}, errSkipped
+		}
+		st.ForgetHash(sum)
 	}
 
-	_, err = io.Copy(out, resp.Body)
+	fullpath, dupe, err := chooseDestination(destDir, fname, extension, sum, feed.Collision, q.PubDate)
 	if err != nil {
-		out.Close()
-		os.Remove(fullpath)
-		return fmt.Errorf("failed to write podcast file %s: %v", fullpath, err)
+		os.Remove(tmpPath)
+		return saved{}, err
+	}
+	if dupe || fullpath == "" {
+		if dupe {
+			sublog.Info("duplicate of existing file, skipping", "existing", fullpath)
+			st.RecordHash(sum, relPath(rootdir, fullpath))
+		} else {
+			sublog.Info("filename collision, skipping")
+		}
+		os.Remove(tmpPath)
+		return saved{}, errSkipped
 	}
 
-	err = out.Close()
+	err = os.Chmod(tmpPath, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to close podcast file %s: %v", fullpath, err)
+		os.Remove(tmpPath)
+		return saved{}, fmt.Errorf("failed to chmod podcast file %s: %v", tmpPath, err)
 	}
 
-	err = os.Chtimes(fullpath, podcast.Date(), podcast.Date())
+	err = os.Rename(tmpPath, fullpath)
 	if err != nil {
-		return fmt.Errorf("failed to change times on  podcast file %s: %v", fullpath, err)
+		os.Remove(tmpPath)
+		return saved{}, fmt.Errorf("failed to rename %s to %s: %v", tmpPath, fullpath, err)
 	}
 
-	if incoming {
-		incomingDir := fmt.Sprintf("%s/Incoming", rootdir)
-		if err := os.MkdirAll(incomingDir, 0777); err != nil {
-			return fmt.Errorf("failed creating %s: %v", incomingDir, err)
-		}
+	err = os.Chtimes(fullpath, q.PubDate, q.PubDate)
+	if err != nil {
+		os.Remove(fullpath)
+		return saved{}, fmt.Errorf("failed to change times on  podcast file %s: %v", fullpath, err)
+	}
 
-		dst := fmt.Sprintf("%s/%s.%s", incomingDir, fname, extension)
-		err := CopyFile(fullpath, dst)
+	s := saved{path: fullpath}
+	if q.Incoming {
+		s.incoming, err = copyToIncoming(rootdir, fullpath, sum, feed.Collision, q.PubDate)
 		if err != nil {
-			return fmt.Errorf("failed to copy %s to incoming: %v", fullpath, err)
+			// so a retry downloads it afresh rather than taking it for a
+			// duplicate
+			os.Remove(fullpath)
+			return saved{}, fmt.Errorf("failed to copy %s to incoming: %v", fullpath, err)
+		}
+		if s.incoming == "" {
+			sublog.Info("filename collision in incoming, not copying")
 		}
+	}
 
-		err = os.Chtimes(dst, podcast.Date(), podcast.Date())
-		if err != nil {
-			return fmt.Errorf("failed to change times on  podcast file %s: %v", dst, err)
+	// only once the download is all in place, so a failure part way is
+	// retried
+	st.RecordHash(sum, relPath(rootdir, fullpath))
+
+	return s, nil
+}
+
+// chooseDestination picks the path a download with the given content hash
+// should be saved to.  It returns dupe if an identical file already occupies
+// the candidate path, and an empty path if the collision policy says to drop
+// the download.
+func chooseDestination(destDir, fname, extension, sum, policy string, date time.Time) (string, bool, error) {
+	fullpath := fmt.Sprintf("%s/%s.%s", destDir, fname, extension)
+
+	same, exists, err := sameContents(fullpath, sum)
+	if err != nil || !exists || same {
+		return fullpath, same, err
+	}
+
+	switch policy {
+	case subscription.CollisionSkip:
+		return "", false, nil
+	case subscription.CollisionOverwrite:
+		return fullpath, false, nil
+	case subscription.CollisionSuffixDate:
+		fname = fmt.Sprintf("%s %s", fname, date.Format("2006-01-02"))
+		fullpath = fmt.Sprintf("%s/%s.%s", destDir, fname, extension)
+		same, exists, err = sameContents(fullpath, sum)
+		if err != nil || !exists || same {
+			return fullpath, same, err
 		}
+	}
+
+	for i := 2; ; i++ {
+		fullpath = fmt.Sprintf("%s/%s (%d).%s", destDir, fname, i, extension)
+		same, exists, err = sameContents(fullpath, sum)
+		if err != nil || !exists || same {
+			return fullpath, same, err
+		}
+	}
+}
+
+func sameContents(path string, sum string) (bool, bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, false, nil
+	} else if err != nil {
+		return false, true, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, true, fmt.Errorf("failed to hash %s: %v", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)) == sum, true, nil
+}
+
+// copyToIncoming copies an episode downloaded to path into Incoming, where
+// it's named by the feed's collision policy just as it was in its own
+// directory.  It returns where the copy went, or "" if the policy dropped
+// it.
+func copyToIncoming(rootdir, path, sum, policy string, date time.Time) (string, error) {
+	dir := filepath.Join(rootdir, incomingDir)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", fmt.Errorf("failed creating %s: %v", dir, err)
+	}
 
+	fname, extension := split(filepath.Base(path))
+	dst, dupe, err := chooseDestination(dir, fname, extension, sum, policy, date)
+	if err != nil || dst == "" {
+		return "", err
 	}
+	if !dupe {
+		if err := CopyFile(path, dst); err != nil {
+			return "", err
+		}
+	}
+	if err := os.Chtimes(dst, date, date); err != nil {
+		return "", fmt.Errorf("failed to change times on  podcast file %s: %v", dst, err)
+	}
+	return dst, nil
+}
 
-	return nil
+func relPath(rootdir, path string) string {
+	rel, err := filepath.Rel(rootdir, path)
+	if err != nil {
+		return path
+	}
+	return rel
 }
 
 func contentDispositionFilename(resp *http.Response, sublog *slog.Logger) string {
@@ -147,6 +312,22 @@ func contentDispositionFilename(resp *http.Response, sublog *slog.Logger) string
 	return fname
 }
 
+// sniffExtension works out a download's extension from what the server
+// says it is, or failing that from the first bytes of its body.
+func sniffExtension(resp *http.Response, body *bufio.Reader) string {
+	return rss.ExtensionForType(sniffType(resp, body))
+}
+
+// sniffType works out what kind of media a download is in the same way,
+// returning "" if it's none that's known.
+func sniffType(resp *http.Response, body *bufio.Reader) string {
+	if t := rss.KnownType(resp.Header.Get("Content-Type")); t != "" {
+		return t
+	}
+	head, _ := body.Peek(512)
+	return rss.KnownType(http.DetectContentType(head))
+}
+
 func split(fname string) (string, string) {
 
 	sep := strings.LastIndex(fname, ".")
@@ -169,6 +350,9 @@ func escape(fname string) string {
 	return fname
 }
 
+// CopyFile copies src to dst, replacing whatever is there.  The copy is
+// made alongside dst and renamed into place, so dst is never left half
+// written.
 func CopyFile(src, dst string) error {
 	srcF, err := os.Open(src)
 	if err != nil {
@@ -181,14 +365,22 @@ func CopyFile(src, dst string) error {
 		return err
 	}
 
-	dstF, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode())
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".podfetch-*.part")
 	if err != nil {
 		return err
 	}
-	defer dstF.Close()
-
-	if _, err := io.Copy(dstF, srcF); err != nil {
-		return err
+	_, err = io.Copy(tmp, srcF)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), info.Mode())
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
 	}
-	return nil
+	return err
 }
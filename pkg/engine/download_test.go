@@ -1,12 +1,19 @@
 package engine
 
 import (
-/*
-	"context"
-	"fmt"
+	"errors"
+	"log/slog"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
-*/
+	"time"
+
+	"jaypod/pkg/state"
+	"jaypod/pkg/subscription"
 )
 
 /*
@@ -45,3 +52,241 @@ func TestAcast(t *testing.T) {
 	}
 }
 */
+
+// newTestState loads a state from an empty state file.
+func newTestState(t *testing.T) *state.State {
+	t.Helper()
+	stateFile := filepath.Join(t.TempDir(), "state.yaml")
+	if err := os.WriteFile(stateFile, nil, 0666); err != nil {
+		t.Fatalf("failed writing state file: %v", err)
+	}
+	st, err := state.LoadState(stateFile)
+	if err != nil {
+		t.Fatalf("failed loading state: %v", err)
+	}
+	return st
+}
+
+func newTestEngine(t *testing.T, cfg Config) *Engine {
+	t.Helper()
+	e, err := New(cfg)
+	if err != nil {
+		t.Fatalf("failed creating engine: %v", err)
+	}
+	return e
+}
+
+func TestDownloadCollisions(t *testing.T) {
+	body := "first"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	rootdir := t.TempDir()
+	st := newTestState(t)
+	e := newTestEngine(t, Config{})
+
+	item := &state.QueueItem{
+		Feed:    "Test",
+		Url:     srv.URL + "/ep1.mp3",
+		Title:   "Episode 1",
+		PubDate: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		Type:    "audio/mpeg",
+		Dest:    "Test",
+	}
+
+	var steps = []struct {
+		body     string
+		policy   string
+		basename string
+		skipped  bool
+		expected []string
+	}{
+		{"first", subscription.CollisionSuffixNumber, "", false, []string{"ep1.mp3"}},
+		// same contents under the same name
+		{"first", subscription.CollisionSuffixNumber, "", true, []string{"ep1.mp3"}},
+		// same contents under a different name
+		{"first", subscription.CollisionSuffixNumber, "renamed", true, []string{"ep1.mp3"}},
+		{"second", subscription.CollisionSkip, "", true, []string{"ep1.mp3"}},
+		{"second", subscription.CollisionSuffixNumber, "", false, []string{"ep1 (2).mp3", "ep1.mp3"}},
+		{"third", subscription.CollisionSuffixDate, "", false, []string{"ep1 (2).mp3", "ep1 2024-03-01.mp3", "ep1.mp3"}},
+		{"fourth", subscription.CollisionOverwrite, "", false, []string{"ep1 (2).mp3", "ep1 2024-03-01.mp3", "ep1.mp3"}},
+	}
+
+	for i, x := range steps {
+		body = x.body
+		feed := &subscription.Feed{Name: "Test", Collision: x.policy}
+		item.Basename = x.basename
+		_, err := e.download(item, feed, st, rootdir, slog.Default())
+		if x.skipped {
+			if !errors.Is(err, errSkipped) {
+				t.Fatalf("steps[%d] - expected download to be skipped, got %v", i, err)
+			}
+		} else if err != nil {
+			t.Fatalf("steps[%d] - download failed: %v", i, err)
+		}
+
+		entries, err := os.ReadDir(filepath.Join(rootdir, "Test"))
+		if err != nil {
+			t.Fatalf("steps[%d] - failed reading dir: %v", i, err)
+		}
+		names := []string{}
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		sort.Strings(names)
+
+		if len(names) != len(x.expected) {
+			t.Fatalf("steps[%d] - expected files %v, got %v", i, x.expected, names)
+		}
+		for j := range names {
+			if names[j] != x.expected[j] {
+				t.Fatalf("steps[%d] - expected files %v, got %v", i, x.expected, names)
+			}
+		}
+	}
+
+	contents, err := os.ReadFile(filepath.Join(rootdir, "Test", "ep1.mp3"))
+	if err != nil || string(contents) != "fourth" {
+		t.Fatalf("expected overwritten file, got %q (%v)", contents, err)
+	}
+}
+
+func TestDownloadSniffsExtension(t *testing.T) {
+	var downloads = []struct {
+		contentType string
+		body        string
+		mediaTypes  string
+		expected    string
+	}{
+		{"video/mp4", "not really", "[video]", "episode.mp4"},
+		{"application/octet-stream", "%PDF-1.4 notes", "[application/pdf]", "episode.pdf"},
+		{"application/octet-stream", "ID3\x04\x00 audio", "[audio]", "episode.mp3"},
+		// checked against media_types once it's known what they are
+		{"video/mp4", "not really", "[audio]", ""},
+		{"application/octet-stream", "%PDF-1.4 notes", "[audio, video]", ""},
+		{"text/html", "<html>sign in</html>", "[audio]", ""},
+	}
+
+	for i, x := range downloads {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", x.contentType)
+			w.Write([]byte(x.body))
+		}))
+
+		rootdir := t.TempDir()
+		st := newTestState(t)
+		e := newTestEngine(t, Config{})
+
+		feeds, err := subscription.ParseFeeds([]byte("feeds:\n  - name: Test\n    url: http://example.com/rss\n    media_types: " + x.mediaTypes + "\n"))
+		if err != nil {
+			t.Fatalf("downloads[%d] - parse error: %v", i, err)
+		}
+		item := &state.QueueItem{Feed: "Test", Url: srv.URL + "/episode", Dest: "Test"}
+		_, err = e.download(item, feeds[0], st, rootdir, slog.Default())
+		srv.Close()
+
+		if x.expected == "" {
+			if entries, _ := os.ReadDir(filepath.Join(rootdir, "Test")); !errors.Is(err, errSkipped) || len(entries) != 0 {
+				t.Errorf("downloads[%d] - expected an unwanted type to be skipped, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("downloads[%d] - download failed: %v", i, err)
+		}
+		if _, err := os.Stat(filepath.Join(rootdir, "Test", x.expected)); err != nil {
+			t.Errorf("downloads[%d] - expected %s: %v", i, x.expected, err)
+		}
+	}
+}
+
+func TestDownloadFallsBack(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/low.opus" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("opus"))
+	}))
+	defer srv.Close()
+
+	rootdir := t.TempDir()
+	st := newTestState(t)
+	e := newTestEngine(t, Config{})
+
+	item := &state.QueueItem{
+		Feed: "Test",
+		Url:  srv.URL + "/high.m4a",
+		Type: "audio/mp4",
+		Dest: "Test",
+		Alternates: []state.Source{
+			{Url: srv.URL + "/mirror/high.m4a", Type: "audio/mp4"},
+			{Url: srv.URL + "/low.opus", Type: "audio/opus"},
+		},
+	}
+	feed := &subscription.Feed{Name: "Test", Collision: subscription.CollisionSuffixNumber}
+	if _, err := e.download(item, feed, st, rootdir, slog.Default()); err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	if contents, err := os.ReadFile(filepath.Join(rootdir, "Test", "low.opus")); err != nil || string(contents) != "opus" {
+		t.Errorf("expected the alternate, got %q (%v)", contents, err)
+	}
+
+	item.Alternates = item.Alternates[:1]
+	if _, err := e.download(item, feed, st, rootdir, slog.Default()); err == nil || !strings.Contains(err.Error(), "mirror") {
+		t.Errorf("expected every url's error, got %v", err)
+	}
+}
+
+func TestDownloadIntoTakenIncoming(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new"))
+	}))
+	defer srv.Close()
+
+	var policies = []struct {
+		policy   string
+		expected []string
+	}{
+		{subscription.CollisionOverwrite, []string{"ep.mp3"}},
+		{subscription.CollisionSuffixNumber, []string{"ep (2).mp3", "ep.mp3"}},
+	}
+
+	for i, x := range policies {
+		rootdir := t.TempDir()
+		st := newTestState(t)
+		e := newTestEngine(t, Config{})
+
+		incoming := filepath.Join(rootdir, incomingDir)
+		if err := os.MkdirAll(incoming, 0777); err != nil {
+			t.Fatalf("failed creating %s: %v", incoming, err)
+		}
+		if err := os.WriteFile(filepath.Join(incoming, "ep.mp3"), []byte("old"), 0644); err != nil {
+			t.Fatalf("failed writing incoming file: %v", err)
+		}
+
+		item := &state.QueueItem{Feed: "Test", Url: srv.URL + "/ep.mp3", Dest: "Test", Incoming: true}
+		feed := &subscription.Feed{Name: "Test", Collision: x.policy}
+		s, err := e.download(item, feed, st, rootdir, slog.Default())
+		if err != nil {
+			t.Fatalf("policies[%d] - download failed: %v", i, err)
+		}
+
+		entries, _ := os.ReadDir(incoming)
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		if strings.Join(names, ",") != strings.Join(x.expected, ",") {
+			t.Errorf("policies[%d] - expected %v in incoming, got %v", i, x.expected, names)
+		}
+		if contents, err := os.ReadFile(s.incoming); err != nil || string(contents) != "new" {
+			t.Errorf("policies[%d] - expected the copy at %s, got %q (%v)", i, s.incoming, contents, err)
+		}
+		if len(st.HashedPaths()) != 1 {
+			t.Errorf("policies[%d] - expected the download's hash recorded, got %v", i, st.HashedPaths())
+		}
+	}
+}
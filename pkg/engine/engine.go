@@ -1,10 +1,9 @@
 package engine
 
 import (
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
-	"net/http"
 	"slices"
 	"time"
 
@@ -13,106 +12,275 @@ import (
 	"jaypod/pkg/subscription"
 )
 
-func Fetch(feeds []*subscription.Feed, state *state.State, rootdir string, testmode bool) (int, error) {
-	numDownloads := 0
-	for _, feed := range feeds {
-		resp, err := http.Get(feed.Url)
-		if err != nil {
-			return numDownloads, fmt.Errorf("failed getting %s: %v", feed.Url, err)
-		}
+// Fetch polls the feeds that are due, or all of them if force is set,
+// queueing newly matched episodes, and then drains the download queue.  It
+// returns the number of episodes downloaded.
+func (e *Engine) Fetch(feeds []*subscription.Feed, state *state.State, rootdir string, testmode bool, force bool) (int, error) {
+	poll := feeds
+	if !force {
+		poll = e.Due(feeds, state, time.Now())
+	}
 
-		contents, err := io.ReadAll(resp.Body)
-		resp.Body.Close()
+	pollErr := e.Poll(poll, state, rootdir, testmode)
 
-		rc, err := rss.ParseRss([]byte(contents))
-		if err != nil {
-			return numDownloads, fmt.Errorf("parse error on %s: %v", feed.Url, err)
+	if testmode {
+		return 0, pollErr
+	}
+
+	downloads, err := e.Drain(feeds, state, rootdir)
+	return downloads, errors.Join(pollErr, err)
+}
+
+// Poll fetches each feed and adds episodes newer than its watermark that
+// match one of its filters to the download queue.  Each feed's next poll
+// time is recorded in the state, even if polling it fails.
+func (e *Engine) Poll(feeds []*subscription.Feed, state *state.State, rootdir string, testmode bool) error {
+	var errs []error
+	for _, feed := range feeds {
+		if err := e.pollFeed(feed, state, rootdir, testmode); err != nil {
+			errs = append(errs, err)
 		}
 
-		last := state.Last(feed.Name)
-		newLast, newDownloads, err := fetchNewFromFeed(rc, feed, rootdir, last, testmode)
+		err := state.Flush()
 		if err != nil {
-			return numDownloads, err
+			return fmt.Errorf("error flushing state: %v\n", err)
 		}
-		numDownloads += newDownloads
-		state.Update(feed.Name, newLast)
+	}
 
-		err = state.Flush()
-		if err != nil {
-			return numDownloads, fmt.Errorf("error flushing state: %v\n", err)
+	return errors.Join(errs...)
+}
+
+func (e *Engine) pollFeed(feed *subscription.Feed, state *state.State, rootdir string, testmode bool) error {
+	now := time.Now()
+	retry, _ := e.interval(feed, nil, nil)
+	state.Schedule(feed.Name, now, now.Add(retry), "last poll failed")
+
+	last := state.Last(feed.Name)
+	// older pages are only needed if there may be unseen episodes before
+	// those of the first, or the initial policy might want them
+	older := func(items []*rss.RssItem) bool {
+		if last.IsZero() {
+			read := rss.RssContainer{Feed: rss.RssChannel{Items: items}}
+			return feed.InitiallyWantsOlder(oldest(items), len(matchEpisodes(feed, acceptedPodcasts(read, feed))))
 		}
+		return last.Before(oldest(items))
+	}
+	rc, header, err := e.readFeed(feed, last, older)
+	if err != nil {
+		return err
+	}
 
+	dates := make([]time.Time, 0, len(rc.Feed.Items))
+	for _, item := range rc.Feed.Items {
+		if !item.Undated {
+			dates = append(dates, item.PubDate)
+		}
 	}
+	state.RecordPublished(feed.Name, dates)
+	state.SetImage(feed.Name, rc.Feed.ImageUrl())
+	if !testmode {
+		e.refreshCovers(feed, state, rootdir)
+	}
+
+	next, reason := e.nextPoll(feed, &rc.Feed, header, state.Published(feed.Name), now)
+	state.Schedule(feed.Name, now, next, reason)
+	slog.Debug("polled feed",
+		"feed", feed.Name,
+		"next", next,
+		"reason", reason)
+
+	newLast := e.fetchNewFromFeed(rc, feed, state, rootdir, last, testmode)
+	state.Update(feed.Name, newLast)
 
-	return numDownloads, nil
+	return nil
 }
 
-func fetchNewFromFeed(rc rss.RssContainer, feed *subscription.Feed, rootdir string, last time.Time, testmode bool) (time.Time, int, error) {
+// episode is a feed item matched by one of the feed's filters, and where
+// it's to be saved.
+type episode struct {
+	p        *rss.RssItem
+	dest     string
+	basename string
+	incoming bool
+}
 
-	podcasts := rc.Podcasts()
+func (e *Engine) fetchNewFromFeed(rc rss.RssContainer, feed *subscription.Feed, st *state.State, rootdir string, last time.Time, testmode bool) time.Time {
 
-	newPodcasts := make([]*rss.RssItem, 0, len(podcasts))
-	for _, p := range podcasts {
-		if p.PubDate.After(last) {
+	var newPodcasts []*rss.RssItem
+	for _, p := range acceptedPodcasts(rc, feed) {
+		if p.Undated {
+			// the watermark can't say whether these are new
+			if !st.SeenUndated(feed.Name, p.Id()) {
+				newPodcasts = append(newPodcasts, p)
+			}
+		} else if p.PubDate.After(last) {
 			newPodcasts = append(newPodcasts, p)
 		}
 	}
-
-	// sort oldest to newest, so we can advance the last even if we
-	// don't get all the podcasts this time
-	slices.SortFunc(newPodcasts, func(a, b *rss.RssItem) int {
-		return a.PubDate.Compare(b.PubDate)
-	})
+	matched := matchEpisodes(feed, newPodcasts)
 
 	newLast := last
 
-	numDownloads := 0
-	for _, p := range newPodcasts {
-		match, dest, basename, incoming := feed.MatchAndMap(p)
-		if match && dest != "" {
-			sublog := slog.With(
+	// The first time a feed is polled its initial policy decides which
+	// episodes are wanted, and the rest are left for backfill.  Either
+	// way they've all been seen.
+	if last.IsZero() {
+		initial := make([]episode, 0, len(matched))
+		for i, m := range matched {
+			if feed.InitiallyWanted(m.p, len(matched)-1-i) {
+				initial = append(initial, m)
+			}
+		}
+		if len(initial) < len(matched) {
+			slog.Info("leaving older episodes for backfill",
 				"feed", feed.Name,
-				"podcast", p.Enclosure.Url,
-				"basename", basename,
-				"dest", dest,
-				"incoming", incoming)
-
-			err := act(testmode, p, rootdir, dest, basename, incoming, sublog)
-			if err != nil {
-				sublog.Error("", "err", err)
+				"initial", feed.Initial,
+				"episodes", len(matched)-len(initial))
+		}
+		matched = initial
+
+		for _, p := range newPodcasts {
+			if p.Undated {
+				st.RecordUndated(feed.Name, p.Id())
+			} else if p.PubDate.After(newLast) {
+				newLast = p.PubDate
+			}
+		}
+		// backfill takes episodes from before the oldest wanted now, or
+		// if none are, up to and including the newest
+		var before time.Time
+		for _, m := range matched {
+			if !m.p.Undated {
+				before = m.p.PubDate
 				break
 			}
+		}
+		if before.IsZero() && !newLast.IsZero() {
+			before = newLast.Add(time.Second)
+		}
+		st.SetBackfill(feed.Name, time.Time{}, before)
+	}
 
-			sublog.Info("downloaded podcast")
-			numDownloads++
+	for _, m := range matched {
+		if !e.queueEpisode(m, feed, &rc.Feed, st, rootdir, testmode) {
+			continue
+		}
+		if m.p.Undated {
+			st.RecordUndated(feed.Name, m.p.Id())
+		} else if m.p.PubDate.After(newLast) {
+			newLast = m.p.PubDate
+		}
+	}
 
-			if p.PubDate.After(newLast) {
-				newLast = p.PubDate
-			}
+	return newLast
+}
+
+// acceptedPodcasts returns the feed's items with an enclosure of a type it
+// wants, oldest first.
+func acceptedPodcasts(rc rss.RssContainer, feed *subscription.Feed) []*rss.RssItem {
+	podcasts := rc.Podcasts()
+
+	accepted := make([]*rss.RssItem, 0, len(podcasts))
+	for _, p := range podcasts {
+		ok := slices.ContainsFunc(p.AllEnclosures(), func(e rss.RssEnclosure) bool {
+			return feed.Considers(e.Type())
+		})
+		if !ok {
+			slog.Debug("no enclosure of a wanted type",
+				"feed", feed.Name,
+				"podcast", p.Url(),
+				"type", p.Type())
+			continue
 		}
+		accepted = append(accepted, p)
 	}
 
-	return newLast, numDownloads, nil
+	// sort oldest to newest, so episodes are queued in the order they
+	// were published
+	slices.SortStableFunc(accepted, func(a, b *rss.RssItem) int {
+		return a.PubDate.Compare(b.PubDate)
+	})
+	return accepted
 }
 
-func act(testmode bool, podcast *rss.RssItem, rootdir string, dest string, basename string, incoming bool, sublog *slog.Logger) error {
-	if testmode {
-		return trialRun(podcast, rootdir, dest, basename, incoming)
-	} else {
-		return download(podcast, rootdir, dest, basename, incoming, sublog)
+// matchEpisodes runs podcasts through the feed's filters, keeping those
+// that are to be downloaded.
+func matchEpisodes(feed *subscription.Feed, podcasts []*rss.RssItem) []episode {
+	var matched []episode
+	for _, p := range podcasts {
+		match, dest, basename, incoming := feed.MatchAndMap(p)
+		if match && dest != "" {
+			matched = append(matched, episode{p: p, dest: dest, basename: basename, incoming: incoming})
+		}
+	}
+	return matched
+}
+
+// queueEpisode adds a matched episode's files to the download queue, or in
+// test mode says what would be downloaded.  Only the episode itself gets
+// artwork and sidecars; files like show notes are just downloaded next to
+// it.  It returns false if none of the episode's enclosures will do.
+func (e *Engine) queueEpisode(m episode, feed *subscription.Feed, channel *rss.RssChannel, st *state.State, rootdir string, testmode bool) bool {
+	p := m.p
+	sublog := slog.With(
+		"feed", feed.Name,
+		"podcast", p.Enclosure.Url,
+		"basename", m.basename,
+		"dest", m.dest,
+		"incoming", m.incoming)
+
+	files := feed.Files(p)
+	if len(files) == 0 {
+		sublog.Warn("no enclosure meets the filter's preferences, skipping")
+		return false
+	}
+	duration := 0
+	if d, ok := p.DurationValue(); ok {
+		duration = int(d.Round(time.Second).Seconds())
+	}
+
+	for i, enclosures := range files {
+		var alternates []state.Source
+		for _, a := range enclosures[1:] {
+			alternates = append(alternates, state.Source{Url: a.Url, Type: a.Type()})
+		}
+
+		q := &state.QueueItem{
+			Feed:       feed.Name,
+			Url:        enclosures[0].Url,
+			Title:      p.Title(),
+			PubDate:    p.PubDate,
+			Type:       enclosures[0].Type(),
+			Dest:       m.dest,
+			Basename:   m.basename,
+			Incoming:   m.incoming,
+			Priority:   feed.Priority,
+			Added:      time.Now(),
+			Alternates: alternates,
+		}
+		if i == 0 {
+			q.Duration = duration
+			q.Image = p.ImageUrl()
+			queueSidecars(q, feed.Sidecars(p), channel, p)
+		}
+
+		if testmode {
+			trialRun(p, enclosures[0], rootdir, m.dest, m.basename, m.incoming)
+		} else if st.Enqueue(q) {
+			sublog.Info("queued podcast", "url", q.Url)
+		}
 	}
+	return true
 }
 
-func trialRun(podcast *rss.RssItem, rootdir string, dest string, basename string, incoming bool) error {
+func trialRun(podcast *rss.RssItem, enclosure rss.RssEnclosure, rootdir string, dest string, basename string, incoming bool) {
 
-	fmt.Printf("%s: would download to %s/%s", podcast.Title(), rootdir, dest)
+	fmt.Printf("%s: would download %s to %s/%s", podcast.Title(), enclosure.Url, rootdir, dest)
 	if basename != "" {
 		fmt.Printf(" and rename to %s", basename)
 	}
 	if incoming {
-		fmt.Printf(" and copy to %s/Incoming", rootdir)
+		fmt.Printf(" and copy to %s/%s", rootdir, incomingDir)
 	}
 	fmt.Printf("\n")
-
-	return nil
 }
@@ -0,0 +1,77 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"jaypod/pkg/subscription"
+)
+
+func TestUndatedEpisodes(t *testing.T) {
+	items := `<item><title>Episode 1</title><pubDate>Mon, 01 Jan 2024 06:00:00 GMT</pubDate>
+  <enclosure url="http://HOST/1.mp3" type="audio/mpeg"/></item>
+<item><title>Bonus</title><guid>tag:show,2024:bonus</guid><pubDate>soon</pubDate>
+  <enclosure url="http://HOST/bonus.mp3" type="audio/mpeg"/></item>`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.ReplaceAll(`<rss version="2.0"><channel><title>Show</title>`+items+`</channel></rss>`, "HOST", r.Host)))
+	}))
+	defer srv.Close()
+
+	st := newTestState(t)
+
+	feeds, err := subscription.ParseFeeds([]byte(`
+feeds:
+  - name: Show
+    url: ` + srv.URL + `/rss
+    filters:
+      - title_regex: ".*"
+`))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	e := newTestEngine(t, Config{})
+
+	queued := func() []string {
+		var titles []string
+		for _, q := range slices.Clone(st.Queue()) {
+			titles = append(titles, q.Title)
+			st.Dequeue(q)
+		}
+		slices.Sort(titles)
+		return titles
+	}
+
+	var polls = []struct {
+		add      string
+		expected []string
+	}{
+		{"", []string{"Bonus", "Episode 1"}},
+		// seen already, though its date still can't be parsed
+		{"", nil},
+		{`<item><title>Bonus 2</title><pubDate></pubDate>
+  <enclosure url="http://HOST/bonus2.mp3" type="audio/mpeg"/></item>`, []string{"Bonus 2"}},
+		{"", nil},
+	}
+	for i, x := range polls {
+		items += x.add
+		if err := e.Poll(feeds, st, t.TempDir(), false); err != nil {
+			t.Fatalf("polls[%d] - poll failed: %v", i, err)
+		}
+		if got := queued(); !slices.Equal(got, x.expected) {
+			t.Errorf("polls[%d] - expected %v queued, got %v", i, x.expected, got)
+		}
+	}
+
+	episode1 := time.Date(2024, 1, 1, 6, 0, 0, 0, time.UTC)
+	if !st.Last("Show").Equal(episode1) {
+		t.Errorf("expected undated episodes to leave the watermark alone, got %v", st.Last("Show"))
+	}
+	if published := st.Published("Show"); len(published) != 1 || !published[0].Equal(episode1) {
+		t.Errorf("expected only real pubDates in the history, got %v", published)
+	}
+}
@@ -0,0 +1,227 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+
+	"jaypod/pkg/rss"
+	"jaypod/pkg/subscription"
+)
+
+const (
+	// Feeds bigger than this, once decompressed, aren't read
+	defaultMaxFeedSize = 50 << 20
+	// Pages of a paged or archived feed read at once
+	defaultMaxFeedPages = 20
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// feedReader undoes any compression of a feed response and stops with an
+// error once more than the maximum feed size has been read.  Bodies that
+// are gzipped without saying so are spotted and decompressed too.
+func (e *Engine) feedReader(resp *http.Response) (io.Reader, error) {
+	var r io.Reader = bufio.NewReader(resp.Body)
+
+	switch enc := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); enc {
+	case "", "identity":
+		br := r.(*bufio.Reader)
+		if magic, _ := br.Peek(len(gzipMagic)); !bytes.Equal(magic, gzipMagic) {
+			break
+		}
+		fallthrough
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("bad gzip body: %v", err)
+		}
+		r = zr
+	case "br":
+		r = brotli.NewReader(r)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %s", enc)
+	}
+
+	return &cappedReader{r: r, limit: e.maxFeedSize}, nil
+}
+
+// cappedReader fails once more than limit bytes have been read from r.
+type cappedReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if c.read > c.limit {
+		return 0, fmt.Errorf("feed is larger than %d bytes", c.limit)
+	}
+	// read up to one byte past the limit, to tell a feed of exactly the
+	// limit from one that's over it
+	if room := c.limit + 1 - c.read; int64(len(p)) > room {
+		p = p[:room]
+	}
+	n, err := c.r.Read(p)
+	c.read += int64(n)
+	if c.read > c.limit {
+		return n, fmt.Errorf("feed is larger than %d bytes", c.limit)
+	}
+	return n, err
+}
+
+// readFeed fetches and parses a feed, stopping early at items published no
+// later than since where the feed's order allows.  Feeds split into pages
+// or archives have their older pages read too, up to a limit, for as long
+// as older, given the items read so far, says items from before them are
+// wanted.  The items of every page are merged into the returned channel.
+func (e *Engine) readFeed(feed *subscription.Feed, since time.Time, older func(items []*rss.RssItem) bool) (rss.RssContainer, http.Header, error) {
+	rc, resp, err := e.readPage(feed, feed.RequestUrl(), since)
+	if err != nil {
+		return rss.RssContainer{}, nil, err
+	}
+	header := resp.Header
+
+	page, pageUrl := rc, resp.Request.URL
+	seen := map[string]bool{pageUrl.String(): true}
+	for pages := 1; ; pages++ {
+		href := page.Feed.OlderPage()
+		if href == "" || page.Truncated || older == nil || !older(rc.Feed.Items) {
+			break
+		}
+		if pages >= e.maxFeedPages {
+			// a limit of zero turns paging off, which needn't be warned of
+			if e.maxFeedPages > 0 {
+				slog.Warn("not reading more pages of feed",
+					"feed", feed.Name,
+					"pages", pages)
+			}
+			break
+		}
+		next, err := pageUrl.Parse(href)
+		if err != nil || seen[next.String()] {
+			break
+		}
+		seen[next.String()] = true
+
+		// a missing page leaves what's been read so far still usable
+		more, resp, err := e.readPage(feed, next.String(), since)
+		if err != nil {
+			slog.Warn("failed reading older page of feed",
+				"feed", feed.Name,
+				"page", pages+1,
+				"error", err)
+			break
+		}
+		n := len(rc.Feed.Items)
+		rc.Feed.Merge(&more.Feed)
+		rc.Warnings = append(rc.Warnings, more.Warnings...)
+		if len(rc.Feed.Items) == n {
+			break
+		}
+		slog.Debug("read older page of feed",
+			"feed", feed.Name,
+			"page", pages+1,
+			"items", len(rc.Feed.Items)-n)
+		page, pageUrl = more, resp.Request.URL
+	}
+
+	for _, w := range rc.Warnings {
+		slog.Warn("problem in feed",
+			"feed", feed.Name,
+			"problem", w)
+	}
+	return rc, header, nil
+}
+
+// redact drops the url from a request's error, since it may have a feed's
+// secrets expanded into it.  Errors say which feed they're about anyway.
+func redact(err error) error {
+	if uerr, ok := err.(*url.Error); ok {
+		return uerr.Err
+	}
+	return err
+}
+
+// readPage fetches and parses one page of a feed.  Pages are parsed as
+// they're read, and only those that can't be are fetched again to be read
+// in full.  The response's body has been read and closed.
+func (e *Engine) readPage(feed *subscription.Feed, u string, since time.Time) (rss.RssContainer, *http.Response, error) {
+	rc, resp, err := e.fetchPage(feed, u, func(body io.Reader) (rss.RssContainer, error) {
+		// what's been read is kept, so a feed that can't be parsed as it's
+		// read can be parsed whole without fetching it again
+		var read bytes.Buffer
+		rc, err := rss.ReadRss(io.TeeReader(body, &read), since)
+		if !errors.Is(err, rss.ErrNotStreamable) {
+			return rc, err
+		}
+		slog.Debug("feed can't be parsed as it's read, parsing it whole",
+			"feed", feed.Name,
+			"error", err)
+		if _, err := read.ReadFrom(body); err != nil {
+			return rss.RssContainer{}, err
+		}
+		return rss.ParseRss(read.Bytes())
+	})
+	if err != nil {
+		return rss.RssContainer{}, nil, err
+	}
+
+	if rc.Truncated {
+		slog.Debug("stopped reading feed at already seen items",
+			"feed", feed.Name,
+			"items", len(rc.Feed.Items))
+	}
+	return rc, resp, nil
+}
+
+// fetchPage gets a page of a feed and parses its body with parse.  Errors
+// from parse are wrapped with %w so the caller can tell what went wrong.
+func (e *Engine) fetchPage(feed *subscription.Feed, u string, parse func(io.Reader) (rss.RssContainer, error)) (rss.RssContainer, *http.Response, error) {
+	req, err := e.newRequest(feed, u)
+	if err != nil {
+		return rss.RssContainer{}, nil, fmt.Errorf("failed creating request for %s: %v", feed.Url, redact(err))
+	}
+
+	// asked for explicitly, so the transport leaves decompressing to us
+	req.Header.Set("Accept-Encoding", "gzip, br")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return rss.RssContainer{}, nil, fmt.Errorf("failed getting %s: %v", feed.Url, redact(err))
+	}
+	defer resp.Body.Close()
+
+	body, err := e.feedReader(resp)
+	if err != nil {
+		return rss.RssContainer{}, nil, fmt.Errorf("failed reading %s: %v", feed.Url, err)
+	}
+
+	rc, err := parse(body)
+	if err != nil {
+		return rss.RssContainer{}, nil, fmt.Errorf("failed reading %s: %w", feed.Url, err)
+	}
+	return rc, resp, nil
+}
+
+// oldest is the earliest pubDate of items, or the zero time if none have
+// one.
+func oldest(items []*rss.RssItem) time.Time {
+	var t time.Time
+	for _, item := range items {
+		if !item.Undated && !item.PubDate.IsZero() && (t.IsZero() || item.PubDate.Before(t)) {
+			t = item.PubDate
+		}
+	}
+	return t
+}
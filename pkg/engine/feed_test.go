@@ -0,0 +1,182 @@
+package engine
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+
+	"jaypod/pkg/rss"
+	"jaypod/pkg/subscription"
+)
+
+func TestFeedReader(t *testing.T) {
+	doc := strings.Repeat("<rss></rss>", 10)
+
+	gzipped := func() []byte {
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		w.Write([]byte(doc))
+		w.Close()
+		return b.Bytes()
+	}
+	brotlied := func() []byte {
+		var b bytes.Buffer
+		w := brotli.NewWriter(&b)
+		w.Write([]byte(doc))
+		w.Close()
+		return b.Bytes()
+	}
+
+	var bodies = []struct {
+		encoding string
+		body     []byte
+		limit    int64
+		ok       bool
+	}{
+		{"", []byte(doc), 1000, true},
+		{"identity", []byte(doc), int64(len(doc)), true},
+		{"gzip", gzipped(), 1000, true},
+		{"br", brotlied(), 1000, true},
+		// gzipped without saying so
+		{"", gzipped(), 1000, true},
+		{"", []byte(doc), int64(len(doc)) - 1, false},
+		// the limit applies to the decompressed feed
+		{"gzip", gzipped(), 50, false},
+		{"compress", []byte(doc), 1000, false},
+	}
+
+	for i, x := range bodies {
+		e := &Engine{maxFeedSize: x.limit}
+		resp := &http.Response{
+			Header: http.Header{},
+			Body:   io.NopCloser(bytes.NewReader(x.body)),
+		}
+		if x.encoding != "" {
+			resp.Header.Set("Content-Encoding", x.encoding)
+		}
+
+		var got []byte
+		r, err := e.feedReader(resp)
+		if err == nil {
+			got, err = io.ReadAll(r)
+		}
+		if (err == nil) != x.ok {
+			t.Errorf("bodies[%d] - expected ok %v, got error %v", i, x.ok, err)
+			continue
+		}
+		if x.ok && string(got) != doc {
+			t.Errorf("bodies[%d] - expected the feed, got %q", i, got)
+		}
+	}
+}
+
+func TestPagedFeed(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2024, 1, d, 6, 0, 0, 0, time.UTC)
+	}
+	page := func(link string, days ...int) string {
+		var b strings.Builder
+		b.WriteString(`<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom"><channel><title>Paged</title>` + link)
+		for _, d := range days {
+			fmt.Fprintf(&b, `<item><title>%d</title><pubDate>%s</pubDate><enclosure url="http://x/%d.mp3" type="audio/mpeg"/></item>`,
+				d, day(d).Format(time.RFC1123), d)
+		}
+		return b.String() + `</channel></rss>`
+	}
+	pages := map[string]string{
+		"/rss": page(`<atom:link rel="self" href="/rss"/><atom:link rel="next" href="page2"/>`, 9, 8, 7),
+		// overlapping the first page, as when an episode is published
+		// between requests
+		"/page2":     page(`<atom:link rel="prev-archive" href="/archive/1"/>`, 7, 6, 5, 4),
+		"/archive/1": page(`<atom:link rel="prev-archive" href="/rss"/>`, 3, 2, 1),
+	}
+
+	var requested []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		w.Write([]byte(pages[r.URL.Path]))
+	}))
+	defer srv.Close()
+
+	var reads = []struct {
+		since     time.Time
+		older     func([]*rss.RssItem) bool
+		maxPages  int
+		items     int
+		requested []string
+	}{
+		{day(5), func(items []*rss.RssItem) bool { return day(5).Before(oldest(items)) }, 20, 5, []string{"/rss", "/page2"}},
+		{day(8), func(items []*rss.RssItem) bool { return day(8).Before(oldest(items)) }, 20, 2, []string{"/rss"}},
+		{time.Time{}, func([]*rss.RssItem) bool { return true }, 20, 9, []string{"/rss", "/page2", "/archive/1"}},
+		{time.Time{}, func([]*rss.RssItem) bool { return true }, 2, 6, []string{"/rss", "/page2"}},
+		// paging turned off
+		{time.Time{}, func([]*rss.RssItem) bool { return true }, 0, 3, []string{"/rss"}},
+		{time.Time{}, nil, 20, 3, []string{"/rss"}},
+		// until enough items are in hand
+		{time.Time{}, func(items []*rss.RssItem) bool { return len(items) < 5 }, 20, 6, []string{"/rss", "/page2"}},
+	}
+
+	feed := &subscription.Feed{Name: "Paged", Url: srv.URL + "/rss"}
+	for i, x := range reads {
+		requested = nil
+		e := newTestEngine(t, Config{MaxFeedPages: &x.maxPages})
+		rc, _, err := e.readFeed(feed, x.since, x.older)
+		if err != nil || len(rc.Feed.Items) != x.items || !slices.Equal(requested, x.requested) {
+			t.Errorf("reads[%d] - expected %d items from %v, got %d from %v: %v",
+				i, x.items, x.requested, len(rc.Feed.Items), requested, err)
+		}
+	}
+
+	// a first poll reads on until the initial policy has enough episodes
+	feeds, err := subscription.ParseFeeds([]byte("feeds:\n  - name: Paged\n    url: " + srv.URL + "/rss\n    initial: latest 5\n    filters:\n      - title_regex: \".*\"\n"))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	st := newTestState(t)
+	e := newTestEngine(t, Config{})
+	requested = nil
+	if err := e.Poll(feeds, st, t.TempDir(), false); err != nil {
+		t.Fatalf("poll failed: %v", err)
+	}
+	if expected := []string{"/rss", "/page2"}; !slices.Equal(requested, expected) {
+		t.Errorf("expected %v read for latest 5, got %v", expected, requested)
+	}
+}
+
+func TestMalformedFeedParsedWhole(t *testing.T) {
+	var docs = []string{
+		`<rss><channel><item><title>Tom &amp; Jerry</title></item></channel></rss>`,
+		`<rss><channel><item><title>Tom &amp; Jerry</title></item><item><title>Broken</titl></item></channel></rss>`,
+	}
+
+	for i, x := range docs {
+		requests := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.Write([]byte(x))
+		}))
+
+		e := newTestEngine(t, Config{})
+		rc, _, err := e.readFeed(&subscription.Feed{Name: "Test", Url: srv.URL}, time.Time{}, nil)
+		srv.Close()
+		if err != nil {
+			t.Errorf("docs[%d] - read error: %v", i, err)
+			continue
+		}
+		if len(rc.Feed.Items) == 0 || rc.Feed.Items[0].Title() != "Tom & Jerry" {
+			t.Errorf("docs[%d] - expected the first item, got %+v", i, rc.Feed.Items)
+		}
+		if requests != 1 {
+			t.Errorf("docs[%d] - expected the feed fetched once, got %d requests", i, requests)
+		}
+	}
+}
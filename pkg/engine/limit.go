@@ -0,0 +1,206 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A token bucket shared by every download it applies to.  Rates are in
+// bytes per second, with a burst of one second's worth.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / l.rate * float64(time.Second)))
+	}
+}
+
+type limitedReader struct {
+	r        io.Reader
+	limiters []*rateLimiter
+}
+
+const limitChunk = 32 * 1024
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > limitChunk {
+		p = p[:limitChunk]
+	}
+	n, err := lr.r.Read(p)
+	for _, l := range lr.limiters {
+		l.wait(n)
+	}
+	return n, err
+}
+
+// limitReader wraps a download body with the global limiter and any
+// limiter configured for its host.
+func (e *Engine) limitReader(r io.Reader, host string) io.Reader {
+	var limiters []*rateLimiter
+	if e.rate != nil {
+		limiters = append(limiters, e.rate)
+	}
+	// the most specific matching host wins
+	best := ""
+	for h := range e.hostRates {
+		if (host == h || strings.HasSuffix(host, "."+h)) && len(h) > len(best) {
+			best = h
+		}
+	}
+	if best != "" {
+		limiters = append(limiters, e.hostRates[best])
+	}
+
+	if len(limiters) == 0 {
+		return r
+	}
+	return &limitedReader{r: r, limiters: limiters}
+}
+
+// ParseRate parses a bandwidth in bytes per second, with an optional k, m
+// or g (binary) suffix, e.g. "512k".
+func ParseRate(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "/s")
+	return parseBytes(s, "rate")
+}
+
+// ParseSize parses a number of bytes, with an optional k, m or g (binary)
+// suffix, e.g. "50m".
+func ParseSize(s string) (int64, error) {
+	return parseBytes(s, "size")
+}
+
+func parseBytes(s string, what string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	s = strings.TrimSuffix(s, "b")
+
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "m"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "g"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("bad %s %q", what, s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// ParseHostRates parses a comma separated list of host=rate pairs.  A host
+// also matches its subdomains.
+func ParseHostRates(s string) (map[string]int64, error) {
+	rates := map[string]int64{}
+	if strings.TrimSpace(s) == "" {
+		return rates, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		host, rate, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("bad host rate %q: expected host=rate", pair)
+		}
+		r, err := ParseRate(rate)
+		if err != nil {
+			return nil, fmt.Errorf("bad host rate for %s: %v", host, err)
+		}
+		rates[strings.TrimSpace(host)] = r
+	}
+	return rates, nil
+}
+
+// Window is a daily span of local time during which downloads are
+// allowed.  Windows whose end is before their start wrap past midnight.
+type Window struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParseWindows parses a comma separated list of HH:MM-HH:MM spans.
+func ParseWindows(s string) ([]Window, error) {
+	var windows []Window
+	if strings.TrimSpace(s) == "" {
+		return windows, nil
+	}
+
+	for _, span := range strings.Split(s, ",") {
+		from, to, ok := strings.Cut(strings.TrimSpace(span), "-")
+		if !ok {
+			return nil, fmt.Errorf("bad window %q: expected HH:MM-HH:MM", span)
+		}
+		start, err := parseClock(from)
+		if err != nil {
+			return nil, fmt.Errorf("bad window %q: %v", span, err)
+		}
+		end, err := parseClock(to)
+		if err != nil {
+			return nil, fmt.Errorf("bad window %q: %v", span, err)
+		}
+		windows = append(windows, Window{Start: start, End: end})
+	}
+	return windows, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w Window) contains(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+
+	if w.Start <= w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// inWindow reports whether downloads are currently allowed.  With no
+// windows configured they always are.
+func (e *Engine) inWindow(t time.Time) bool {
+	if len(e.windows) == 0 {
+		return true
+	}
+	for _, w := range e.windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package engine
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	var rates = []struct {
+		in       string
+		expected int64
+		ok       bool
+	}{
+		{"1000", 1000, true},
+		{"512k", 512 * 1024, true},
+		{"2M", 2 * 1024 * 1024, true},
+		{"1.5mb/s", 3 * 512 * 1024, true},
+		{"fast", 0, false},
+		{"-5k", 0, false},
+	}
+
+	for i, x := range rates {
+		r, err := ParseRate(x.in)
+		if (err == nil) != x.ok {
+			t.Errorf("rates[%d] - expected ok %v, got error %v", i, x.ok, err)
+		}
+		if r != x.expected {
+			t.Errorf("rates[%d] - expected %d, got %d", i, x.expected, r)
+		}
+	}
+}
+
+func TestWindows(t *testing.T) {
+	windows, err := ParseWindows("01:00-07:00, 22:30-00:30")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	e := &Engine{windows: windows}
+
+	var times = []struct {
+		hour, minute int
+		expected     bool
+	}{
+		{0, 15, true},
+		{0, 45, false},
+		{1, 0, true},
+		{6, 59, true},
+		{7, 0, false},
+		{12, 0, false},
+		{22, 30, true},
+		{23, 59, true},
+	}
+
+	for i, x := range times {
+		now := time.Date(2024, 3, 1, x.hour, x.minute, 0, 0, time.Local)
+		if e.inWindow(now) != x.expected {
+			t.Errorf("times[%d] - expected %v at %02d:%02d", i, x.expected, x.hour, x.minute)
+		}
+	}
+
+	if !(&Engine{}).inWindow(time.Now()) {
+		t.Errorf("expected downloads to be allowed with no windows")
+	}
+
+	if _, err := ParseWindows("7am-9am"); err == nil {
+		t.Errorf("expected error for bad window")
+	}
+}
+
+func TestLimitedReader(t *testing.T) {
+	e := &Engine{
+		rate:      newRateLimiter(1 << 20),
+		hostRates: map[string]*rateLimiter{"example.com": newRateLimiter(64 * 1024)},
+	}
+
+	start := time.Now()
+	// one second of burst, then another half second's worth
+	n, err := io.Copy(io.Discard, e.limitReader(bytes.NewReader(make([]byte, 96*1024)), "cdn.example.com"))
+	if err != nil || n != 96*1024 {
+		t.Fatalf("copy failed: %d, %v", n, err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("expected host limit to slow the copy, took %v", elapsed)
+	}
+}
@@ -0,0 +1,225 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"jaypod/pkg/rss"
+	"jaypod/pkg/state"
+	"jaypod/pkg/subscription"
+)
+
+const playlistExt = ".m3u8"
+
+// WritePlaylists brings the library's M3U8 playlists up to date with the
+// episodes in it: one in each directory episodes are saved to, in the
+// order they were published; one in Incoming of the episodes copied there,
+// in the order they were downloaded; and the smart playlists, in the output
+// directory.  Episodes whose files have gone are forgotten, and directory
+// playlists left empty are removed.
+func WritePlaylists(feeds []*subscription.Feed, playlists []*subscription.Playlist, st *state.State, rootdir string) error {
+	if _, err := os.Stat(rootdir); err != nil {
+		return fmt.Errorf("can't write playlists: %v", err)
+	}
+
+	dirs := map[string][]*state.Episode{}
+	var episodes, incoming []*state.Episode
+	known := map[string]bool{}
+	for _, ep := range slices.Clone(st.Episodes()) {
+		dir := filepath.Dir(ep.Path)
+		if _, err := os.Stat(filepath.Join(rootdir, ep.Path)); os.IsNotExist(err) {
+			st.ForgetEpisode(ep.Path)
+			if _, ok := dirs[dir]; !ok {
+				dirs[dir] = nil
+			}
+			continue
+		}
+		known[ep.Path] = true
+		if !playable(ep.Path) {
+			continue
+		}
+		dirs[dir] = append(dirs[dir], ep)
+		episodes = append(episodes, ep)
+
+		if ep.Incoming != "" {
+			if _, err := os.Stat(filepath.Join(rootdir, ep.Incoming)); os.IsNotExist(err) {
+				ep.Incoming = ""
+			} else {
+				incoming = append(incoming, ep)
+			}
+		}
+	}
+
+	for _, ep := range unrecorded(feeds, known, rootdir) {
+		dir := filepath.Dir(ep.Path)
+		dirs[dir] = append(dirs[dir], ep)
+		episodes = append(episodes, ep)
+	}
+
+	var errs []error
+	for dir, eps := range dirs {
+		slices.SortStableFunc(eps, byPubDate)
+		name := filepath.Base(dir)
+		filename := filepath.Join(rootdir, dir, name+playlistExt)
+		if err := writeOrRemovePlaylist(filename, name, rootdir, eps, false); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	slices.SortStableFunc(incoming, func(a, b *state.Episode) int {
+		return a.Downloaded.Compare(b.Downloaded)
+	})
+	filename := filepath.Join(rootdir, incomingDir, incomingDir+playlistExt)
+	if err := writeOrRemovePlaylist(filename, incomingDir, rootdir, incoming, true); err != nil {
+		errs = append(errs, err)
+	}
+
+	now := time.Now()
+	for _, p := range playlists {
+		eps := smartPlaylist(p, episodes, now)
+		if err := writePlaylist(filepath.Join(rootdir, p.Name+playlistExt), p.Name, rootdir, eps, false); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := st.Flush(); err != nil {
+		errs = append(errs, fmt.Errorf("error flushing state: %v", err))
+	}
+	return errors.Join(errs...)
+}
+
+// unrecorded finds the episodes in feeds' directories that aren't in the
+// state, like those downloaded before episodes were recorded there, and
+// makes do with what their files say about them: titles from their names
+// and dates from when they were last changed.  Each file belongs to the
+// feed with the deepest directory holding it.
+func unrecorded(feeds []*subscription.Feed, known map[string]bool, rootdir string) []*state.Episode {
+	feeds = slices.Clone(feeds)
+	slices.SortStableFunc(feeds, func(a, b *subscription.Feed) int {
+		return strings.Count(b.Name, "/") - strings.Count(a.Name, "/")
+	})
+
+	var eps []*state.Episode
+	for _, feed := range feeds {
+		top := filepath.Join(rootdir, filepath.FromSlash(feed.Name))
+		filepath.WalkDir(top, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if entry.IsDir() {
+				if path != top && strings.HasPrefix(entry.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			rel := relPath(rootdir, path)
+			if known[rel] || strings.HasPrefix(entry.Name(), ".") || !playable(rel) {
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil || !info.Mode().IsRegular() {
+				return nil
+			}
+			known[rel] = true
+			eps = append(eps, &state.Episode{
+				Path:    rel,
+				Feed:    feed.Name,
+				Title:   strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())),
+				PubDate: info.ModTime(),
+			})
+			return nil
+		})
+	}
+	return eps
+}
+
+// playable says whether a file is audio or video, rather than say the
+// show notes downloaded alongside an episode.
+func playable(path string) bool {
+	t := rss.TypeForExtension(filepath.Ext(path))
+	return strings.HasPrefix(t, "audio/") || strings.HasPrefix(t, "video/")
+}
+
+// smartPlaylist picks the episodes a smart playlist holds, in its order.
+func smartPlaylist(p *subscription.Playlist, episodes []*state.Episode, now time.Time) []*state.Episode {
+	var eps []*state.Episode
+	for _, ep := range episodes {
+		if p.Includes(ep.Feed, filepath.Dir(ep.Path)) && p.Recent(ep.PubDate, now) {
+			eps = append(eps, ep)
+		}
+	}
+	slices.SortStableFunc(eps, byPubDate)
+	if p.Limit > 0 && len(eps) > p.Limit {
+		eps = eps[len(eps)-p.Limit:]
+	}
+	if p.Order == subscription.OrderNewest {
+		slices.Reverse(eps)
+	}
+	return eps
+}
+
+func byPubDate(a, b *state.Episode) int {
+	return a.PubDate.Compare(b.PubDate)
+}
+
+// writeOrRemovePlaylist writes a playlist, or removes it if it would be
+// empty.
+func writeOrRemovePlaylist(filename, name, rootdir string, eps []*state.Episode, incoming bool) error {
+	if len(eps) > 0 {
+		return writePlaylist(filename, name, rootdir, eps, incoming)
+	}
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed removing empty playlist %s: %v", filename, err)
+	}
+	return nil
+}
+
+// writePlaylist saves episodes as an extended M3U8 playlist at filename,
+// with paths relative to it, or to their copies in Incoming if incoming is
+// set.  A file that wouldn't change is left alone.
+func writePlaylist(filename, name, rootdir string, eps []*state.Episode, incoming bool) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "#EXTM3U\n#PLAYLIST:%s\n", name)
+	for _, ep := range eps {
+		target := ep.Path
+		if incoming {
+			target = ep.Incoming
+		}
+		rel, err := filepath.Rel(filepath.Dir(filename), filepath.Join(rootdir, target))
+		if err != nil {
+			return fmt.Errorf("failed writing playlist %s: %v", filename, err)
+		}
+
+		duration := ep.Duration
+		if duration == 0 {
+			duration = -1
+		}
+		// Artist - Title, which players show
+		title := strings.Join(strings.Fields(path.Base(ep.Feed)+" - "+ep.Title), " ")
+		fmt.Fprintf(&b, "#EXTINF:%d,%s\n%s\n", duration, title, filepath.ToSlash(rel))
+	}
+
+	if old, err := os.ReadFile(filename); err == nil && bytes.Equal(old, b.Bytes()) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+		return fmt.Errorf("failed creating %s: %v", filepath.Dir(filename), err)
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, b.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed writing playlist %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed renaming %s to %s: %v", tmp, filename, err)
+	}
+	return nil
+}
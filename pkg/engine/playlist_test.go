@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"jaypod/pkg/subscription"
+)
+
+func TestPlaylists(t *testing.T) {
+	now := time.Now().UTC()
+	item := func(title string, age time.Duration, duration string) string {
+		return `<item><title>` + title + `</title><pubDate>` + now.Add(-age).Format(time.RFC1123) + `</pubDate>
+  <itunes:duration>` + duration + `</itunes:duration>
+  <enclosure url="http://HOST/` + title + `.mp3" type="audio/mpeg"/></item>`
+	}
+	feed := `<rss version="2.0" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd"><channel><title>WTF</title>` +
+		item("New", 24*time.Hour, "30:00") + item("Old", 240*time.Hour, "") + item("Mid", 72*time.Hour, "1:00:00") +
+		`</channel></rss>`
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rss" {
+			w.Write([]byte(strings.ReplaceAll(feed, "HOST", r.Host)))
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	rootdir := t.TempDir()
+	st := newTestState(t)
+
+	doc := []byte(`
+feeds:
+  - name: Comedy/WTF
+    url: ` + srv.URL + `/rss
+    filters:
+      - title_regex: New
+        incoming: true
+      - title_regex: ".*"
+playlists:
+  - name: Recent comedy
+    dirs: [Comedy]
+    within: 7d
+    order: newest
+`)
+	feeds, err := subscription.ParseFeeds(doc)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	playlists, err := subscription.ParsePlaylists(doc)
+	if err != nil || len(playlists) != 1 {
+		t.Fatalf("expected a playlist, got %v: %v", playlists, err)
+	}
+
+	e := newTestEngine(t, Config{})
+	if n, err := e.Fetch(feeds, st, rootdir, false, true); err != nil || n != 3 {
+		t.Fatalf("expected 3 downloads, got %d: %v", n, err)
+	}
+	// downloaded before episodes were recorded, with show notes that
+	// aren't played
+	for _, name := range []string{"Ancient.mp3", "Ancient.pdf"} {
+		path := filepath.Join(rootdir, "Comedy/WTF", name)
+		if err := os.WriteFile(path, nil, 0666); err != nil {
+			t.Fatalf("failed writing %s: %v", name, err)
+		}
+		os.Chtimes(path, now.Add(-1000*time.Hour), now.Add(-1000*time.Hour))
+	}
+	if err := WritePlaylists(feeds, playlists, st, rootdir); err != nil {
+		t.Fatalf("failed writing playlists: %v", err)
+	}
+
+	expected := map[string]string{
+		"Comedy/WTF/WTF.m3u8": "#EXTM3U\n#PLAYLIST:WTF\n" +
+			"#EXTINF:-1,WTF - Ancient\nAncient.mp3\n" +
+			"#EXTINF:-1,WTF - Old\nOld.mp3\n" +
+			"#EXTINF:3600,WTF - Mid\nMid.mp3\n" +
+			"#EXTINF:1800,WTF - New\nNew.mp3\n",
+		"Incoming/Incoming.m3u8": "#EXTM3U\n#PLAYLIST:Incoming\n" +
+			"#EXTINF:1800,WTF - New\nNew.mp3\n",
+		"Recent comedy.m3u8": "#EXTM3U\n#PLAYLIST:Recent comedy\n" +
+			"#EXTINF:1800,WTF - New\nComedy/WTF/New.mp3\n" +
+			"#EXTINF:3600,WTF - Mid\nComedy/WTF/Mid.mp3\n",
+	}
+	for name, contents := range expected {
+		b, err := os.ReadFile(filepath.Join(rootdir, name))
+		if err != nil || string(b) != contents {
+			t.Errorf("expected %s:\n%s\ngot:\n%s (%v)", name, contents, b, err)
+		}
+	}
+
+	// episodes deleted since are dropped, and playlists left empty removed
+	for _, name := range []string{"Comedy/WTF/Old.mp3", "Comedy/WTF/Mid.mp3", "Incoming/New.mp3"} {
+		os.Remove(filepath.Join(rootdir, name))
+	}
+	if err := WritePlaylists(feeds, playlists, st, rootdir); err != nil {
+		t.Fatalf("failed writing playlists: %v", err)
+	}
+	if len(st.Episodes()) != 1 || st.Episodes()[0].Incoming != "" {
+		t.Errorf("expected just New without its Incoming copy, got %+v", st.Episodes())
+	}
+	if _, err := os.Stat(filepath.Join(rootdir, "Incoming/Incoming.m3u8")); !os.IsNotExist(err) {
+		t.Errorf("expected empty Incoming playlist to be removed, got %v", err)
+	}
+	b, _ := os.ReadFile(filepath.Join(rootdir, "Recent comedy.m3u8"))
+	if string(b) != "#EXTM3U\n#PLAYLIST:Recent comedy\n#EXTINF:1800,WTF - New\nComedy/WTF/New.mp3\n" {
+		t.Errorf("expected smart playlist of New, got:\n%s", b)
+	}
+}
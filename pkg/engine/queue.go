@@ -0,0 +1,109 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"jaypod/pkg/state"
+	"jaypod/pkg/subscription"
+)
+
+const (
+	defaultMaxAttempts = 5
+	maxBackoff         = 6 * time.Hour
+)
+
+// Drain downloads queued episodes, highest priority first and oldest first
+// within a priority.  A failed download is retried on later drains with
+// exponential backoff until it runs out of attempts.
+func (e *Engine) Drain(feeds []*subscription.Feed, st *state.State, rootdir string) (int, error) {
+	queue := slices.Clone(st.Queue())
+	slices.SortStableFunc(queue, func(a, b *state.QueueItem) int {
+		if a.Priority != b.Priority {
+			return b.Priority - a.Priority
+		}
+		return a.PubDate.Compare(b.PubDate)
+	})
+
+	numDownloads := 0
+	for _, q := range queue {
+		now := time.Now()
+		if !e.inWindow(now) {
+			break
+		}
+		if q.Failed || now.Before(q.NextAttempt) {
+			continue
+		}
+
+		sublog := slog.With(
+			"feed", q.Feed,
+			"podcast", q.Url,
+			"basename", q.Basename,
+			"dest", q.Dest,
+			"incoming", q.Incoming)
+
+		feed := findFeed(feeds, q.Feed)
+		s, err := e.download(q, feed, st, rootdir, sublog)
+		if errors.Is(err, errSkipped) {
+			st.Dequeue(q)
+		} else if err != nil {
+			q.Attempts++
+			q.LastError = err.Error()
+			if q.Attempts >= e.maxAttempts {
+				q.Failed = true
+				sublog.Error("giving up on podcast", "attempts", q.Attempts, "err", err)
+			} else {
+				q.NextAttempt = now.Add(backoff(q.Attempts))
+				sublog.Error("download failed, will retry", "attempts", q.Attempts,
+					"next", q.NextAttempt, "err", err)
+			}
+		} else {
+			sublog.Info("downloaded podcast")
+			e.saveArtwork(q, feed, st, rootdir, s.path, sublog)
+			if err := writeSidecars(q, s.path); err != nil {
+				sublog.Warn("failed writing sidecars", "err", err)
+			}
+			ep := &state.Episode{
+				Path:       relPath(rootdir, s.path),
+				Feed:       q.Feed,
+				Title:      q.Title,
+				PubDate:    q.PubDate,
+				Duration:   q.Duration,
+				Downloaded: now,
+			}
+			if s.incoming != "" {
+				ep.Incoming = relPath(rootdir, s.incoming)
+			}
+			st.RecordEpisode(ep)
+			st.Dequeue(q)
+			numDownloads++
+		}
+
+		if err := st.Flush(); err != nil {
+			return numDownloads, fmt.Errorf("error flushing state: %v\n", err)
+		}
+	}
+	return numDownloads, nil
+}
+
+func backoff(attempts int) time.Duration {
+	d := time.Minute << attempts
+	if d > maxBackoff || d <= 0 {
+		return maxBackoff
+	}
+	return d
+}
+
+// findFeed looks up a queued item's feed for its download settings,
+// falling back to the defaults if it has since been unsubscribed.
+func findFeed(feeds []*subscription.Feed, name string) *subscription.Feed {
+	for _, f := range feeds {
+		if f.Name == name {
+			return f
+		}
+	}
+	return &subscription.Feed{Name: name, Collision: subscription.CollisionSuffixNumber}
+}
@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"jaypod/pkg/state"
+)
+
+func TestDrainRetries(t *testing.T) {
+	var order []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, r.URL.Path)
+		if r.URL.Path == "/missing.mp3" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	st := newTestState(t)
+
+	date := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	st.Enqueue(&state.QueueItem{Feed: "Test", Url: srv.URL + "/missing.mp3", Dest: "Test", PubDate: date})
+	st.Enqueue(&state.QueueItem{Feed: "Test", Url: srv.URL + "/newer.mp3", Dest: "Test", PubDate: date.Add(time.Hour)})
+	st.Enqueue(&state.QueueItem{Feed: "Test", Url: srv.URL + "/urgent.mp3", Dest: "Test", PubDate: date.Add(2 * time.Hour), Priority: 1})
+
+	e := newTestEngine(t, Config{MaxAttempts: 2})
+
+	n, err := e.Drain(nil, st, t.TempDir())
+	if err != nil {
+		t.Fatalf("drain failed: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 downloads, got %d", n)
+	}
+
+	expected := []string{"/urgent.mp3", "/missing.mp3", "/newer.mp3"}
+	if len(order) != len(expected) {
+		t.Fatalf("expected requests %v, got %v", expected, order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("expected requests %v, got %v", expected, order)
+		}
+	}
+
+	if len(st.Queue()) != 1 {
+		t.Fatalf("expected failed item to stay queued, got %d items", len(st.Queue()))
+	}
+	q := st.Queue()[0]
+	if q.Attempts != 1 || q.Failed || !q.NextAttempt.After(time.Now()) {
+		t.Fatalf("expected one attempt with a retry scheduled, got %+v", q)
+	}
+
+	// not yet due for a retry
+	order = nil
+	e.Drain(nil, st, t.TempDir())
+	if len(order) != 0 {
+		t.Fatalf("expected no requests before backoff expires, got %v", order)
+	}
+
+	q.NextAttempt = time.Time{}
+	e.Drain(nil, st, t.TempDir())
+	if !q.Failed || q.Attempts != 2 || q.LastError == "" {
+		t.Fatalf("expected item to be marked failed, got %+v", q)
+	}
+}
+
+func TestDrainSkipsDuplicates(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("same"))
+	}))
+	defer srv.Close()
+
+	st := newTestState(t)
+
+	date := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	st.Enqueue(&state.QueueItem{Feed: "Test", Url: srv.URL + "/first.mp3", Dest: "Test", PubDate: date})
+	st.Enqueue(&state.QueueItem{Feed: "Test", Url: srv.URL + "/second.mp3", Dest: "Test", PubDate: date.Add(time.Hour)})
+
+	e := newTestEngine(t, Config{})
+
+	n, err := e.Drain(nil, st, t.TempDir())
+	if err != nil {
+		t.Fatalf("drain failed: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 download, got %d", n)
+	}
+	if len(st.Queue()) != 0 {
+		t.Fatalf("expected the duplicate to be dequeued, got %d items", len(st.Queue()))
+	}
+	if len(st.Episodes()) != 1 {
+		t.Fatalf("expected 1 episode recorded, got %d", len(st.Episodes()))
+	}
+}
@@ -0,0 +1,139 @@
+package engine
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"jaypod/pkg/rss"
+	"jaypod/pkg/state"
+	"jaypod/pkg/subscription"
+)
+
+const (
+	defaultPollInterval = time.Hour
+	// Feeds asking to be left alone for longer than this still get polled
+	// daily
+	maxHintInterval = 24 * time.Hour
+)
+
+// interval works out how long to leave a feed between polls, not knowing
+// when it publishes.  A poll_interval on the feed is used as is.
+// Otherwise the engine's default is stretched to honour the feed's <ttl>
+// or <sy:updatePeriod> and the response's Cache-Control max-age, whichever
+// asks for the longest.  It also says where the interval came from.
+func (e *Engine) interval(feed *subscription.Feed, channel *rss.RssChannel, header http.Header) (time.Duration, string) {
+	if d := feed.Interval(); d > 0 {
+		return d, "poll_interval " + d.String()
+	}
+
+	d, reason := e.pollInterval, "default interval"
+	if channel != nil {
+		if hint := min(channel.UpdateInterval(), maxHintInterval); hint > d {
+			d, reason = hint, "feed update period"
+		}
+	}
+	if age := min(cacheMaxAge(header), maxHintInterval); age > d {
+		d, reason = age, "Cache-Control max-age"
+	}
+	return d, reason
+}
+
+// nextPoll decides when to poll a feed again after polling it at now.
+// Feeds without a poll_interval of their own are polled around the times
+// they've usually published, once enough of their history has been seen.
+func (e *Engine) nextPoll(feed *subscription.Feed, channel *rss.RssChannel, header http.Header, history []time.Time, now time.Time) (time.Time, string) {
+	d, reason := e.interval(feed, channel, header)
+	if feed.Interval() > 0 {
+		return now.Add(d), reason
+	}
+
+	c := LearnCadence(history, now)
+	if c == nil {
+		return now.Add(d), reason
+	}
+	return c.nextPoll(now, d)
+}
+
+// cacheMaxAge returns the max-age from a Cache-Control header, or zero.
+func cacheMaxAge(header http.Header) time.Duration {
+	if header == nil {
+		return 0
+	}
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if !strings.EqualFold(name, "max-age") {
+			continue
+		}
+		secs, err := strconv.Atoi(strings.Trim(value, `"`))
+		if err != nil || secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	return 0
+}
+
+// Due returns the feeds whose next poll time has come.  Feeds that have
+// never been polled are always due.
+func (e *Engine) Due(feeds []*subscription.Feed, st *state.State, now time.Time) []*subscription.Feed {
+	var due []*subscription.Feed
+	for _, feed := range feeds {
+		if !now.Before(st.NextPoll(feed.Name)) {
+			due = append(due, feed)
+		}
+	}
+	return due
+}
+
+// NextWake is when there will next be something to do: a feed due to be
+// polled, or a queued download due to be retried or waiting for a
+// download window to open.
+func (e *Engine) NextWake(feeds []*subscription.Feed, st *state.State, now time.Time) time.Time {
+	var next time.Time
+	earliest := func(t time.Time) {
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+
+	for _, feed := range feeds {
+		earliest(st.NextPoll(feed.Name))
+	}
+
+	for _, q := range st.Queue() {
+		if q.Failed {
+			continue
+		}
+		t := q.NextAttempt
+		if t.Before(now) {
+			t = now
+		}
+		if !e.inWindow(t) {
+			t = e.nextWindow(t)
+		}
+		earliest(t)
+	}
+
+	if next.Before(now) {
+		return now
+	}
+	return next
+}
+
+// nextWindow is the next time after t at which a download window opens.
+func (e *Engine) nextWindow(t time.Time) time.Time {
+	var next time.Time
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	for _, w := range e.windows {
+		start := midnight.Add(w.Start)
+		if !start.After(t) {
+			start = midnight.AddDate(0, 0, 1).Add(w.Start)
+		}
+		if next.IsZero() || start.Before(next) {
+			next = start
+		}
+	}
+	return next
+}
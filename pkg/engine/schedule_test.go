@@ -0,0 +1,133 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"jaypod/pkg/rss"
+	"jaypod/pkg/subscription"
+)
+
+func TestPollInterval(t *testing.T) {
+	e := newTestEngine(t, Config{PollInterval: 30 * time.Minute})
+
+	feeds, err := subscription.ParseFeeds([]byte(`
+feeds:
+  - name: Plain
+    url: http://plain.example.com/rss
+  - name: Monthly
+    url: http://monthly.example.com/rss
+    poll_interval: 2d
+`))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	plain, monthly := feeds[0], feeds[1]
+
+	var intervals = []struct {
+		feed     *subscription.Feed
+		channel  *rss.RssChannel
+		cache    string
+		expected time.Duration
+	}{
+		{plain, nil, "", 30 * time.Minute},
+		{plain, &rss.RssChannel{Ttl: "10"}, "", 30 * time.Minute},
+		{plain, &rss.RssChannel{Ttl: "120"}, "", 2 * time.Hour},
+		{plain, &rss.RssChannel{UpdatePeriod: "weekly"}, "", maxHintInterval},
+		{plain, nil, "public, max-age=7200", 2 * time.Hour},
+		{plain, &rss.RssChannel{Ttl: "90"}, "max-age=3600", 90 * time.Minute},
+		{plain, nil, "no-cache", 30 * time.Minute},
+		{monthly, &rss.RssChannel{Ttl: "120"}, "max-age=7200", 48 * time.Hour},
+	}
+
+	for i, x := range intervals {
+		header := http.Header{}
+		if x.cache != "" {
+			header.Set("Cache-Control", x.cache)
+		}
+		if got, _ := e.interval(x.feed, x.channel, header); got != x.expected {
+			t.Errorf("intervals[%d] - expected %v, got %v", i, x.expected, got)
+		}
+	}
+}
+
+func TestFetchSchedule(t *testing.T) {
+	polls := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls[r.URL.Path]++
+		if r.URL.Path == "/cached" {
+			w.Header().Set("Cache-Control", "max-age=10800")
+		}
+		w.Write([]byte(`<rss version="2.0"><channel><title>x</title><ttl>5</ttl></channel></rss>`))
+	}))
+	defer srv.Close()
+
+	st := newTestState(t)
+
+	feeds := []*subscription.Feed{
+		{Name: "Plain", Url: srv.URL + "/plain"},
+		{Name: "Cached", Url: srv.URL + "/cached"},
+	}
+
+	e := newTestEngine(t, Config{PollInterval: time.Hour})
+
+	start := time.Now()
+	if _, err := e.Fetch(feeds, st, t.TempDir(), true, false); err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	if polls["/plain"] != 1 || polls["/cached"] != 1 {
+		t.Fatalf("expected each feed polled once, got %v", polls)
+	}
+
+	if next := st.NextPoll("Plain").Sub(start); next < time.Hour || next > time.Hour+time.Minute {
+		t.Errorf("expected Plain due in an hour, got %v", next)
+	}
+	if next := st.NextPoll("Cached").Sub(start); next < 3*time.Hour || next > 3*time.Hour+time.Minute {
+		t.Errorf("expected Cached due in three hours, got %v", next)
+	}
+
+	if _, err := e.Fetch(feeds, st, t.TempDir(), true, false); err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	if polls["/plain"] != 1 || polls["/cached"] != 1 {
+		t.Errorf("expected feeds not yet due to be left alone, got %v", polls)
+	}
+
+	if due := e.Due(feeds, st, start.Add(2*time.Hour)); len(due) != 1 || due[0].Name != "Plain" {
+		t.Errorf("expected only Plain due after two hours, got %v", due)
+	}
+	if wake := e.NextWake(feeds, st, start); !wake.Equal(st.NextPoll("Plain")) {
+		t.Errorf("expected to wake when Plain is due, got %v", wake)
+	}
+
+	if _, err := e.Fetch(feeds, st, t.TempDir(), true, true); err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	if polls["/plain"] != 2 || polls["/cached"] != 2 {
+		t.Errorf("expected a forced fetch to poll everything, got %v", polls)
+	}
+}
+
+func TestNextWindow(t *testing.T) {
+	windows, err := ParseWindows("01:00-07:00,22:30-00:30")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	e := newTestEngine(t, Config{Windows: windows})
+
+	var times = []struct {
+		now      time.Time
+		expected time.Time
+	}{
+		{time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 22, 30, 0, 0, time.UTC)},
+		{time.Date(2024, 3, 1, 0, 45, 0, 0, time.UTC), time.Date(2024, 3, 1, 1, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 3, 1, 23, 0, 0, 0, time.UTC), time.Date(2024, 3, 2, 1, 0, 0, 0, time.UTC)},
+	}
+	for i, x := range times {
+		if got := e.nextWindow(x.now); !got.Equal(x.expected) {
+			t.Errorf("times[%d] - expected %v, got %v", i, x.expected, got)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package engine
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"jaypod/pkg/rss"
+	"jaypod/pkg/state"
+	"jaypod/pkg/subscription"
+)
+
+var (
+	anyTag      = regexp.MustCompile(`<[^>]*>`)
+	blankLines  = regexp.MustCompile(`\n{3,}`)
+	spaceBefore = regexp.MustCompile(`[ \t]+\n`)
+)
+
+// queueSidecars notes the sidecar files a filter asks for on a queued
+// episode, along with the details of the feed they're made from, which
+// are gone by the time it's downloaded.
+func queueSidecars(q *state.QueueItem, kinds []string, channel *rss.RssChannel, p *rss.RssItem) {
+	if len(kinds) == 0 {
+		return
+	}
+	q.Sidecars = kinds
+	q.Show = channel.Title
+	q.Description = p.Description()
+	q.Season = p.Season
+	q.Episode = p.Episode
+}
+
+// renderSidecars renders sidecar files, keyed by the extension they're
+// saved with.
+func renderSidecars(kinds []string, channel *rss.RssChannel, p *rss.RssItem) (map[string]string, error) {
+	if len(kinds) == 0 {
+		return nil, nil
+	}
+
+	sidecars := map[string]string{}
+	for _, kind := range kinds {
+		var content string
+		var err error
+		switch kind {
+		case subscription.SidecarJson:
+			content, err = sidecarJson(p)
+		case subscription.SidecarNfo:
+			content, err = sidecarNfo(channel, p)
+		case subscription.SidecarMarkdown:
+			content = sidecarMarkdown(channel, p)
+		default:
+			err = fmt.Errorf("unknown sidecar %s", kind)
+		}
+		if err != nil {
+			return nil, err
+		}
+		sidecars[subscription.SidecarExtension(kind)] = content
+	}
+	return sidecars, nil
+}
+
+// writeSidecars renders a queued episode's sidecars and saves them next to
+// it at path, named after it.
+func writeSidecars(q *state.QueueItem, path string) error {
+	if len(q.Sidecars) == 0 {
+		return nil
+	}
+
+	channel := &rss.RssChannel{Title: q.Show}
+	p := &rss.RssItem{
+		MyTitle:       rss.NonNamespaceString(q.Title),
+		MyDescription: q.Description,
+		PubDate:       q.PubDate,
+		Season:        q.Season,
+		Episode:       q.Episode,
+		ItunesImage:   rss.ItunesImage{Href: q.Image},
+		Enclosure:     rss.RssEnclosure{Url: q.Url, EnclosureType: q.Type},
+	}
+	if q.Duration > 0 {
+		p.Duration = strconv.Itoa(q.Duration)
+	}
+	sidecars, err := renderSidecars(q.Sidecars, channel, p)
+	if err != nil {
+		return err
+	}
+
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	for ext, content := range sidecars {
+		if err := os.WriteFile(base+"."+ext, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sidecarJson(p *rss.RssItem) (string, error) {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b) + "\n", nil
+}
+
+// episodeDetails is the .nfo format Kodi and Jellyfin read for episodes.
+type episodeDetails struct {
+	XMLName   xml.Name `xml:"episodedetails"`
+	Title     string   `xml:"title"`
+	ShowTitle string   `xml:"showtitle,omitempty"`
+	Season    string   `xml:"season,omitempty"`
+	Episode   string   `xml:"episode,omitempty"`
+	Plot      string   `xml:"plot,omitempty"`
+	Aired     string   `xml:"aired,omitempty"`
+	// minutes
+	Runtime int    `xml:"runtime,omitempty"`
+	Thumb   string `xml:"thumb,omitempty"`
+}
+
+func sidecarNfo(channel *rss.RssChannel, p *rss.RssItem) (string, error) {
+	details := episodeDetails{
+		Title:     p.Title(),
+		ShowTitle: channel.Title,
+		Season:    p.Season,
+		Episode:   p.Episode,
+		Plot:      htmlText(p.Description(), false),
+		Thumb:     p.ImageUrl(),
+	}
+	if !p.PubDate.IsZero() {
+		details.Aired = p.PubDate.Format("2006-01-02")
+	}
+	if d, ok := p.DurationValue(); ok {
+		details.Runtime = int(d.Round(time.Minute).Minutes())
+	}
+
+	b, err := xml.MarshalIndent(details, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" + string(b) + "\n", nil
+}
+
+func sidecarMarkdown(channel *rss.RssChannel, p *rss.RssItem) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", p.Title())
+
+	var about []string
+	if channel.Title != "" {
+		about = append(about, "*"+channel.Title+"*")
+	}
+	if !p.PubDate.IsZero() {
+		about = append(about, p.PubDate.Format("2006-01-02"))
+	}
+	if d, ok := p.DurationValue(); ok {
+		about = append(about, d.Round(time.Second).String())
+	}
+	if len(about) > 0 {
+		fmt.Fprintf(&b, "%s\n\n", strings.Join(about, " · "))
+	}
+
+	if text := htmlText(p.Description(), true); text != "" {
+		fmt.Fprintf(&b, "%s\n\n", text)
+	}
+	fmt.Fprintf(&b, "Source: <%s>\n", p.Url())
+	return b.String()
+}
+
+// htmlText converts an HTML description to plain text, or Markdown, keeping
+// paragraphs, line breaks, list items and links.  Descriptions too broken
+// to parse just have their tags stripped.
+func htmlText(s string, markdown bool) string {
+	d := xml.NewDecoder(strings.NewReader("<div>" + s + "</div>"))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+
+	var b strings.Builder
+	var hrefs []string
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return tidyText(anyTag.ReplaceAllString(s, " "))
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch strings.ToLower(t.Name.Local) {
+			case "p", "div", "ul", "ol", "blockquote", "h1", "h2", "h3", "h4", "h5", "h6":
+				b.WriteString("\n\n")
+			case "br":
+				b.WriteString("\n")
+			case "li":
+				b.WriteString("\n- ")
+			case "strong", "b":
+				if markdown {
+					b.WriteString("**")
+				}
+			case "em", "i":
+				if markdown {
+					b.WriteString("_")
+				}
+			case "a":
+				href := ""
+				for _, a := range t.Attr {
+					if strings.EqualFold(a.Name.Local, "href") {
+						href = a.Value
+					}
+				}
+				hrefs = append(hrefs, href)
+				if markdown && href != "" {
+					b.WriteString("[")
+				}
+			}
+		case xml.EndElement:
+			switch strings.ToLower(t.Name.Local) {
+			case "p", "div", "ul", "ol", "blockquote", "h1", "h2", "h3", "h4", "h5", "h6":
+				b.WriteString("\n\n")
+			case "strong", "b":
+				if markdown {
+					b.WriteString("**")
+				}
+			case "em", "i":
+				if markdown {
+					b.WriteString("_")
+				}
+			case "a":
+				if len(hrefs) == 0 {
+					break
+				}
+				href := hrefs[len(hrefs)-1]
+				hrefs = hrefs[:len(hrefs)-1]
+				switch {
+				case href == "":
+				case markdown:
+					b.WriteString("](" + href + ")")
+				default:
+					b.WriteString(" (" + href + ")")
+				}
+			}
+		case xml.CharData:
+			// runs of whitespace become single spaces, as a browser would
+			// show them
+			text := string(t)
+			if text == "" {
+				break
+			}
+			if isSpace(text[0]) {
+				space(&b)
+			}
+			if words := strings.Fields(text); len(words) > 0 {
+				b.WriteString(strings.Join(words, " "))
+				if isSpace(text[len(text)-1]) {
+					space(&b)
+				}
+			}
+		}
+	}
+	return tidyText(b.String())
+}
+
+// space adds a space, unless there's already whitespace or nothing before it.
+func space(b *strings.Builder) {
+	if s := b.String(); s != "" && !isSpace(s[len(s)-1]) {
+		b.WriteString(" ")
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func tidyText(s string) string {
+	s = spaceBefore.ReplaceAllString(s, "\n")
+	s = blankLines.ReplaceAllString(s, "\n\n")
+	return strings.TrimSpace(s)
+}
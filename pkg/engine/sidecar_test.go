@@ -0,0 +1,99 @@
+package engine
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"jaypod/pkg/rss"
+	"jaypod/pkg/state"
+	"jaypod/pkg/subscription"
+)
+
+func TestHtmlText(t *testing.T) {
+	var descriptions = []struct {
+		html     string
+		text     string
+		markdown string
+	}{
+		{"Plain text", "Plain text", "Plain text"},
+		{"<p>One</p><p>Two<br>Three</p>", "One\n\nTwo\nThree", "One\n\nTwo\nThree"},
+		{"Tom &amp; <b>Jerry</b> &nbsp;live", "Tom & Jerry live", "Tom & **Jerry** live"},
+		{`See <a href="http://x/notes">the notes</a>.`, "See the notes (http://x/notes).", "See [the notes](http://x/notes)."},
+		{"<ul><li>first</li><li>second <i>item</i></li></ul>", "- first\n- second item", "- first\n- second _item_"},
+		{"Unclosed <p>para & <br> stray", "Unclosed\n\npara &\nstray", "Unclosed\n\npara &\nstray"},
+	}
+
+	for i, x := range descriptions {
+		if got := htmlText(x.html, false); got != x.text {
+			t.Errorf("descriptions[%d] - expected text %q, got %q", i, x.text, got)
+		}
+		if got := htmlText(x.html, true); got != x.markdown {
+			t.Errorf("descriptions[%d] - expected markdown %q, got %q", i, x.markdown, got)
+		}
+	}
+}
+
+func TestSidecars(t *testing.T) {
+	channel := &rss.RssChannel{Title: "The Show"}
+	item := &rss.RssItem{
+		MyTitle:       "Episode 7",
+		MyDescription: `<p>About <a href="http://x/guest">a guest</a> &amp; more</p>`,
+		PubDate:       time.Date(2024, 3, 1, 6, 0, 0, 0, time.UTC),
+		Duration:      "1:02:31",
+		Season:        "2",
+		Episode:       "7",
+		Enclosure:     rss.RssEnclosure{Url: "http://x/ep7.mp3", EnclosureType: "audio/mpeg"},
+		ItunesImage:   rss.ItunesImage{Href: "http://x/ep7.jpg"},
+	}
+
+	// as queued, and rendered once downloaded
+	q := &state.QueueItem{
+		Url:      item.Enclosure.Url,
+		Type:     item.Type(),
+		Title:    item.Title(),
+		PubDate:  item.PubDate,
+		Duration: 3751,
+		Image:    item.ImageUrl(),
+	}
+	queueSidecars(q, []string{subscription.SidecarJson, subscription.SidecarNfo, subscription.SidecarMarkdown}, channel, item)
+
+	dir := t.TempDir()
+	if err := writeSidecars(q, filepath.Join(dir, "Episode 7.mp3")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	read := func(name string) string {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("expected %s: %v", name, err)
+		}
+		return string(b)
+	}
+
+	var decoded rss.RssItem
+	if err := json.Unmarshal([]byte(read("Episode 7.json")), &decoded); err != nil || decoded.Episode != "7" || decoded.Enclosure.Url != item.Enclosure.Url {
+		t.Errorf("expected the item's fields in JSON, got %+v (%v)", decoded, err)
+	}
+
+	nfo := read("Episode 7.nfo")
+	for _, want := range []string{"<episodedetails>", "<title>Episode 7</title>", "<showtitle>The Show</showtitle>",
+		"<season>2</season>", "<aired>2024-03-01</aired>", "<runtime>63</runtime>",
+		"<plot>About a guest (http://x/guest) &amp; more</plot>", "<thumb>http://x/ep7.jpg</thumb>"} {
+		if !strings.Contains(nfo, want) {
+			t.Errorf("expected %s in nfo:\n%s", want, nfo)
+		}
+	}
+
+	expected := "# Episode 7\n\n*The Show* · 2024-03-01 · 1h2m31s\n\nAbout [a guest](http://x/guest) & more\n\nSource: <http://x/ep7.mp3>\n"
+	if md := read("Episode 7.md"); md != expected {
+		t.Errorf("expected markdown:\n%s\ngot:\n%s", expected, md)
+	}
+
+	bad := "feeds:\n  - name: x\n    url: http://example.com/rss\n    filters:\n      - sidecars: [pdf]\n"
+	if _, err := subscription.ParseFeeds([]byte(bad)); err == nil || !strings.Contains(err.Error(), "unknown sidecar pdf") {
+		t.Errorf("expected unknown sidecar error, got %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package rss
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// RFC 822 dates are what feeds are supposed to use, but everything below
+// turns up in the wild.  Dates are normalised before trying these: any
+// leading day name is dropped, since they're often missing or wrong, and
+// zone names and GMT+hhmm style offsets are replaced with plain offsets.
+var dateFormats = []string{
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04 -0700",
+	"2 Jan 06 15:04:05 -0700",
+	"2 Jan 06 15:04 -0700",
+	"2 January 2006 15:04:05 -0700",
+	"2 January 2006 15:04 -0700",
+	"2 Jan 2006 15:04:05 -07:00",
+	"2 Jan 2006 15:04:05",
+	"2 Jan 2006 15:04",
+	"2 Jan 06 15:04:05",
+	"2 January 2006 15:04:05",
+	"2 Jan 2006",
+	"2 January 2006",
+	"Jan 2 2006 15:04:05 -0700",
+	"Jan 2 2006 15:04:05",
+	"Jan 2 2006",
+	"January 2 2006 15:04:05 -0700",
+	"January 2 2006",
+	"Jan 2 15:04:05 2006",
+	"Jan 2 15:04:05 -0700 2006",
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02T15:04:05.999999999-0700",
+	"2006-01-02T15:04-07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05-07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"2006/01/02 15:04:05",
+	"2006/01/02",
+}
+
+// Zone abbreviations and their offsets.  Where an abbreviation means
+// different things in different places, the most common usage in English
+// language podcast feeds wins.
+var zoneOffsets = map[string]string{
+	"UT": "+0000", "UTC": "+0000", "GMT": "+0000", "Z": "+0000", "WET": "+0000",
+	"EST": "-0500", "EDT": "-0400",
+	"CST": "-0600", "CDT": "-0500",
+	"MST": "-0700", "MDT": "-0600",
+	"PST": "-0800", "PDT": "-0700",
+	"AKST": "-0900", "AKDT": "-0800",
+	"HST": "-1000", "HDT": "-0900",
+	"AST": "-0400", "ADT": "-0300",
+	"NST": "-0330", "NDT": "-0230",
+	"BST": "+0100", "IST": "+0100", "WEST": "+0100",
+	"CET": "+0100", "CEST": "+0200", "MET": "+0100", "MEST": "+0200",
+	"EET": "+0200", "EEST": "+0300", "MSK": "+0300", "SAST": "+0200",
+	"JST": "+0900", "KST": "+0900", "HKT": "+0800", "SGT": "+0800", "AWST": "+0800",
+	"ACST": "+0930", "ACDT": "+1030",
+	"AEST": "+1000", "AEDT": "+1100",
+	"NZST": "+1200", "NZDT": "+1300",
+}
+
+var (
+	dayName = regexp.MustCompile(`(?i)^(mon|tue|wed|thu|fri|sat|sun)[a-z]*\.?,?\s+`)
+	// GMT+0000, UTC-05:00, GMT+1
+	gmtOffset    = regexp.MustCompile(`(?i)\b(GMT|UTC|UT)\s*([+-])(\d{1,2}):?(\d{2})?$`)
+	trailingZone = regexp.MustCompile(`\s([A-Za-z]{1,5})$`)
+	// a zone name following an offset, like "-0500 (EST)" or "+0000 GMT"
+	redundantZone = regexp.MustCompile(`([+-]\d{2}:?\d{2})\s*\(?[A-Za-z]{1,5}\)?$`)
+)
+
+// Dates without a zone are taken to be US Eastern, since RFC 822's zone
+// names are all American and that's where most feeds using them are from.
+var defaultZone = func() *time.Location {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		return time.FixedZone("EST", -5*60*60)
+	}
+	return loc
+}()
+
+// parsePodcastDate parses a pubDate in any of the many formats feeds use.
+func parsePodcastDate(date string) (time.Time, error) {
+	s := normaliseDate(date)
+	if s == "" {
+		return time.Time{}, fmt.Errorf("empty date")
+	}
+
+	for _, format := range dateFormats {
+		if t, err := time.ParseInLocation(format, s, defaultZone); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised date %q", date)
+}
+
+func normaliseDate(date string) string {
+	s := strings.Join(strings.Fields(date), " ")
+	s = strings.ReplaceAll(s, ",", " ")
+	s = strings.Join(strings.Fields(s), " ")
+	s = dayName.ReplaceAllString(s, "")
+
+	// Sept isn't something the time package recognises
+	s = strings.Replace(s, "Sept ", "Sep ", 1)
+
+	if m := gmtOffset.FindStringSubmatch(s); m != nil {
+		minutes := m[4]
+		if minutes == "" {
+			minutes = "00"
+		}
+		s = s[:len(s)-len(m[0])] + fmt.Sprintf("%s%02s%s", m[2], m[3], minutes)
+	} else if m := redundantZone.FindStringSubmatch(s); m != nil {
+		s = s[:len(s)-len(m[0])] + m[1]
+	} else if m := trailingZone.FindStringSubmatch(s); m != nil {
+		if offset, ok := zoneOffsets[strings.ToUpper(m[1])]; ok {
+			s = s[:len(s)-len(m[1])] + offset
+		}
+	}
+
+	return strings.TrimSpace(s)
+}
@@ -0,0 +1,105 @@
+package rss
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePodcastDate(t *testing.T) {
+	utc := func(y int, mo time.Month, d, h, mi, s int) time.Time {
+		return time.Date(y, mo, d, h, mi, s, 0, time.UTC)
+	}
+
+	var dates = []struct {
+		date     string
+		expected time.Time
+	}{
+		{"Mon, 08 Jun 2009 11:30:00 -0500", utc(2009, 6, 8, 16, 30, 0)},
+		{"Mon, 8 Jun 2009 11:30:00 -0500", utc(2009, 6, 8, 16, 30, 0)},
+		{"08 Jun 2009 11:30:00 -0500", utc(2009, 6, 8, 16, 30, 0)},
+		{"Fri, 08 Jun 2009 11:30:00 -0500", utc(2009, 6, 8, 16, 30, 0)},
+		{"Monday, 08 June 2009 11:30:00 -0500", utc(2009, 6, 8, 16, 30, 0)},
+		{"Mon, 08 Jun 09 11:30:00 -0500", utc(2009, 6, 8, 16, 30, 0)},
+		{"Mon, 08 Jun 2009 11:30 -0500", utc(2009, 6, 8, 16, 30, 0)},
+		{"Sat, 01 Apr 2023 18:58:00 EST", utc(2023, 4, 1, 23, 58, 0)},
+		{"Sat, 01 Jul 2023 18:58:00 EDT", utc(2023, 7, 1, 22, 58, 0)},
+		{"Sat, 01 Jul 2023 18:58:00 PDT", utc(2023, 7, 2, 1, 58, 0)},
+		{"Sat, 01 Jul 2023 18:58:00 pst", utc(2023, 7, 2, 2, 58, 0)},
+		{"Sat, 01 Jul 2023 18:58:00 GMT", utc(2023, 7, 1, 18, 58, 0)},
+		{"Sat, 01 Jul 2023 18:58:00 GMT+0000", utc(2023, 7, 1, 18, 58, 0)},
+		{"Sat, 01 Jul 2023 18:58:00 GMT+02:00", utc(2023, 7, 1, 16, 58, 0)},
+		{"Sat, 01 Jul 2023 18:58:00 UTC-5", utc(2023, 7, 1, 23, 58, 0)},
+		{"Sat, 01 Jul 2023 18:58:00 +0000 (UTC)", utc(2023, 7, 1, 18, 58, 0)},
+		{"Sat, 01 Jul 2023 18:58:00 +01:00", utc(2023, 7, 1, 17, 58, 0)},
+		// no zone is US Eastern, as RFC 822's zone names suggest
+		{"Sat, 01 Jul 2023 18:58:00", utc(2023, 7, 1, 22, 58, 0)},
+		{"Fri, 01 Dec 2023 18:58:00", utc(2023, 12, 1, 23, 58, 0)},
+		{"  Sat,  01 Jul 2023\n 18:58:00  Z ", utc(2023, 7, 1, 18, 58, 0)},
+		{"Sat, 01 Sept 2023 18:58:00 +0000", utc(2023, 9, 1, 18, 58, 0)},
+		{"01 Jul 2023", utc(2023, 7, 1, 4, 0, 0)},
+		{"July 1, 2023", utc(2023, 7, 1, 4, 0, 0)},
+		{"Jul 1, 2023 18:58:00 -0700", utc(2023, 7, 2, 1, 58, 0)},
+		{"2023-07-01T18:58:00Z", utc(2023, 7, 1, 18, 58, 0)},
+		{"2023-07-01T18:58:00.123+02:00", time.Date(2023, 7, 1, 16, 58, 0, 123000000, time.UTC)},
+		{"2023-07-01T18:58:00+0200", utc(2023, 7, 1, 16, 58, 0)},
+		{"2023-07-01T18:58:00", utc(2023, 7, 1, 22, 58, 0)},
+		{"2023-07-01 18:58:00", utc(2023, 7, 1, 22, 58, 0)},
+		{"2023-07-01", utc(2023, 7, 1, 4, 0, 0)},
+	}
+
+	for i, x := range dates {
+		got, err := parsePodcastDate(x.date)
+		if err != nil {
+			t.Errorf("dates[%d] - %q: %v", i, x.date, err)
+			continue
+		}
+		if !got.Equal(x.expected) {
+			t.Errorf("dates[%d] - %q: expected %v, got %v", i, x.date, x.expected, got.UTC())
+		}
+	}
+
+	for _, bad := range []string{"", "   ", "yesterday", "Sat, 45 Jul 2023 18:58:00 GMT"} {
+		if _, err := parsePodcastDate(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestUndatedItems(t *testing.T) {
+	doc := `<rss version="2.0"><channel><title>x</title>
+<lastBuildDate>Sat, 01 Jul 2023 18:58:00 GMT</lastBuildDate>
+<item><title>Good</title><pubDate>Fri, 30 Jun 2023 06:00:00 GMT</pubDate></item>
+<item><title>Bad</title><guid> tag:x,2023:bad </guid><pubDate>last Tuesday</pubDate></item>
+<item><title>Missing</title><enclosure url="http://x/missing.mp3"/></item>
+</channel></rss>`
+
+	rc, err := ParseRss([]byte(doc))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	channelDate := time.Date(2023, 7, 1, 18, 58, 0, 0, time.UTC)
+	items := rc.Feed.Items
+	if !items[0].PubDate.Equal(time.Date(2023, 6, 30, 6, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected good date to be kept, got %v", items[0].PubDate)
+	}
+	if !items[1].PubDate.Equal(channelDate) || !items[2].PubDate.Equal(channelDate) {
+		t.Errorf("expected bad dates to fall back to the channel's, got %v, %v", items[1].PubDate, items[2].PubDate)
+	}
+	if items[0].Undated || !items[1].Undated || !items[2].Undated {
+		t.Errorf("expected only bad dates marked undated, got %v, %v, %v", items[0].Undated, items[1].Undated, items[2].Undated)
+	}
+	if items[1].Id() != "tag:x,2023:bad" || items[2].Id() != "http://x/missing.mp3" {
+		t.Errorf("expected ids from the guid or enclosure, got %q, %q", items[1].Id(), items[2].Id())
+	}
+	if len(rc.Warnings) != 2 {
+		t.Errorf("expected two warnings, got %q", rc.Warnings)
+	}
+
+	rc = RssContainer{Feed: RssChannel{Items: []*RssItem{{}}}}
+	fetched := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	rc.datePodcasts(fetched)
+	if !rc.Feed.Items[0].PubDate.Equal(fetched) {
+		t.Errorf("expected fetch time without a channel date, got %v", rc.Feed.Items[0].PubDate)
+	}
+}
@@ -0,0 +1,175 @@
+package rss
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+)
+
+var (
+	utf8BOM    = []byte{0xEF, 0xBB, 0xBF}
+	utf16BEBOM = []byte{0xFE, 0xFF}
+	utf16LEBOM = []byte{0xFF, 0xFE}
+
+	xmlDeclaration  = regexp.MustCompile(`^\s*<\?xml[^>]*\?>`)
+	declaredCharset = regexp.MustCompile(`encoding\s*=\s*["']([^"']*)["']`)
+	rssStart        = regexp.MustCompile(`<rss(\s[^>]*)?>`)
+	itemElement     = regexp.MustCompile(`(?s)<item[\s>].*?</item\s*>`)
+	itemTitle       = regexp.MustCompile(`(?s)<title>(.*?)</title>`)
+)
+
+// newDecoder returns a decoder that knows the HTML entities feeds use
+// without declaring them, like &nbsp;.  Non-strict decoders also put up
+// with unquoted attributes, unclosed tags and stray ampersands.
+func newDecoder(doc []byte, strict bool) *xml.Decoder {
+	d := xml.NewDecoder(bytes.NewReader(doc))
+	d.Entity = xml.HTMLEntity
+	if !strict {
+		d.Strict = false
+		d.AutoClose = xml.HTMLAutoClose
+	}
+	return d
+}
+
+// toUTF8 strips any byte order mark and converts the document to UTF-8
+// from UTF-16, the charset it declares, or, if it isn't valid UTF-8 and
+// declares nothing else, Windows-1252.
+func toUTF8(doc []byte) ([]byte, []string, error) {
+	var warnings []string
+
+	var enc encoding.Encoding
+	switch {
+	case bytes.HasPrefix(doc, utf8BOM):
+		doc = doc[len(utf8BOM):]
+	case bytes.HasPrefix(doc, utf16BEBOM):
+		enc = unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM)
+	case bytes.HasPrefix(doc, utf16LEBOM):
+		enc = unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM)
+	}
+
+	if enc == nil {
+		charset := ""
+		if decl := xmlDeclaration.Find(doc); decl != nil {
+			if m := declaredCharset.FindSubmatch(decl); m != nil {
+				charset = strings.ToLower(strings.TrimSpace(string(m[1])))
+			}
+		}
+
+		switch charset {
+		case "", "utf-8", "utf8", "us-ascii", "ascii":
+			if utf8.Valid(doc) {
+				return doc, warnings, nil
+			}
+			// undeclared Windows-1252 is the usual culprit
+			enc = charmap.Windows1252
+			warnings = append(warnings, "feed isn't valid UTF-8, read it as Windows-1252")
+		default:
+			var err error
+			if enc, err = htmlindex.Get(charset); err != nil {
+				return doc, warnings, fmt.Errorf("unsupported charset %s", charset)
+			}
+		}
+	}
+
+	converted, err := enc.NewDecoder().Bytes(doc)
+	if err != nil {
+		return doc, warnings, err
+	}
+	// so the decoder doesn't try to convert it again
+	converted = xmlDeclaration.ReplaceAllLiteral(converted, []byte(`<?xml version="1.0" encoding="UTF-8"?>`))
+	return converted, warnings, nil
+}
+
+// decodeRss parses a feed, falling back to increasingly desperate measures
+// when it's malformed.  Anything that had to be worked around or left out
+// is described in the container's warnings.
+func decodeRss(doc []byte) (RssContainer, error) {
+	var rc RssContainer
+
+	doc, warnings, err := toUTF8(doc)
+	if err != nil {
+		return rc, err
+	}
+	rc.Warnings = warnings
+
+	err = newDecoder(doc, true).Decode(&rc)
+	if err == nil {
+		return rc, nil
+	}
+
+	recovered, rerr := recoverRss(doc)
+	if rerr != nil {
+		return rc, err
+	}
+	recovered.Warnings = append(rc.Warnings, recovered.Warnings...)
+	recovered.Warnings = append([]string{fmt.Sprintf("malformed feed, salvaged what could be: %v", err)},
+		recovered.Warnings...)
+	return recovered, nil
+}
+
+// recoverRss salvages what it can from a feed that can't be parsed as a
+// whole: the channel's own details, and each item that parses on its own.
+// Items are decoded inside the document's <rss> element so that its
+// namespace declarations still apply.
+func recoverRss(doc []byte) (RssContainer, error) {
+	var rc RssContainer
+
+	start := rssStart.Find(doc)
+	if start == nil {
+		return rc, fmt.Errorf("no rss element")
+	}
+	wrap := func(channel []byte) []byte {
+		w := append([]byte{}, start...)
+		w = append(w, "<channel>"...)
+		w = append(w, channel...)
+		return append(w, "</channel></rss>"...)
+	}
+
+	items := itemElement.FindAllIndex(doc, -1)
+
+	// the channel's details are everything between <channel> and the first
+	// item
+	header := doc
+	if len(items) > 0 {
+		header = doc[:items[0][0]]
+	}
+	if i := bytes.Index(header, []byte("<channel")); i >= 0 {
+		if j := bytes.IndexByte(header[i:], '>'); j >= 0 {
+			header = header[i+j+1:]
+		}
+	}
+	if err := newDecoder(wrap(header), false).Decode(&rc); err != nil {
+		rc.Warnings = append(rc.Warnings, fmt.Sprintf("couldn't read channel details: %v", err))
+	}
+	rc.Feed.Items = nil
+
+	for n, loc := range items {
+		var one RssContainer
+		err := newDecoder(wrap(doc[loc[0]:loc[1]]), false).Decode(&one)
+		if err == nil && len(one.Feed.Items) != 1 {
+			err = fmt.Errorf("not a single item")
+		}
+		if err != nil {
+			title := ""
+			if m := itemTitle.FindSubmatch(doc[loc[0]:loc[1]]); m != nil {
+				title = fmt.Sprintf(" (%q)", m[1])
+			}
+			rc.Warnings = append(rc.Warnings, fmt.Sprintf("dropped item %d%s: %v", n+1, title, err))
+			continue
+		}
+		rc.Feed.Items = append(rc.Feed.Items, one.Feed.Items[0])
+	}
+
+	if len(rc.Feed.Items) == 0 && rc.Feed.Title == "" {
+		return rc, fmt.Errorf("nothing salvageable")
+	}
+	return rc, nil
+}
@@ -0,0 +1,94 @@
+package rss
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestDecodeCharsets(t *testing.T) {
+	item := func(title string) string {
+		return `<rss version="2.0" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd"><channel><title>x</title>` +
+			`<item><title>` + title + `</title><itunes:episode>7</itunes:episode></item></channel></rss>`
+	}
+
+	utf16le := func(s string) string {
+		b := []byte{0xFF, 0xFE}
+		for _, r := range utf16.Encode([]rune(s)) {
+			b = append(b, byte(r), byte(r>>8))
+		}
+		return string(b)
+	}
+
+	var docs = []struct {
+		doc      string
+		title    string
+		warnings int
+	}{
+		{`<?xml version="1.0" encoding="UTF-8"?>` + item("Café"), "Café", 0},
+		{`<?xml version="1.0" encoding="ISO-8859-1"?>` + item("Caf\xe9"), "Café", 0},
+		{`<?xml version='1.0' encoding='windows-1252'?>` + item("\x93Quoted\x94"), "“Quoted”", 0},
+		{`<?xml version="1.0"?>` + item("Caf\xe9"), "Café", 1},
+		{"\xef\xbb\xbf" + `<?xml version="1.0" encoding="UTF-8"?>` + item("Bom"), "Bom", 0},
+		{utf16le(`<?xml version="1.0" encoding="UTF-16"?>` + item("Sixteen é")), "Sixteen é", 0},
+		{item("Tom&nbsp;&amp;&nbsp;Jerry &eacute;t&eacute;"), "Tom & Jerry été", 0},
+	}
+
+	for i, x := range docs {
+		rc, err := ParseRss([]byte(x.doc))
+		if err != nil {
+			t.Errorf("docs[%d] - parse error: %v", i, err)
+			continue
+		}
+		if len(rc.Feed.Items) != 1 || rc.Feed.Items[0].Title() != x.title || rc.Feed.Items[0].Episode != "7" {
+			t.Errorf("docs[%d] - expected title %q, got %+v", i, x.title, rc.Feed.Items)
+		}
+		// every item here lacks a pubDate
+		if len(rc.Warnings) != x.warnings+1 {
+			t.Errorf("docs[%d] - expected %d warnings, got %q", i, x.warnings, rc.Warnings)
+		}
+	}
+
+	if _, err := ParseRss([]byte(`<?xml version="1.0" encoding="x-klingon"?>` + item("x"))); err == nil {
+		t.Errorf("expected error for unknown charset")
+	}
+}
+
+func TestDecodeRecovery(t *testing.T) {
+	doc := `<rss version="2.0" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd"><channel>
+<title>Salvage</title>
+<item><title>One</title><itunes:episode>1</itunes:episode><pubDate>Mon, 01 Jan 2024 06:00:00 GMT</pubDate></item>
+<item><title>Two</title><description>Fish & chips <br> unquoted=attr</description><pubDate>Tue, 02 Jan 2024 06:00:00 GMT</pubDate></item>
+<item><title>Three</title><![CDATA[ never closed </item>
+<item><title>Four</title><itunes:episode>4</itunes:episode><pubDate>Thu, 04 Jan 2024 06:00:00 GMT</pubDate></item>
+</channel></rss>`
+
+	rc, err := ParseRss([]byte(doc))
+	if err != nil {
+		t.Fatalf("expected salvaged feed, got %v", err)
+	}
+
+	if rc.Feed.Title != "Salvage" {
+		t.Errorf("expected channel title, got %q", rc.Feed.Title)
+	}
+
+	var titles []string
+	for _, item := range rc.Feed.Items {
+		titles = append(titles, item.Title())
+	}
+	if strings.Join(titles, ",") != "One,Two,Four" {
+		t.Errorf("expected items One,Two,Four, got %v", titles)
+	}
+	if len(rc.Feed.Items) == 3 && rc.Feed.Items[2].Episode != "4" {
+		t.Errorf("expected namespaced fields in salvaged items, got %+v", rc.Feed.Items[2])
+	}
+
+	warnings := strings.Join(rc.Warnings, "\n")
+	if !strings.Contains(warnings, "malformed feed") || !strings.Contains(warnings, `dropped item 3 ("Three")`) {
+		t.Errorf("expected diagnostics of what was dropped, got:\n%s", warnings)
+	}
+
+	if _, err := ParseRss([]byte("<html><body>Not Found</body></html>")); err == nil {
+		t.Errorf("expected error for something that isn't a feed")
+	}
+}
@@ -0,0 +1,111 @@
+package rss
+
+import (
+	"strconv"
+	"strings"
+)
+
+// AlternateEnclosure is a podcast:alternateEnclosure, another version of an
+// episode such as a different bitrate, format or a video, which can be
+// fetched from any of its sources.
+type AlternateEnclosure struct {
+	EnclosureType string `xml:"type,attr"`
+	Length        string `xml:"length,attr"`
+	// Bits per second
+	Bitrate string `xml:"bitrate,attr"`
+	// Of video, in pixels
+	Height  string `xml:"height,attr"`
+	Title   string `xml:"title,attr"`
+	Sources []struct {
+		Uri string `xml:"uri,attr"`
+	} `xml:"https://podcastindex.org/namespace/1.0 source"`
+}
+
+// AllEnclosures returns every version of the item that could be
+// downloaded: its enclosures in the order the feed gives them, then each
+// source of each alternate enclosure.  Urls seen already are left out.
+func (i *RssItem) AllEnclosures() []RssEnclosure {
+	var all []RssEnclosure
+	seen := map[string]bool{}
+	add := func(e RssEnclosure) {
+		e.Url = strings.TrimSpace(e.Url)
+		if e.Url == "" || seen[e.Url] {
+			return
+		}
+		seen[e.Url] = true
+		all = append(all, e)
+	}
+
+	add(i.Enclosure)
+	for _, e := range i.Enclosures {
+		add(e)
+	}
+	for _, a := range i.Alternates {
+		for _, src := range a.Sources {
+			// only http sources can be fetched, not ipfs: and the like
+			if !strings.HasPrefix(src.Uri, "http://") && !strings.HasPrefix(src.Uri, "https://") {
+				continue
+			}
+			add(RssEnclosure{
+				Url:           src.Uri,
+				Length:        a.Length,
+				EnclosureType: a.EnclosureType,
+				Bitrate:       a.Bitrate,
+				Height:        a.Height,
+				Title:         a.Title,
+				Alternate:     true,
+			})
+		}
+	}
+	return all
+}
+
+// firstEnclosures makes each item's first enclosure its Enclosure.
+func (rc *RssContainer) firstEnclosures() {
+	for _, item := range rc.Feed.Items {
+		if all := item.AllEnclosures(); len(all) > 0 {
+			item.Enclosure = all[0]
+		}
+	}
+}
+
+// Type is the enclosure's MIME type, guessed from its url when the feed
+// doesn't give a useful one.
+func (e RssEnclosure) Type() string {
+	if t := normaliseType(e.EnclosureType); t != "" && t != "application/octet-stream" {
+		return t
+	}
+	return TypeForUrl(e.Url)
+}
+
+// Size is the enclosure's length in bytes, or zero if the feed doesn't say.
+func (e RssEnclosure) Size() int64 {
+	n, err := strconv.ParseInt(strings.TrimSpace(e.Length), 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// Bitrate is one of the item's enclosures' bits per second, as the feed
+// gives it or worked out from its length and the item's duration, or zero
+// if neither is known.
+func (i *RssItem) Bitrate(e RssEnclosure) int64 {
+	if b, err := strconv.ParseFloat(strings.TrimSpace(e.Bitrate), 64); err == nil && b > 0 {
+		return int64(b)
+	}
+	d, ok := i.DurationValue()
+	if size := e.Size(); ok && size > 0 && d.Seconds() >= 1 {
+		return int64(float64(size*8) / d.Seconds())
+	}
+	return 0
+}
+
+// HeightValue is a video enclosure's height in pixels, or zero.
+func (e RssEnclosure) HeightValue() int64 {
+	n, err := strconv.ParseInt(strings.TrimSpace(e.Height), 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
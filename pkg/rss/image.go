@@ -0,0 +1,62 @@
+package rss
+
+import (
+	"strconv"
+	"strings"
+)
+
+// RssImage is the channel's plain RSS <image>.
+type RssImage struct {
+	Url string `xml:"url"`
+}
+
+type ItunesImage struct {
+	Href string `xml:"href,attr"`
+}
+
+// PodcastImages is podcast:images, whose srcset lists versions of an
+// image at different widths, like "a.jpg 1500w, b.jpg 600w".
+type PodcastImages struct {
+	Srcset string `xml:"srcset,attr"`
+}
+
+// Largest is the url of the widest image in the srcset, or "".
+func (p PodcastImages) Largest() string {
+	best, bestWidth := "", -1
+	for _, candidate := range strings.Split(p.Srcset, ",") {
+		fields := strings.Fields(candidate)
+		if len(fields) == 0 {
+			continue
+		}
+		width := 0
+		if len(fields) > 1 {
+			width, _ = strconv.Atoi(strings.TrimSuffix(fields[1], "w"))
+		}
+		if width > bestWidth {
+			best, bestWidth = fields[0], width
+		}
+	}
+	return best
+}
+
+// ImageUrl is the url of the channel's artwork, or "" if it has none.
+// The largest of podcast:images is preferred, then itunes:image, which is
+// usually bigger than the plain RSS image.
+func (c *RssChannel) ImageUrl() string {
+	for _, u := range []string{c.PodcastImages.Largest(), c.ItunesImage.Href, c.Image.Url} {
+		if u = strings.TrimSpace(u); u != "" {
+			return u
+		}
+	}
+	return ""
+}
+
+// ImageUrl is the url of the episode's own artwork, or "" if it has none.
+func (i *RssItem) ImageUrl() string {
+	for _, u := range []string{i.PodcastImages.Largest(), i.ItunesImage.Href} {
+		if u = strings.TrimSpace(u); u != "" {
+			return u
+		}
+	}
+	return ""
+}
@@ -0,0 +1,103 @@
+package rss
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// MIME types of enclosures and the extensions their files get.  The first
+// extension listed for a type is the one its files are saved with, and the
+// first type listed for an extension is the one guessed from it.
+var mediaTypes = []struct {
+	mimeType  string
+	extension string
+}{
+	{"audio/mpeg", "mp3"},
+	{"audio/mp3", "mp3"},
+	{"audio/mpeg3", "mp3"},
+	{"audio/x-mpeg", "mp3"},
+	{"audio/aac", "aac"},
+	{"audio/x-aac", "aac"},
+	{"audio/ogg", "ogg"},
+	{"application/ogg", "ogg"},
+	{"audio/opus", "opus"},
+	{"audio/flac", "flac"},
+	{"audio/x-flac", "flac"},
+	{"audio/wav", "wav"},
+	{"audio/x-wav", "wav"},
+	{"audio/wave", "wav"},
+	{"video/mp4", "mp4"},
+	// audio/mp4 downloads have always been saved as mp4, and renaming new
+	// ones would split a show's episodes between two extensions
+	{"audio/mp4", "mp4"},
+	{"audio/mp4", "m4a"},
+	{"audio/x-m4a", "m4a"},
+	{"audio/m4a", "m4a"},
+	{"video/x-m4v", "m4v"},
+	{"video/m4v", "m4v"},
+	{"video/quicktime", "mov"},
+	{"video/webm", "webm"},
+	{"audio/webm", "webm"},
+	{"application/pdf", "pdf"},
+}
+
+// normaliseType lower-cases a MIME type and drops any parameters.
+func normaliseType(mimeType string) string {
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	return strings.ToLower(strings.TrimSpace(mimeType))
+}
+
+// KnownType returns a MIME type without any parameters, or "" if it isn't
+// a known kind of media.
+func KnownType(mimeType string) string {
+	if ExtensionForType(mimeType) == "" {
+		return ""
+	}
+	return normaliseType(mimeType)
+}
+
+func ExtensionForType(mimeType string) string {
+	mimeType = normaliseType(mimeType)
+	for _, m := range mediaTypes {
+		if m.mimeType == mimeType {
+			return m.extension
+		}
+	}
+	return ""
+}
+
+// ExtensionsForType returns every extension files of a MIME type are
+// known by, the one they're saved with first.
+func ExtensionsForType(mimeType string) []string {
+	mimeType = normaliseType(mimeType)
+	var extensions []string
+	for _, m := range mediaTypes {
+		if m.mimeType == mimeType {
+			extensions = append(extensions, m.extension)
+		}
+	}
+	return extensions
+}
+
+// TypeForExtension returns the MIME type for a file extension, with or
+// without its dot, or "" if it isn't a known kind of media.
+func TypeForExtension(extension string) string {
+	extension = strings.ToLower(strings.TrimPrefix(extension, "."))
+	for _, m := range mediaTypes {
+		if m.extension == extension {
+			return m.mimeType
+		}
+	}
+	return ""
+}
+
+// TypeForUrl guesses an enclosure's MIME type from the extension of its
+// url's path.
+func TypeForUrl(u string) string {
+	parsed, err := url.Parse(strings.TrimSpace(u))
+	if err != nil {
+		return ""
+	}
+	return TypeForExtension(path.Ext(parsed.Path))
+}
@@ -0,0 +1,50 @@
+package rss
+
+import "strings"
+
+const atomNS = "http://www.w3.org/2005/Atom"
+
+// AtomLink is an atom:link in a channel.  Besides pointing at the feed
+// itself, they link paged and archived feeds (RFC 5005) to the pages
+// holding their older items.
+type AtomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+}
+
+// OlderPage is the href of the page of older items the channel links to:
+// the next page of a paged feed, or the previous archive of an archived
+// one.  It's "" if there's no such link, and may be relative.
+func (c *RssChannel) OlderPage() string {
+	for _, rel := range []string{"next", "prev-archive"} {
+		for _, l := range c.AtomLinks {
+			if strings.EqualFold(strings.TrimSpace(l.Rel), rel) && strings.TrimSpace(l.Href) != "" {
+				return strings.TrimSpace(l.Href)
+			}
+		}
+	}
+	return ""
+}
+
+// Merge adds the items of an older page of the feed to the channel,
+// leaving out any it already has.
+func (c *RssChannel) Merge(page *RssChannel) {
+	seen := map[string]bool{}
+	for _, item := range c.Items {
+		seen[item.key()] = true
+	}
+	for _, item := range page.Items {
+		if !seen[item.key()] {
+			seen[item.key()] = true
+			c.Items = append(c.Items, item)
+		}
+	}
+}
+
+// key identifies an item across pages, by its enclosure if it has one.
+func (i *RssItem) key() string {
+	if i.Enclosure.Url != "" {
+		return i.Enclosure.Url
+	}
+	return i.Title() + "\x00" + i.PubDateString
+}
@@ -29,90 +29,151 @@ func (s *NonNamespaceString) UnmarshalXML(d *xml.Decoder, start xml.StartElement
 	return nil
 }
 
+const (
+	syndicationNS = "http://purl.org/rss/1.0/modules/syndication/"
+	itunesNS      = "http://www.itunes.com/dtds/podcast-1.0.dtd"
+	podcastNS     = "https://podcastindex.org/namespace/1.0"
+)
+
 type RssContainer struct {
 	XMLName xml.Name   `xml:"rss"`
 	Version string     `xml:"version,attr"`
-	Feed    RssChannel `xml:channel"`
+	Feed    RssChannel `xml:"channel"`
+	// Problems that didn't stop the feed being parsed
+	Warnings []string `xml:"-"`
+	// Set when ReadRss stopped before the end of the feed
+	Truncated bool `xml:"-"`
 }
 
 type RssChannel struct {
-	XMLName xml.Name   `xml:"channel"`
-	Title   string     `xml:"title"`
-	Items   []*RssItem `xml:"item"`
+	XMLName       xml.Name   `xml:"channel"`
+	Title         string     `xml:"title"`
+	Items         []*RssItem `xml:"item"`
+	PubDate       string     `xml:"pubDate"`
+	LastBuildDate string     `xml:"lastBuildDate"`
+	// Minutes the channel may be cached for
+	Ttl string `xml:"ttl"`
+	// From the syndication module: the feed updates UpdateFrequency
+	// times per UpdatePeriod (hourly, daily, weekly, monthly or yearly)
+	UpdatePeriod    string `xml:"http://purl.org/rss/1.0/modules/syndication/ updatePeriod"`
+	UpdateFrequency string `xml:"http://purl.org/rss/1.0/modules/syndication/ updateFrequency"`
+	// Namespaced images come first so that <image> only gets the plain one
+	ItunesImage   ItunesImage   `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd image"`
+	PodcastImages PodcastImages `xml:"https://podcastindex.org/namespace/1.0 images"`
+	Image         RssImage      `xml:"image"`
+	// Links to the feed's other pages
+	AtomLinks []AtomLink `xml:"http://www.w3.org/2005/Atom link"`
 }
 
 type RssItem struct {
-	XMLName       xml.Name           `xml:"item"`
+	XMLName       xml.Name           `xml:"item" json:"-"`
 	MyTitle       NonNamespaceString `xml:"title"`
 	MyDescription string             `xml:"description"`
-	// guid?
-	PubDateString string       `xml:"pubDate"`
-	PubDate       time.Time    `xml:"-"`
-	ItunesTitle   string       `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd title"`
-	Duration      string       `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd duration"`
-	Episode       string       `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd episode"`
-	Season        string       `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd season"`
-	Enclosure     RssEnclosure `xml:"enclosure"`
+	Guid          string             `xml:"guid"`
+	PubDateString string             `xml:"pubDate"`
+	PubDate       time.Time          `xml:"-"`
+	// The pubDate couldn't be parsed, and PubDate is only a stand-in for
+	// naming and ordering the episode
+	Undated       bool          `xml:"-" json:"-"`
+	ItunesTitle   string        `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd title"`
+	Duration      string        `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd duration"`
+	Episode       string        `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd episode"`
+	Season        string        `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd season"`
+	EpisodeType   string        `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd episodeType"`
+	ItunesImage   ItunesImage   `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd image"`
+	PodcastImages PodcastImages `xml:"https://podcastindex.org/namespace/1.0 images"`
+	// The item's first enclosure; see AllEnclosures for the rest
+	Enclosure  RssEnclosure         `xml:"-"`
+	Enclosures []RssEnclosure       `xml:"enclosure"`
+	Alternates []AlternateEnclosure `xml:"https://podcastindex.org/namespace/1.0 alternateEnclosure"`
 }
 
 type RssEnclosure struct {
-	XMLName       xml.Name `xml:"enclosure"`
+	XMLName       xml.Name `xml:"enclosure" json:"-"`
 	Url           string   `xml:"url,attr"`
 	Length        string   `xml:"length,attr"`
 	EnclosureType string   `xml:"type,attr"`
+	// Only known for podcast:alternateEnclosure variants
+	Bitrate string `xml:"-"`
+	Height  string `xml:"-"`
+	Title   string `xml:"-"`
+	// A source of a podcast:alternateEnclosure, so another version of the
+	// item's first enclosure rather than a file of its own
+	Alternate bool `xml:"-"`
 }
 
 func ParseRss(doc []byte) (RssContainer, error) {
-	var rc RssContainer
-
-	if err := xml.Unmarshal(doc, &rc); err != nil {
+	rc, err := decodeRss(doc)
+	if err != nil {
 		return rc, err
 	}
 
+	rc.datePodcasts(time.Now())
+	rc.firstEnclosures()
+	return rc, nil
+}
+
+// datePodcasts parses each item's pubDate.  Items whose date can't be
+// made sense of are marked undated, with a warning, and given the
+// channel's date or failing that the time the feed was fetched as a
+// stand-in.
+func (rc *RssContainer) datePodcasts(fetched time.Time) {
+	fallback, fallbackName := fetched, "fetch time"
+	for _, d := range []string{rc.Feed.PubDate, rc.Feed.LastBuildDate} {
+		if t, err := parsePodcastDate(d); err == nil {
+			fallback, fallbackName = t, "channel date"
+			break
+		}
+	}
+
 	for _, item := range rc.Feed.Items {
 		var err error
 		item.PubDate, err = parsePodcastDate(item.PubDateString)
 		if err != nil {
-			return rc, fmt.Errorf("error parsing date %s: %v", item.PubDateString, err)
+			item.PubDate = fallback
+			item.Undated = true
+			rc.Warnings = append(rc.Warnings, fmt.Sprintf("%q: %v, treating as undated and using %s",
+				item.Title(), err, fallbackName))
 		}
 	}
-	return rc, nil
 }
 
-func parsePodcastDate(date string) (time.Time, error) {
-	// rfc822 specifies support for the *ST USA timezone abbreviations, and
-	// they've been grandfathered into the podcast "standards".  Hopefully
-	// most feeds use UTC or timezone offsets.
-	loc, err := time.LoadLocation("America/New_York")
-	if err != nil {
-		return time.Time{}, err
+// UpdateInterval is how often the channel says it's worth checking for
+// changes, from <ttl> or else <sy:updatePeriod>, or zero if it doesn't say.
+func (c *RssChannel) UpdateInterval() time.Duration {
+	if ttl, err := strconv.Atoi(strings.TrimSpace(c.Ttl)); err == nil && ttl > 0 {
+		return time.Duration(ttl) * time.Minute
 	}
 
-	formats := []string{
-		time.RFC1123,
-		time.RFC1123Z,
-		"Mon, 2 Jan 2006 15:04:05 MST",   // rfc1123 without date padding
-		"Mon, 2 Jan 2006 15:04:05 -0700", // rfc1123Z without date padding
+	var period time.Duration
+	switch strings.ToLower(strings.TrimSpace(c.UpdatePeriod)) {
+	case "hourly":
+		period = time.Hour
+	case "daily":
+		period = 24 * time.Hour
+	case "weekly":
+		period = 7 * 24 * time.Hour
+	case "monthly":
+		period = 30 * 24 * time.Hour
+	case "yearly":
+		period = 365 * 24 * time.Hour
+	default:
+		return 0
 	}
 
-	var firstErr error
-	for i, format := range formats {
-		t, err := time.ParseInLocation(format, date, loc)
-		if err == nil {
-			return t, nil
-		}
-		if i == 0 {
-			firstErr = err
-		}
+	frequency, err := strconv.Atoi(strings.TrimSpace(c.UpdateFrequency))
+	if err != nil || frequency < 1 {
+		frequency = 1
 	}
-
-	return time.Time{}, firstErr
+	return period / time.Duration(frequency)
 }
 
+// Podcasts returns the items that have an enclosure.  Which types of
+// enclosure are wanted is up to each feed's media_types.
 func (rc RssContainer) Podcasts() []*RssItem {
 	var ret []*RssItem
 	for _, item := range rc.Feed.Items {
-		if strings.HasPrefix(item.Enclosure.EnclosureType, "audio/") {
+		if len(item.AllEnclosures()) > 0 {
 			ret = append(ret, item)
 		}
 	}
@@ -130,27 +191,33 @@ func (i *RssItem) Attrs() map[string]string {
 		m["itunestitle"] = i.ItunesTitle
 	}
 
+	// as the feed gives them; templates can pad them with pad
 	if i.Episode != "" {
-		if epno, err := strconv.Atoi(i.Episode); err != nil {
-			m["episode"] = fmt.Sprintf("%3d", epno)
-		} else {
-			m["episode"] = i.Episode
-		}
+		m["episode"] = i.Episode
 	}
 
 	if i.Season != "" {
-		if sno, err := strconv.Atoi(i.Season); err != nil {
-			m["season"] = fmt.Sprintf("%3d", sno)
-		} else {
-			m["season"] = i.Season
-		}
+		m["season"] = i.Season
 	}
 
 	m["date"] = i.PubDate.Format("2006-01-02")
+	m["year"] = i.PubDate.Format("2006")
+	m["month"] = i.PubDate.Format("01")
+	m["day"] = i.PubDate.Format("02")
+	m["pubdate"] = i.PubDate.Format(time.RFC3339)
 
 	return m
 }
 
+// Id identifies the item, for telling whether an undated item has been
+// seen before: its guid, or failing that its enclosure's url.
+func (i *RssItem) Id() string {
+	if guid := strings.TrimSpace(i.Guid); guid != "" {
+		return guid
+	}
+	return i.Enclosure.Url
+}
+
 func (i *RssItem) Date() time.Time {
 	return i.PubDate
 }
@@ -167,8 +234,46 @@ func (i *RssItem) Description() string {
 	return i.MyDescription
 }
 
+// Type is the enclosure's MIME type, guessed from its url when the feed
+// doesn't give a useful one.
 func (i *RssItem) Type() string {
-	return i.Enclosure.EnclosureType
+	return i.Enclosure.Type()
+}
+
+// DurationValue parses itunes:duration, which feeds give as seconds,
+// MM:SS or HH:MM:SS.
+func (i *RssItem) DurationValue() (time.Duration, bool) {
+	d := strings.TrimSpace(i.Duration)
+	if d == "" {
+		return 0, false
+	}
+
+	var total float64
+	parts := strings.Split(d, ":")
+	if len(parts) > 3 {
+		return 0, false
+	}
+	for _, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || n < 0 {
+			return 0, false
+		}
+		total = total*60 + n
+	}
+	return time.Duration(total * float64(time.Second)), true
+}
+
+// Length is the enclosure size in bytes, or zero if the feed doesn't say.
+func (i *RssItem) Length() int64 {
+	return i.Enclosure.Size()
+}
+
+// Kind is the itunes:episodeType, which defaults to full.
+func (i *RssItem) Kind() string {
+	if i.EpisodeType == "" {
+		return "full"
+	}
+	return strings.ToLower(strings.TrimSpace(i.EpisodeType))
 }
 
 func (i *RssItem) FileBaseName() string {
@@ -186,12 +291,5 @@ func (i *RssItem) FileBaseName() string {
 }
 
 func (i *RssItem) ExtensionFromMimeType() string {
-	extensions := map[string]string{
-		"audio/mpeg":  "mp3",
-		"audio/mp3":   "mp3",
-		"audio/mp4":   "mp4",
-		"audio/ogg":   "ogg",
-		"audio/x-wav": "wav",
-	}
-	return extensions[i.Enclosure.EnclosureType]
+	return ExtensionForType(i.Type())
 }
@@ -1,6 +1,7 @@
 package rss
 
 import (
+	"strings"
 	"testing"
 	"time"
 )
@@ -166,3 +167,186 @@ func TestParseRss(t *testing.T) {
 	}
 
 }
+
+func TestUpdateInterval(t *testing.T) {
+	var channels = []struct {
+		channel  RssChannel
+		expected time.Duration
+	}{
+		{RssChannel{}, 0},
+		{RssChannel{Ttl: "60"}, time.Hour},
+		{RssChannel{Ttl: " 1440 "}, 24 * time.Hour},
+		{RssChannel{Ttl: "soon"}, 0},
+		{RssChannel{UpdatePeriod: "daily"}, 24 * time.Hour},
+		{RssChannel{UpdatePeriod: "hourly", UpdateFrequency: "2"}, 30 * time.Minute},
+		{RssChannel{UpdatePeriod: "Weekly", UpdateFrequency: "0"}, 7 * 24 * time.Hour},
+		{RssChannel{Ttl: "15", UpdatePeriod: "daily"}, 15 * time.Minute},
+		{RssChannel{UpdatePeriod: "fortnightly"}, 0},
+	}
+
+	for i, x := range channels {
+		if got := x.channel.UpdateInterval(); got != x.expected {
+			t.Errorf("channels[%d] - expected %v, got %v", i, x.expected, got)
+		}
+	}
+}
+
+func TestEnclosureTypes(t *testing.T) {
+	var enclosures = []struct {
+		enclosure RssEnclosure
+		mimeType  string
+		extension string
+	}{
+		{RssEnclosure{Url: "http://x/ep.mp3", EnclosureType: "audio/mpeg"}, "audio/mpeg", "mp3"},
+		{RssEnclosure{Url: "http://x/ep", EnclosureType: "Audio/MP4; codecs=mp4a.40.2"}, "audio/mp4", "mp4"},
+		{RssEnclosure{Url: "http://x/ep.m4a"}, "audio/mp4", "mp4"},
+		{RssEnclosure{Url: "http://x/ep.mp4", EnclosureType: "video/mp4"}, "video/mp4", "mp4"},
+		{RssEnclosure{Url: "http://x/notes.pdf", EnclosureType: "application/pdf"}, "application/pdf", "pdf"},
+		// sniffed from the url
+		{RssEnclosure{Url: "http://x/ep.m4v?token=1"}, "video/x-m4v", "m4v"},
+		{RssEnclosure{Url: "http://x/ep.OPUS", EnclosureType: "application/octet-stream"}, "audio/opus", "opus"},
+		{RssEnclosure{Url: "http://x/ep.flac", EnclosureType: " "}, "audio/flac", "flac"},
+		{RssEnclosure{Url: "http://x/ep.mov"}, "video/quicktime", "mov"},
+		{RssEnclosure{Url: "http://x/ep.webm"}, "video/webm", "webm"},
+		{RssEnclosure{Url: "http://x/ep.aac"}, "audio/aac", "aac"},
+		{RssEnclosure{Url: "http://x/download"}, "", ""},
+	}
+
+	for i, x := range enclosures {
+		item := &RssItem{Enclosure: x.enclosure}
+		if item.Type() != x.mimeType || item.ExtensionFromMimeType() != x.extension {
+			t.Errorf("enclosures[%d] - expected %s, %s, got %s, %s",
+				i, x.mimeType, x.extension, item.Type(), item.ExtensionFromMimeType())
+		}
+	}
+}
+
+func TestMultipleEnclosures(t *testing.T) {
+	doc := `<rss version="2.0" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd" xmlns:podcast="https://podcastindex.org/namespace/1.0"><channel>
+<item>
+  <title>Many</title>
+  <itunes:duration>1:00:00</itunes:duration>
+  <enclosure url="http://x/ep.mp3" length="57600000" type="audio/mpeg"/>
+  <enclosure url="http://x/ep.pdf" length="1000" type="application/pdf"/>
+  <podcast:alternateEnclosure type="audio/mpeg" length="57600000" bitrate="128000" default="true">
+    <podcast:source uri="http://x/ep.mp3"/>
+  </podcast:alternateEnclosure>
+  <podcast:alternateEnclosure type="audio/opus" length="14400000" bitrate="32000" title="Low">
+    <podcast:source uri="ipfs://abc"/>
+    <podcast:source uri="https://cdn/ep.opus"/>
+    <podcast:source uri="https://mirror/ep.opus"/>
+  </podcast:alternateEnclosure>
+  <podcast:alternateEnclosure type="video/mp4" height="1080">
+    <podcast:source uri="https://cdn/ep.mp4"/>
+  </podcast:alternateEnclosure>
+</item>
+</channel></rss>`
+
+	rc, err := ParseRss([]byte(doc))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	item := rc.Feed.Items[0]
+	if item.Url() != "http://x/ep.mp3" {
+		t.Errorf("expected first enclosure, got %s", item.Url())
+	}
+
+	var expected = []struct {
+		url     string
+		bitrate int64
+	}{
+		{"http://x/ep.mp3", 128000},
+		{"http://x/ep.pdf", 2},
+		{"https://cdn/ep.opus", 32000},
+		{"https://mirror/ep.opus", 32000},
+		{"https://cdn/ep.mp4", 0},
+	}
+
+	all := item.AllEnclosures()
+	if len(all) != len(expected) {
+		t.Fatalf("expected %d enclosures, got %+v", len(expected), all)
+	}
+	for i, x := range expected {
+		if all[i].Url != x.url || item.Bitrate(all[i]) != x.bitrate {
+			t.Errorf("enclosures[%d] - expected %s at %d, got %s at %d", i, x.url, x.bitrate, all[i].Url, item.Bitrate(all[i]))
+		}
+	}
+	if all[2].Title != "Low" || all[4].HeightValue() != 1080 {
+		t.Errorf("expected alternate details, got %+v", all)
+	}
+}
+
+func TestImages(t *testing.T) {
+	const head = `<rss version="2.0" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd" xmlns:podcast="https://podcastindex.org/namespace/1.0"><channel><title>Art</title>`
+
+	var docs = []struct {
+		channel string
+		item    string
+		cover   string
+		art     string
+	}{
+		{`<image><url>http://x/rss.jpg</url><title>Art</title></image>`, ``, "http://x/rss.jpg", ""},
+		{`<image><url>http://x/rss.jpg</url></image><itunes:image href="http://x/itunes.jpg"/>`,
+			`<itunes:image href="http://x/ep.jpg"/>`, "http://x/itunes.jpg", "http://x/ep.jpg"},
+		{`<itunes:image href="http://x/itunes.jpg"/><podcast:images srcset="http://x/600.jpg 600w, http://x/1500.jpg 1500w, http://x/300.jpg 300w"/>`,
+			`<podcast:images srcset="http://x/ep-small.jpg 100w,http://x/ep-big.jpg 900w"/>`, "http://x/1500.jpg", "http://x/ep-big.jpg"},
+		{``, ``, "", ""},
+	}
+
+	for i, x := range docs {
+		doc := head + x.channel + `<item><title>Ep</title>` + x.item + `</item></channel></rss>`
+		parsed, err := ParseRss([]byte(doc))
+		if err != nil {
+			t.Fatalf("docs[%d] - parse error: %v", i, err)
+		}
+		streamed, err := ReadRss(strings.NewReader(doc), time.Time{})
+		if err != nil {
+			t.Fatalf("docs[%d] - read error: %v", i, err)
+		}
+		for _, rc := range []RssContainer{parsed, streamed} {
+			if rc.Feed.ImageUrl() != x.cover || rc.Feed.Items[0].ImageUrl() != x.art {
+				t.Errorf("docs[%d] - expected %q and %q, got %q and %q", i, x.cover, x.art,
+					rc.Feed.ImageUrl(), rc.Feed.Items[0].ImageUrl())
+			}
+		}
+	}
+}
+
+func TestOlderPage(t *testing.T) {
+	const head = `<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom"><channel><title>Paged</title>`
+
+	var docs = []struct {
+		links string
+		older string
+	}{
+		{`<atom:link rel="self" href="http://x/rss"/><atom:link rel="next" href="http://x/rss?page=2"/>`, "http://x/rss?page=2"},
+		{`<atom:link rel="prev-archive" href="/2023.xml"/><atom:link rel="current" href="/rss"/>`, "/2023.xml"},
+		{`<atom:link rel="prev-archive" href="/2023.xml"/><atom:link rel="next" href="?page=2"/>`, "?page=2"},
+		{`<atom:link rel="self" href="http://x/rss"/>`, ""},
+	}
+
+	for i, x := range docs {
+		doc := head + x.links + `<item><title>Ep</title><enclosure url="http://x/ep.mp3"/></item></channel></rss>`
+		parsed, err := ParseRss([]byte(doc))
+		if err != nil {
+			t.Fatalf("docs[%d] - parse error: %v", i, err)
+		}
+		streamed, err := ReadRss(strings.NewReader(doc), time.Time{})
+		if err != nil {
+			t.Fatalf("docs[%d] - read error: %v", i, err)
+		}
+		for _, rc := range []RssContainer{parsed, streamed} {
+			if got := rc.Feed.OlderPage(); got != x.older {
+				t.Errorf("docs[%d] - expected %q, got %q", i, x.older, got)
+			}
+		}
+	}
+
+	// items already present aren't added again
+	first, _ := ParseRss([]byte(head + `<item><title>B</title><enclosure url="http://x/b.mp3"/></item></channel></rss>`))
+	second, _ := ParseRss([]byte(head + `<item><title>B</title><enclosure url="http://x/b.mp3"/></item><item><title>A</title><enclosure url="http://x/a.mp3"/></item></channel></rss>`))
+	first.Feed.Merge(&second.Feed)
+	if len(first.Feed.Items) != 2 || first.Feed.Items[1].Title() != "A" {
+		t.Errorf("expected B then A, got %+v", first.Feed.Items)
+	}
+}
@@ -0,0 +1,174 @@
+package rss
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// A feed is taken to list its items newest first once this many have been
+// seen in that order, and no sooner
+const minOrderedItems = 2
+
+// ErrNotStreamable is returned by ReadRss for feeds that can't be parsed
+// as they're read.  They need reading in full and handing to the more
+// forgiving ParseRss instead.
+var ErrNotStreamable = errors.New("feed can't be parsed as it's read")
+
+// ReadRss parses a feed as it's read, one item at a time, without holding
+// on to the document.  If since isn't zero and the feed lists its items
+// newest first, it stops reading at the first item no newer than since,
+// and marks the container Truncated.  Errors from r itself are returned as
+// they are, and feeds that can't be parsed this way give an error wrapping
+// ErrNotStreamable.
+func ReadRss(r io.Reader, since time.Time) (RssContainer, error) {
+	src := &errReader{r: r}
+	rc, err := streamRss(src, since)
+	if src.err != nil && src.err != io.EOF {
+		return rc, src.err
+	}
+	if err != nil {
+		return rc, fmt.Errorf("%w: %v", ErrNotStreamable, err)
+	}
+
+	rc.datePodcasts(time.Now())
+	rc.firstEnclosures()
+	return rc, nil
+}
+
+// errReader remembers the first error its reader returned, so it can be
+// told apart from a problem with what was read.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
+
+func streamRss(r io.Reader, since time.Time) (RssContainer, error) {
+	var rc RssContainer
+
+	d := xml.NewDecoder(r)
+	d.Entity = xml.HTMLEntity
+	d.CharsetReader = charsetReader
+
+	var prev time.Time
+	ordered := true
+	depth := 0
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return rc, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch {
+			case depth == 0 && t.Name.Local == "rss":
+				rc.XMLName = t.Name
+				for _, a := range t.Attr {
+					if a.Name.Local == "version" {
+						rc.Version = a.Value
+					}
+				}
+				depth++
+			case depth == 1 && t.Name.Local == "channel":
+				rc.Feed.XMLName = t.Name
+				depth++
+			case depth == 2 && t.Name.Local == "item":
+				item := &RssItem{}
+				if err := d.DecodeElement(item, &t); err != nil {
+					return rc, err
+				}
+				rc.Feed.Items = append(rc.Feed.Items, item)
+
+				if since.IsZero() {
+					continue
+				}
+				date, err := parsePodcastDate(item.PubDateString)
+				if err != nil || (!prev.IsZero() && date.After(prev)) {
+					ordered = false
+				}
+				prev = date
+				if ordered && len(rc.Feed.Items) >= minOrderedItems && !date.After(since) {
+					rc.Truncated = true
+					return rc, nil
+				}
+			case depth == 2:
+				if err := rc.Feed.decodeChild(d, t); err != nil {
+					return rc, err
+				}
+			default:
+				if err := d.Skip(); err != nil {
+					return rc, err
+				}
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+
+	if rc.XMLName.Local == "" {
+		return rc, fmt.Errorf("no rss element")
+	}
+	return rc, nil
+}
+
+// decodeChild decodes one of the channel's own elements, other than an
+// item, into the channel, or skips it if it's of no interest.
+func (c *RssChannel) decodeChild(d *xml.Decoder, start xml.StartElement) error {
+	var dest any
+	switch start.Name {
+	case xml.Name{Space: itunesNS, Local: "image"}:
+		dest = &c.ItunesImage
+	case xml.Name{Space: podcastNS, Local: "images"}:
+		dest = &c.PodcastImages
+	case xml.Name{Space: c.XMLName.Space, Local: "image"}:
+		dest = &c.Image
+	case xml.Name{Space: syndicationNS, Local: "updatePeriod"}:
+		dest = &c.UpdatePeriod
+	case xml.Name{Space: syndicationNS, Local: "updateFrequency"}:
+		dest = &c.UpdateFrequency
+	case xml.Name{Space: c.XMLName.Space, Local: "title"}:
+		dest = &c.Title
+	case xml.Name{Space: c.XMLName.Space, Local: "pubDate"}:
+		dest = &c.PubDate
+	case xml.Name{Space: c.XMLName.Space, Local: "lastBuildDate"}:
+		dest = &c.LastBuildDate
+	case xml.Name{Space: c.XMLName.Space, Local: "ttl"}:
+		dest = &c.Ttl
+	case xml.Name{Space: atomNS, Local: "link"}:
+		var l AtomLink
+		if err := d.DecodeElement(&l, &start); err != nil {
+			return err
+		}
+		c.AtomLinks = append(c.AtomLinks, l)
+		return nil
+	default:
+		return d.Skip()
+	}
+	return d.DecodeElement(dest, &start)
+}
+
+// charsetReader converts documents declaring a charset other than UTF-8.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(strings.ToLower(strings.TrimSpace(charset)))
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %s", charset)
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
@@ -0,0 +1,97 @@
+package rss
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadRss(t *testing.T) {
+	feed := func(days ...int) string {
+		doc := `<rss version="2.0"><channel><title>Stream</title><ttl>90</ttl>`
+		for _, d := range days {
+			date := time.Date(2024, 3, d, 6, 0, 0, 0, time.UTC).Format(time.RFC1123Z)
+			doc += `<item><title>Day ` + date[5:7] + `</title><pubDate>` + date + `</pubDate></item>`
+		}
+		return doc + `</channel></rss>`
+	}
+	since := time.Date(2024, 3, 10, 6, 0, 0, 0, time.UTC)
+
+	var feeds = []struct {
+		doc       string
+		since     time.Time
+		items     int
+		truncated bool
+	}{
+		// newest first: stops at the first item already seen
+		{feed(14, 12, 10, 8, 6), since, 3, true},
+		{feed(14, 12, 11), since, 3, false},
+		// the first item alone doesn't show the feed is ordered
+		{feed(9, 8, 7), since, 2, true},
+		// oldest first, or jumbled: read to the end
+		{feed(6, 8, 10, 12, 14), since, 5, false},
+		{feed(8, 14, 12, 6), since, 4, false},
+		{feed(14, 12, 10, 8, 6), time.Time{}, 5, false},
+	}
+
+	for i, x := range feeds {
+		rc, err := ReadRss(strings.NewReader(x.doc), x.since)
+		if err != nil {
+			t.Errorf("feeds[%d] - read error: %v", i, err)
+			continue
+		}
+		if len(rc.Feed.Items) != x.items || rc.Truncated != x.truncated {
+			t.Errorf("feeds[%d] - expected %d items, truncated %v, got %d, %v",
+				i, x.items, x.truncated, len(rc.Feed.Items), rc.Truncated)
+		}
+		if rc.Feed.Title != "Stream" || rc.Feed.UpdateInterval() != 90*time.Minute {
+			t.Errorf("feeds[%d] - channel details lost: %+v", i, rc.Feed)
+		}
+		for _, item := range rc.Feed.Items {
+			if item.PubDate.IsZero() {
+				t.Errorf("feeds[%d] - %q undated", i, item.Title())
+			}
+		}
+	}
+}
+
+func TestReadRssFallback(t *testing.T) {
+	var docs = []struct {
+		doc   string
+		title string
+	}{
+		{`<?xml version="1.0" encoding="ISO-8859-1"?><rss><channel><item><title>Caf` + "\xe9" + `</title></item></channel></rss>`, "Café"},
+		{`<?xml version="1.0"?><rss><channel><item><title>Caf` + "\xe9" + `</title></item></channel></rss>`, "Café"},
+		{`<rss><channel><item><title>Tom &amp; Jerry</title></item><item><title>Broken</titl></item></channel></rss>`, "Tom & Jerry"},
+	}
+
+	for i, x := range docs {
+		rc, err := ReadRss(strings.NewReader(x.doc), time.Time{})
+		if errors.Is(err, ErrNotStreamable) {
+			rc, err = ParseRss([]byte(x.doc))
+		}
+		if err != nil {
+			t.Errorf("docs[%d] - read error: %v", i, err)
+			continue
+		}
+		if len(rc.Feed.Items) == 0 || rc.Feed.Items[0].Title() != x.title {
+			t.Errorf("docs[%d] - expected title %q, got %+v", i, x.title, rc.Feed.Items)
+		}
+	}
+
+	broken := `<rss><channel><item><title>Broken</titl></item></channel></rss>`
+	if _, err := ReadRss(strings.NewReader(broken), time.Time{}); !errors.Is(err, ErrNotStreamable) {
+		t.Errorf("expected a malformed feed not to stream, got %v", err)
+	}
+
+	failing := io.MultiReader(strings.NewReader(`<rss><channel><item>`), iotest{errors.New("connection reset")})
+	if _, err := ReadRss(failing, time.Time{}); err == nil || err.Error() != "connection reset" {
+		t.Errorf("expected the read error, got %v", err)
+	}
+}
+
+type iotest struct{ err error }
+
+func (r iotest) Read([]byte) (int, error) { return 0, r.err }
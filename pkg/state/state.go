@@ -1,8 +1,11 @@
 package state
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
+	"slices"
 	"time"
 
 	"github.com/goccy/go-yaml"
@@ -11,31 +14,237 @@ import (
 type State struct {
 	filename string
 	s        map[string]FeedState
+	// content hash -> path of the downloaded file, relative to the
+	// output directory
+	hashes map[string]string
+	// path of saved artwork, relative to the output directory -> where
+	// it came from
+	artwork map[string]Artwork
+	queue   []*QueueItem
+	// downloaded episodes, for playlists
+	episodes []*Episode
 }
 
 type FeedState struct {
 	last time.Time
+	// when the feed was last polled, when it should next be, and why then
+	lastPoll   time.Time
+	nextPoll   time.Time
+	pollReason string
+	// pubDates seen in the feed, oldest first, for learning when it
+	// publishes
+	published []time.Time
+	// ids of items seen without a usable pubDate, which the watermark
+	// can't account for, oldest first
+	undated []string
+	// the channel's artwork as of the last poll
+	image string
+	// backfill fetches episodes published between these, narrowing them
+	// as it goes; before starts as the oldest episode of the first poll
+	backfillAfter  time.Time
+	backfillBefore time.Time
 }
 
-func stateFromYaml(contents []byte) (map[string]FeedState, error) {
-	tmp := map[string]int64{}
-	cooked := map[string]FeedState{}
+// Artwork is an image saved alongside downloads, and the feed and url it
+// came from.
+type Artwork struct {
+	Feed string `yaml:"feed"`
+	Url  string `yaml:"url"`
+}
+
+// Episode is a downloaded episode, remembered so that playlists can be
+// made of it.  Paths are relative to the output directory.
+type Episode struct {
+	Path    string    `yaml:"path"`
+	Feed    string    `yaml:"feed"`
+	Title   string    `yaml:"title"`
+	PubDate time.Time `yaml:"pubdate"`
+	// Seconds, or zero if the feed didn't say
+	Duration   int       `yaml:"duration,omitempty"`
+	Downloaded time.Time `yaml:"downloaded"`
+	// Where it was copied to in Incoming, if it was
+	Incoming string `yaml:"incoming,omitempty"`
+}
+
+// How many pubDates, and ids of undated items, are remembered per feed
+const (
+	maxPublished = 100
+	maxUndated   = 1000
+)
+
+// QueueItem is a matched episode waiting to be downloaded, along with where
+// it should go and how previous attempts went.
+type QueueItem struct {
+	ID       string    `yaml:"id"`
+	Feed     string    `yaml:"feed"`
+	Url      string    `yaml:"url"`
+	Title    string    `yaml:"title"`
+	PubDate  time.Time `yaml:"pubdate"`
+	Type     string    `yaml:"type"`
+	Dest     string    `yaml:"dest"`
+	Basename string    `yaml:"basename,omitempty"`
+	Incoming bool      `yaml:"incoming,omitempty"`
+	Priority int       `yaml:"priority,omitempty"`
+	Added    time.Time `yaml:"added"`
+	// Seconds, or zero if the feed didn't say
+	Duration int `yaml:"duration,omitempty"`
+	// Other versions of the episode, tried in order if Url can't be
+	// downloaded
+	Alternates []Source `yaml:"alternates,omitempty"`
+	// The episode's own artwork
+	Image string `yaml:"image,omitempty"`
+	// Formats of sidecar files to write next to the episode once it's
+	// downloaded, and what they're made from besides the fields above;
+	// only kept when there are sidecars to write
+	Sidecars    []string `yaml:"sidecars,flow,omitempty"`
+	Show        string   `yaml:"show,omitempty"`
+	Description string   `yaml:"description,omitempty"`
+	Season      string   `yaml:"season,omitempty"`
+	Episode     string   `yaml:"episode,omitempty"`
+
+	Attempts    int       `yaml:"attempts,omitempty"`
+	LastError   string    `yaml:"last_error,omitempty"`
+	NextAttempt time.Time `yaml:"next_attempt,omitempty"`
+	// Set once an item runs out of attempts; it stays queued until
+	// retried or dropped
+	Failed bool `yaml:"failed,omitempty"`
+}
+
+// Source is somewhere a queued episode can be downloaded from.
+type Source struct {
+	Url  string `yaml:"url"`
+	Type string `yaml:"type,omitempty"`
+}
+
+// Sources returns where the episode can be downloaded from, best first.
+func (q *QueueItem) Sources() []Source {
+	return append([]Source{{Url: q.Url, Type: q.Type}}, q.Alternates...)
+}
+
+// QueueID is a short stable identifier for an episode of a feed.
+func QueueID(feed string, url string) string {
+	sum := sha256.Sum256([]byte(feed + "\x00" + url))
+	return hex.EncodeToString(sum[:4])
+}
+
+type stateYaml struct {
+	Feeds    map[string]feedStateYaml `yaml:"feeds"`
+	Hashes   map[string]string        `yaml:"hashes,omitempty"`
+	Artwork  map[string]Artwork       `yaml:"artwork,omitempty"`
+	Queue    []*QueueItem             `yaml:"queue,omitempty"`
+	Episodes []*Episode               `yaml:"episodes,omitempty"`
+}
+
+type feedStateYaml struct {
+	Last       int64    `yaml:"last"`
+	LastPoll   int64    `yaml:"last_poll,omitempty"`
+	NextPoll   int64    `yaml:"next_poll,omitempty"`
+	PollReason string   `yaml:"poll_reason,omitempty"`
+	Published  []int64  `yaml:"published,flow,omitempty"`
+	Undated    []string `yaml:"undated,omitempty"`
+	Image      string   `yaml:"image,omitempty"`
+	// Backfill progress
+	BackfillAfter  int64 `yaml:"backfill_after,omitempty"`
+	BackfillBefore int64 `yaml:"backfill_before,omitempty"`
+}
+
+func epoch(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func fromEpoch(e int64) time.Time {
+	if e == 0 {
+		return time.Time{}
+	}
+	return time.Unix(e, 0)
+}
+
+func newState() *State {
+	return &State{
+		s:       map[string]FeedState{},
+		hashes:  map[string]string{},
+		artwork: map[string]Artwork{},
+	}
+}
 
+func stateFromYaml(contents []byte) (*State, error) {
+	cooked := newState()
+
+	// Older state files are a flat map of feed name to epoch
+	legacy := map[string]int64{}
+	if err := yaml.Unmarshal(contents, &legacy); err == nil {
+		for name, epoch := range legacy {
+			cooked.s[name] = FeedState{last: time.Unix(epoch, 0)}
+		}
+		return cooked, nil
+	}
+
+	var tmp stateYaml
 	if err := yaml.Unmarshal(contents, &tmp); err != nil {
 		return cooked, err
 	}
 
-	for url, epoch := range tmp {
-		cooked[url] = FeedState{last: time.Unix(epoch, 0)}
+	for name, fs := range tmp.Feeds {
+		feed := FeedState{
+			last:       time.Unix(fs.Last, 0),
+			lastPoll:   fromEpoch(fs.LastPoll),
+			nextPoll:   fromEpoch(fs.NextPoll),
+			pollReason: fs.PollReason,
+			undated:    fs.Undated,
+			image:      fs.Image,
+
+			backfillAfter:  fromEpoch(fs.BackfillAfter),
+			backfillBefore: fromEpoch(fs.BackfillBefore),
+		}
+		for _, p := range fs.Published {
+			feed.published = append(feed.published, time.Unix(p, 0))
+		}
+		cooked.s[name] = feed
+	}
+	for sum, path := range tmp.Hashes {
+		cooked.hashes[sum] = path
 	}
+	for path, a := range tmp.Artwork {
+		cooked.artwork[path] = a
+	}
+	for _, q := range tmp.Queue {
+		if q.ID == "" {
+			q.ID = QueueID(q.Feed, q.Url)
+		}
+		cooked.queue = append(cooked.queue, q)
+	}
+	cooked.episodes = tmp.Episodes
 	return cooked, nil
 }
 
-func yamlFromState(s map[string]FeedState) ([]byte, error) {
-	tmp := map[string]int64{}
+func yamlFromState(s *State) ([]byte, error) {
+	tmp := stateYaml{
+		Feeds:    map[string]feedStateYaml{},
+		Hashes:   s.hashes,
+		Artwork:  s.artwork,
+		Queue:    s.queue,
+		Episodes: s.episodes,
+	}
+
+	for name, fs := range s.s {
+		feed := feedStateYaml{
+			Last:       fs.last.Unix(),
+			LastPoll:   epoch(fs.lastPoll),
+			NextPoll:   epoch(fs.nextPoll),
+			PollReason: fs.pollReason,
+			Undated:    fs.undated,
+			Image:      fs.image,
 
-	for url, fs := range s {
-		tmp[url] = fs.last.Unix()
+			BackfillAfter:  epoch(fs.backfillAfter),
+			BackfillBefore: epoch(fs.backfillBefore),
+		}
+		for _, p := range fs.published {
+			feed.Published = append(feed.Published, p.Unix())
+		}
+		tmp.Feeds[name] = feed
 	}
 
 	b, err := yaml.Marshal(tmp)
@@ -55,11 +264,12 @@ func LoadState(filename string) (*State, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Failed to parse state file: %v", err)
 	}
-	return &State{filename: filename, s: s}, nil
+	s.filename = filename
+	return s, nil
 }
 
 func (s *State) Flush() error {
-	y, err := yamlFromState(s.s)
+	y, err := yamlFromState(s)
 	if err != nil {
 		return fmt.Errorf("failed to marshal state: %v", err)
 	}
@@ -84,5 +294,206 @@ func (s *State) Last(url string) time.Time {
 }
 
 func (s *State) Update(url string, last time.Time) {
-	s.s[url] = FeedState{last: last}
+	fs := s.s[url]
+	fs.last = last
+	s.s[url] = fs
+}
+
+// NextPoll is when the feed is next due to be polled, or the zero time if
+// it never has been.
+func (s *State) NextPoll(name string) time.Time {
+	return s.s[name].nextPoll
+}
+
+func (s *State) LastPoll(name string) time.Time {
+	return s.s[name].lastPoll
+}
+
+// PollReason says why the feed's next poll was scheduled when it was.
+func (s *State) PollReason(name string) string {
+	return s.s[name].pollReason
+}
+
+// Schedule records that the feed was polled and when it should next be.
+func (s *State) Schedule(name string, polled time.Time, next time.Time, reason string) {
+	fs := s.s[name]
+	fs.lastPoll = polled
+	fs.nextPoll = next
+	fs.pollReason = reason
+	s.s[name] = fs
+}
+
+// Published returns the pubDates seen in the feed, oldest first.
+func (s *State) Published(name string) []time.Time {
+	return s.s[name].published
+}
+
+// RecordPublished adds pubDates seen in the feed to its history, keeping
+// only the most recent.
+func (s *State) RecordPublished(name string, dates []time.Time) {
+	fs := s.s[name]
+	for _, d := range dates {
+		if d.IsZero() {
+			continue
+		}
+		d = d.Truncate(time.Second)
+		if !slices.ContainsFunc(fs.published, d.Equal) {
+			fs.published = append(fs.published, d)
+		}
+	}
+	slices.SortFunc(fs.published, time.Time.Compare)
+	if len(fs.published) > maxPublished {
+		fs.published = slices.Clone(fs.published[len(fs.published)-maxPublished:])
+	}
+	s.s[name] = fs
+}
+
+// SeenUndated says whether an item the feed gave no usable pubDate for
+// has been seen before.
+func (s *State) SeenUndated(name string, id string) bool {
+	return slices.Contains(s.s[name].undated, id)
+}
+
+// RecordUndated remembers an undated item as seen, keeping only the most
+// recent.
+func (s *State) RecordUndated(name string, id string) {
+	fs := s.s[name]
+	if id == "" || slices.Contains(fs.undated, id) {
+		return
+	}
+	fs.undated = append(fs.undated, id)
+	if len(fs.undated) > maxUndated {
+		fs.undated = slices.Clone(fs.undated[len(fs.undated)-maxUndated:])
+	}
+	s.s[name] = fs
+}
+
+// Backfill returns the window of pubDates backfilling the feed has yet to
+// cover.  A zero before means backfill hasn't been set up for the feed.
+func (s *State) Backfill(name string) (after time.Time, before time.Time) {
+	fs := s.s[name]
+	return fs.backfillAfter, fs.backfillBefore
+}
+
+func (s *State) SetBackfill(name string, after time.Time, before time.Time) {
+	fs := s.s[name]
+	fs.backfillAfter = after
+	fs.backfillBefore = before
+	s.s[name] = fs
+}
+
+// HashPath returns the library-relative path of a previously downloaded
+// file with the given content hash.
+func (s *State) HashPath(sum string) (string, bool) {
+	path, ok := s.hashes[sum]
+	return path, ok
+}
+
+func (s *State) RecordHash(sum string, path string) {
+	s.hashes[sum] = path
+}
+
+func (s *State) ForgetHash(sum string) {
+	delete(s.hashes, sum)
+}
+
+// HashedPaths returns the library-relative paths of the files whose
+// content hashes are recorded, sorted.
+func (s *State) HashedPaths() []string {
+	var paths []string
+	for _, path := range s.hashes {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+// Image is the url of the feed's channel artwork as of its last poll.
+func (s *State) Image(name string) string {
+	return s.s[name].image
+}
+
+func (s *State) SetImage(name string, url string) {
+	fs := s.s[name]
+	fs.image = url
+	s.s[name] = fs
+}
+
+// Artwork returns where the artwork saved at a library-relative path came
+// from.
+func (s *State) Artwork(path string) (Artwork, bool) {
+	a, ok := s.artwork[path]
+	return a, ok
+}
+
+func (s *State) RecordArtwork(path string, a Artwork) {
+	s.artwork[path] = a
+}
+
+func (s *State) ForgetArtwork(path string) {
+	delete(s.artwork, path)
+}
+
+// FeedArtwork returns the library-relative paths of the artwork saved from
+// a feed, sorted.
+func (s *State) FeedArtwork(name string) []string {
+	var paths []string
+	for path, a := range s.artwork {
+		if a.Feed == name {
+			paths = append(paths, path)
+		}
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+// Episodes returns the downloaded episodes, in the order they were
+// downloaded.
+func (s *State) Episodes() []*Episode {
+	return s.episodes
+}
+
+// RecordEpisode remembers a downloaded episode, replacing any previously
+// saved to the same path.
+func (s *State) RecordEpisode(ep *Episode) {
+	s.ForgetEpisode(ep.Path)
+	s.episodes = append(s.episodes, ep)
+}
+
+func (s *State) ForgetEpisode(path string) {
+	s.episodes = slices.DeleteFunc(s.episodes, func(ep *Episode) bool {
+		return ep.Path == path
+	})
+}
+
+func (s *State) Queue() []*QueueItem {
+	return s.queue
+}
+
+// Enqueue adds an item to the download queue, unless the same episode is
+// already queued.
+func (s *State) Enqueue(item *QueueItem) bool {
+	if item.ID == "" {
+		item.ID = QueueID(item.Feed, item.Url)
+	}
+	if s.Queued(item.ID) != nil {
+		return false
+	}
+	s.queue = append(s.queue, item)
+	return true
+}
+
+func (s *State) Queued(id string) *QueueItem {
+	for _, q := range s.queue {
+		if q.ID == id {
+			return q
+		}
+	}
+	return nil
+}
+
+func (s *State) Dequeue(item *QueueItem) {
+	s.queue = slices.DeleteFunc(s.queue, func(q *QueueItem) bool {
+		return q == item
+	})
 }
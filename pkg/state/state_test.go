@@ -12,12 +12,12 @@ func TestEmptyYaml(t *testing.T) {
 		t.Fatalf("parse error: %v", err)
 	}
 
-	if s == nil {
+	if s == nil || s.s == nil {
 		t.Fatalf("nil map")
 	}
 
-	if len(s) != 0 {
-		t.Fatalf("non-empty map: %+v", s)
+	if len(s.s) != 0 {
+		t.Fatalf("non-empty map: %+v", s.s)
 	}
 }
 
@@ -30,28 +30,33 @@ https://www.patreon.com/rss/theflagrantones?auth=PYkre__74n16LEDkBSkLAk4dkdRmZAN
 		t.Fatalf("parse error: %v", err)
 	}
 
-	if s == nil {
+	if s == nil || s.s == nil {
 		t.Fatalf("nil map")
 	}
 
-	if len(s) != 2 {
-		t.Fatalf("expected 2 entries, got %d: %+v", len(s), s)
+	if len(s.s) != 2 {
+		t.Fatalf("expected 2 entries, got %d: %+v", len(s.s), s.s)
 	}
 
-	if s["https://www.patreon.com/rss/theflagrantones?auth=PYkre__74n16LEDkBSkLAk4dkdRmZANq"].last != time.Unix(3123, 0) {
+	if s.s["https://www.patreon.com/rss/theflagrantones?auth=PYkre__74n16LEDkBSkLAk4dkdRmZANq"].last != time.Unix(3123, 0) {
 		t.Fatalf("bad last time for HH: expected 3123, got %v: %+v",
-			s["https://www.patreon.com/rss/theflagrantones?auth=PYkre__74n16LEDkBSkLAk4dkdRmZANq"].last, s)
+			s.s["https://www.patreon.com/rss/theflagrantones?auth=PYkre__74n16LEDkBSkLAk4dkdRmZANq"].last, s.s)
 	}
 }
 
 func TestYamlFromState(t *testing.T) {
-	in := map[string]FeedState{
-		"http://wtfpod.libsyn.com/rss": FeedState{last: time.Unix(111111, 0)},
-		"https://www.patreon.com/rss/theflagrantones?auth=PYkre__74n16LEDkBSkLAk4dkdRmZANq": FeedState{last: time.Unix(3123, 0)},
-	}
+	in := newState()
+	in.s["http://wtfpod.libsyn.com/rss"] = FeedState{last: time.Unix(111111, 0)}
+	in.s["https://www.patreon.com/rss/theflagrantones?auth=PYkre__74n16LEDkBSkLAk4dkdRmZANq"] = FeedState{last: time.Unix(3123, 0)}
+	in.RecordHash("0a1b2c", "Comedy/WTF/1512 Da'Vine Joy Randolph.mp3")
 
-	out := []byte(`http://wtfpod.libsyn.com/rss: 111111
-https://www.patreon.com/rss/theflagrantones?auth=PYkre__74n16LEDkBSkLAk4dkdRmZANq: 3123
+	out := []byte(`feeds:
+  http://wtfpod.libsyn.com/rss:
+    last: 111111
+  https://www.patreon.com/rss/theflagrantones?auth=PYkre__74n16LEDkBSkLAk4dkdRmZANq:
+    last: 3123
+hashes:
+  0a1b2c: Comedy/WTF/1512 Da'Vine Joy Randolph.mp3
 `)
 
 	b, err := yamlFromState(in)
@@ -63,4 +68,126 @@ https://www.patreon.com/rss/theflagrantones?auth=PYkre__74n16LEDkBSkLAk4dkdRmZAN
 		t.Fatalf("bad marshal results: expected %+v, got %+v", string(out), string(b))
 	}
 
+	back, err := stateFromYaml(b)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	if back.Last("http://wtfpod.libsyn.com/rss") != time.Unix(111111, 0) {
+		t.Fatalf("bad last time after round trip: %+v", back.s)
+	}
+
+	if path, ok := back.HashPath("0a1b2c"); !ok || path != "Comedy/WTF/1512 Da'Vine Joy Randolph.mp3" {
+		t.Fatalf("bad hash after round trip: %+v", back.hashes)
+	}
+}
+
+func TestQueueRoundTrip(t *testing.T) {
+	in := newState()
+	first := &QueueItem{
+		Feed:     "Comedy/WTF",
+		Url:      "http://wtfpod.libsyn.com/1512.mp3",
+		Title:    "Episode 1512 - Da'Vine Joy Randolph",
+		PubDate:  time.Date(2024, 3, 4, 8, 0, 0, 0, time.UTC),
+		Type:     "audio/mpeg",
+		Dest:     "Comedy/WTF",
+		Basename: "1512 Da'Vine Joy Randolph",
+		Incoming: true,
+	}
+	in.Enqueue(first)
+	in.Enqueue(&QueueItem{Feed: "Comedy/WTF", Url: "http://wtfpod.libsyn.com/1513.mp3"})
+	in.Dequeue(in.Queue()[1])
+
+	b, err := yamlFromState(in)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+
+	out, err := stateFromYaml(b)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	if len(out.Queue()) != 1 {
+		t.Fatalf("expected 1 queued item, got %d:\n%s", len(out.Queue()), b)
+	}
+
+	got := out.Queue()[0]
+	if got.Url != first.Url || got.Basename != first.Basename || !got.Incoming || !got.PubDate.Equal(first.PubDate) {
+		t.Fatalf("bad queued item after round trip: expected %+v, got %+v", first, got)
+	}
+}
+
+func TestScheduleRoundTrip(t *testing.T) {
+	in := newState()
+	in.Update("Comedy/WTF", time.Unix(111111, 0))
+	in.Schedule("Comedy/WTF", time.Unix(111222, 0), time.Unix(222222, 0), "default interval")
+	in.Schedule("News/Daily", time.Unix(111333, 0), time.Unix(333333, 0), "")
+	in.RecordPublished("Comedy/WTF", []time.Time{time.Unix(3000, 0), time.Unix(1000, 0), {}, time.Unix(2000, 0)})
+	in.RecordPublished("Comedy/WTF", []time.Time{time.Unix(2000, 0), time.Unix(4000, 0)})
+	in.SetBackfill("Comedy/WTF", time.Unix(500, 0), time.Unix(2000, 0))
+	in.RecordUndated("Comedy/WTF", "tag:wtf,2023:1")
+	in.RecordUndated("Comedy/WTF", "tag:wtf,2023:1")
+
+	y, err := yamlFromState(in)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+
+	out, err := stateFromYaml(y)
+	if err != nil {
+		t.Fatalf("parse error: %v\n%s", err, y)
+	}
+
+	if !out.Last("Comedy/WTF").Equal(time.Unix(111111, 0)) || !out.NextPoll("Comedy/WTF").Equal(time.Unix(222222, 0)) {
+		t.Errorf("expected last and next poll to survive, got %+v", out.s["Comedy/WTF"])
+	}
+	if !out.LastPoll("Comedy/WTF").Equal(time.Unix(111222, 0)) || out.PollReason("Comedy/WTF") != "default interval" {
+		t.Errorf("expected last poll and reason to survive, got %+v", out.s["Comedy/WTF"])
+	}
+	if after, before := out.Backfill("Comedy/WTF"); !after.Equal(time.Unix(500, 0)) || !before.Equal(time.Unix(2000, 0)) {
+		t.Errorf("expected backfill progress to survive, got %v %v", after, before)
+	}
+	published := out.Published("Comedy/WTF")
+	if len(published) != 4 || !published[0].Equal(time.Unix(1000, 0)) || !published[3].Equal(time.Unix(4000, 0)) {
+		t.Errorf("expected four sorted pubDates, got %v", published)
+	}
+	if !out.SeenUndated("Comedy/WTF", "tag:wtf,2023:1") || out.SeenUndated("News/Daily", "tag:wtf,2023:1") ||
+		len(out.s["Comedy/WTF"].undated) != 1 {
+		t.Errorf("expected one undated item seen, got %v", out.s["Comedy/WTF"].undated)
+	}
+	if !out.NextPoll("News/Daily").Equal(time.Unix(333333, 0)) {
+		t.Errorf("expected next poll for News/Daily, got %v", out.NextPoll("News/Daily"))
+	}
+	if !out.NextPoll("Other").IsZero() {
+		t.Errorf("expected unknown feed to be due, got %v", out.NextPoll("Other"))
+	}
+}
+
+func TestArtworkRoundTrip(t *testing.T) {
+	in := newState()
+	in.SetImage("Comedy/WTF", "http://x/cover.jpg")
+	in.RecordArtwork("Comedy/WTF/cover.jpg", Artwork{Feed: "Comedy/WTF", Url: "http://x/cover.jpg"})
+	in.RecordArtwork("Comedy/WTF/Specials/cover.jpg", Artwork{Feed: "Comedy/WTF", Url: "http://x/old.jpg"})
+	in.RecordArtwork("News/cover.jpg", Artwork{Feed: "News", Url: "http://y/cover.jpg"})
+
+	y, err := yamlFromState(in)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	out, err := stateFromYaml(y)
+	if err != nil {
+		t.Fatalf("parse error: %v\n%s", err, y)
+	}
+
+	if out.Image("Comedy/WTF") != "http://x/cover.jpg" {
+		t.Errorf("expected channel image to survive, got %q", out.Image("Comedy/WTF"))
+	}
+	paths := out.FeedArtwork("Comedy/WTF")
+	if len(paths) != 2 || paths[0] != "Comedy/WTF/Specials/cover.jpg" || paths[1] != "Comedy/WTF/cover.jpg" {
+		t.Errorf("expected the feed's two covers, got %v", paths)
+	}
+	if a, ok := out.Artwork("News/cover.jpg"); !ok || a.Url != "http://y/cover.jpg" {
+		t.Errorf("expected News cover to survive, got %+v", a)
+	}
 }
@@ -0,0 +1,210 @@
+package subscription
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"strings"
+
+	"jaypod/pkg/rss"
+)
+
+// Condition is the matching half of a filter.  Every test set directly on a
+// condition must pass, along with every condition under All, at least one
+// under Any, and not the one under Not.  Named groups captured by the
+// regexps of matching conditions are available to filename templates.
+type Condition struct {
+	TitleExpression       string `yaml:"title_regex"`
+	TitleRegexp           *regexp.Regexp
+	DescriptionExpression string `yaml:"description_regex"`
+	DescriptionRegexp     *regexp.Regexp
+	FilenameExpression    string `yaml:"filename_regex"`
+	FilenameRegexp        *regexp.Regexp
+	MinDuration           string `yaml:"min_duration"`
+	MaxDuration           string `yaml:"max_duration"`
+	After                 string
+	Before                string
+	Season                string
+	Episode               string
+	EpisodeType           string `yaml:"episode_type"`
+	MimeType              string `yaml:"mime_type"`
+	MinSize               string `yaml:"min_size"`
+	MaxSize               string `yaml:"max_size"`
+	All                   []*Condition
+	Any                   []*Condition
+	Not                   *Condition
+	predicates            *predicates
+}
+
+// How a filter's title, description and filename expressions are applied.
+// These are set on the filter and hold for every condition nested in it.
+type matchOptions struct {
+	mode       string
+	ignoreCase bool
+	glob       bool
+}
+
+const (
+	MatchFull     = "full"
+	MatchContains = "contains"
+	MatchPrefix   = "prefix"
+
+	SyntaxRegex = "regex"
+	SyntaxGlob  = "glob"
+)
+
+// compile prepares the condition's regexps and predicates.  path is the
+// condition's location in the YAML document, used to report errors.
+func (c *Condition) compile(path string, opts matchOptions) error {
+	var err error
+
+	if c.TitleRegexp, err = compileRegexp(c.TitleExpression, path+".title_regex", opts); err != nil {
+		return err
+	}
+	if c.DescriptionRegexp, err = compileRegexp(c.DescriptionExpression, path+".description_regex", opts); err != nil {
+		return err
+	}
+	if c.FilenameRegexp, err = compileRegexp(c.FilenameExpression, path+".filename_regex", opts); err != nil {
+		return err
+	}
+
+	if c.predicates, err = c.compilePredicates(path); err != nil {
+		return err
+	}
+
+	for i, sub := range c.All {
+		if err := sub.compile(fmt.Sprintf("%s.all[%d]", path, i), opts); err != nil {
+			return err
+		}
+	}
+	for i, sub := range c.Any {
+		if err := sub.compile(fmt.Sprintf("%s.any[%d]", path, i), opts); err != nil {
+			return err
+		}
+	}
+	if c.Not != nil {
+		if err := c.Not.compile(path+".not", opts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func compileRegexp(expr string, path string, opts matchOptions) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+
+	pattern := expr
+	if opts.glob {
+		pattern = globToRegexp(expr)
+	}
+
+	switch opts.mode {
+	case MatchContains:
+	case MatchPrefix:
+		pattern = "^" + pattern
+	default:
+		pattern = "^" + pattern + "$"
+	}
+
+	if opts.ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, &fieldError{path: path, err: err}
+	}
+	return re, nil
+}
+
+// match reports whether the condition holds, adding any named groups
+// captured along the way to subst if it does.
+func (c *Condition) match(podcast *rss.RssItem, subst map[string]string) bool {
+	if c.predicates != nil && !c.predicates.match(podcast) {
+		return false
+	}
+
+	captures := map[string]string{}
+
+	if !capture(c.TitleRegexp, podcast.Title(), captures) ||
+		!capture(c.DescriptionRegexp, podcast.Description(), captures) ||
+		!capture(c.FilenameRegexp, podcast.FileBaseName(), captures) {
+		return false
+	}
+
+	for _, sub := range c.All {
+		if !sub.match(podcast, captures) {
+			return false
+		}
+	}
+
+	if len(c.Any) > 0 {
+		matched := false
+		for _, sub := range c.Any {
+			if sub.match(podcast, captures) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if c.Not != nil && c.Not.match(podcast, map[string]string{}) {
+		return false
+	}
+
+	maps.Copy(subst, captures)
+	return true
+}
+
+func capture(re *regexp.Regexp, s string, captures map[string]string) bool {
+	if re == nil {
+		return true
+	}
+
+	matches := re.FindStringSubmatch(s)
+	if matches == nil {
+		return false
+	}
+
+	for i, m := range matches {
+		if i > 0 {
+			captures[re.SubexpNames()[i]] = m
+		}
+	}
+	return true
+}
+
+// globToRegexp translates shell-style wildcards: * matches any run of
+// characters, ? any single character and [...] a character class.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch ch := glob[i]; ch {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,379 @@
+package subscription
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"github.com/goccy/go-yaml/parser"
+)
+
+// A subscription document may hold, besides its feeds:
+//
+//	defaults:       settings for every feed that doesn't set them itself,
+//	  filter:       with a nested block of settings for every filter
+//	filter_sets:    named lists of filters, spliced into a feed's filters
+//	                wherever it has a "- use: name" entry
+//	include:        other files, relative to this one, whose defaults and
+//	                filter sets apply here
+//	playlists:      smart playlists gathering episodes from across the
+//	                library
+//
+// A _defaults.yaml file in a subscription directory works like an include
+// for every file in that directory and those below it.
+var topLevelKeys = []string{"feeds", "defaults", "filter_sets", "include", "playlists"}
+
+// layer holds the defaults and filter sets in effect for a document, still
+// as YAML nodes so that merged values keep their original line numbers.
+type layer struct {
+	feed       *ast.MappingNode
+	filter     *ast.MappingNode
+	filterSets map[string]*ast.SequenceNode
+}
+
+// extend returns a layer with over's settings taking precedence over l's.
+func (l *layer) extend(over *layer) *layer {
+	if l == nil {
+		return over
+	}
+
+	sets := maps.Clone(l.filterSets)
+	if sets == nil {
+		sets = map[string]*ast.SequenceNode{}
+	}
+	maps.Copy(sets, over.filterSets)
+
+	return &layer{
+		feed:       inherit(over.feed, l.feed, "auth", "headers"),
+		filter:     inherit(over.filter, l.filter),
+		filterSets: sets,
+	}
+}
+
+// document is a parsed subscription file along with the layer its feeds
+// build on.
+type document struct {
+	filename string
+	root     *ast.MappingNode
+	layer    *layer
+	dec      *yaml.Decoder
+}
+
+// readDocument parses a subscription file and works out its layer: base,
+// then anything it includes, then its own defaults and filter sets.
+// including lists the files whose includes led here.
+func readDocument(doc []byte, filename string, base *layer, including []string) (*document, error) {
+	file, err := parser.ParseBytes(doc, 0)
+	if err != nil {
+		return nil, locate(nil, filename, err)
+	}
+
+	d := &document{
+		filename: filename,
+		root:     ast.Mapping(nil, false),
+		layer:    base,
+		dec:      yaml.NewDecoder(bytes.NewReader(nil), yaml.Strict()),
+	}
+	if len(file.Docs) > 0 && file.Docs[0].Body != nil {
+		root, ok := asMapping(file.Docs[0].Body)
+		if !ok {
+			return nil, nodeError(filename, file.Docs[0].Body, fmt.Errorf("expected a mapping of feeds"))
+		}
+		d.root = root
+
+		// registers any anchors so that aliases resolve when individual
+		// nodes are decoded later
+		var ignored ast.Node
+		d.dec.DecodeFromNode(root, &ignored)
+	}
+
+	for _, v := range d.root.Values {
+		if !slices.Contains(topLevelKeys, keyName(v)) {
+			return nil, nodeError(filename, v.Key, fmt.Errorf("unknown field %q", keyName(v)))
+		}
+	}
+
+	if node := lookup(d.root, "include"); node != nil {
+		var includes []string
+		if err := d.dec.DecodeFromNode(node, &includes); err != nil {
+			return nil, locate(nil, filename, err)
+		}
+		for _, name := range includes {
+			path := name
+			if !filepath.IsAbs(path) && filename != "" {
+				path = filepath.Join(filepath.Dir(filename), name)
+			}
+			if slices.Contains(including, path) || path == filename {
+				return nil, nodeError(filename, node, fmt.Errorf("include cycle through %s", path))
+			}
+
+			contents, err := os.ReadFile(path)
+			if err != nil {
+				return nil, nodeError(filename, node, fmt.Errorf("unreadable include: %v", err))
+			}
+			included, err := readDocument(contents, path, d.layer, append(including, filename))
+			if err != nil {
+				return nil, err
+			}
+			if err := included.settingsOnly(); err != nil {
+				return nil, err
+			}
+			d.layer = included.layer
+		}
+	}
+
+	own, err := d.settings()
+	if err != nil {
+		return nil, err
+	}
+	d.layer = d.layer.extend(own)
+	return d, nil
+}
+
+// settingsOnly is for documents that are included or apply to a whole
+// directory, which can't define feeds or playlists of their own.
+func (d *document) settingsOnly() error {
+	for _, key := range []string{"feeds", "playlists"} {
+		if v := lookupValue(d.root, key); v != nil {
+			return nodeError(d.filename, v.Key, fmt.Errorf("%s can't be defined here", key))
+		}
+	}
+	return nil
+}
+
+// settings checks the document's own defaults and filter sets.  Problems
+// are caught here, where they can be reported against the right file,
+// rather than in each feed that picks them up.
+func (d *document) settings() (*layer, error) {
+	l := &layer{filterSets: map[string]*ast.SequenceNode{}}
+
+	if node := lookup(d.root, "defaults"); node != nil && node.Type() != ast.NullType {
+		defaults, ok := asMapping(node)
+		if !ok {
+			return nil, nodeError(d.filename, node, fmt.Errorf("defaults must be a mapping"))
+		}
+
+		l.feed = ast.Mapping(defaults.GetToken(), false)
+		for _, v := range defaults.Values {
+			switch keyName(v) {
+			case "name", "url":
+				return nil, nodeError(d.filename, v.Key, fmt.Errorf("%s can't have a default", keyName(v)))
+			case "filter":
+				filter, ok := asMapping(v.Value)
+				if !ok {
+					return nil, nodeError(d.filename, v.Value, fmt.Errorf("default filter must be a mapping"))
+				}
+				l.filter = filter
+			default:
+				l.feed.Values = append(l.feed.Values, v)
+			}
+		}
+
+		var feed Feed
+		if err := d.dec.DecodeFromNode(l.feed, &feed); err != nil {
+			return nil, locate(nil, d.filename, err)
+		}
+		for i, filter := range feed.Filters {
+			if err := filter.compile(fmt.Sprintf("$.defaults.filters[%d]", i), ""); err != nil {
+				return nil, locate(d.root, d.filename, err)
+			}
+		}
+
+		if l.filter != nil {
+			var filter Filter
+			if err := d.dec.DecodeFromNode(l.filter, &filter); err != nil {
+				return nil, locate(nil, d.filename, err)
+			}
+			if err := filter.compile("$.defaults.filter", ""); err != nil {
+				return nil, locate(d.root, d.filename, err)
+			}
+		}
+	}
+
+	if node := lookup(d.root, "filter_sets"); node != nil && node.Type() != ast.NullType {
+		sets, ok := asMapping(node)
+		if !ok {
+			return nil, nodeError(d.filename, node, fmt.Errorf("filter_sets must be a mapping of names to filters"))
+		}
+		for _, v := range sets.Values {
+			name := keyName(v)
+			seq, ok := v.Value.(*ast.SequenceNode)
+			if !ok {
+				return nil, nodeError(d.filename, v.Value, fmt.Errorf("filter set %s must be a list of filters", name))
+			}
+
+			var filters []*Filter
+			if err := d.dec.DecodeFromNode(seq, &filters); err != nil {
+				return nil, locate(nil, d.filename, err)
+			}
+			for i, filter := range filters {
+				if err := filter.compile(fmt.Sprintf("$.filter_sets.%s[%d]", name, i), ""); err != nil {
+					return nil, locate(d.root, d.filename, err)
+				}
+			}
+			l.filterSets[name] = seq
+		}
+	}
+
+	return l, nil
+}
+
+// feeds returns the document's feed definitions with defaults filled in
+// and filter sets expanded, as a document of their own so that paths like
+// $.feeds[0].filters[3] refer to the expanded filters.
+func (d *document) feeds() (*ast.MappingNode, error) {
+	v := lookupValue(d.root, "feeds")
+	if v == nil {
+		return nil, nil
+	}
+	if v.Value.Type() == ast.NullType {
+		return nil, nil
+	}
+	seq, ok := v.Value.(*ast.SequenceNode)
+	if !ok {
+		return nil, nodeError(d.filename, v.Value, fmt.Errorf("feeds must be a list"))
+	}
+
+	expanded := ast.Sequence(seq.GetToken(), seq.IsFlowStyle)
+	for _, node := range seq.Values {
+		feed, err := d.expandFeed(node)
+		if err != nil {
+			return nil, err
+		}
+		expanded.Values = append(expanded.Values, feed)
+	}
+
+	return ast.Mapping(d.root.GetToken(), false, ast.MappingValue(v.GetToken(), v.Key, expanded)), nil
+}
+
+func (d *document) expandFeed(node ast.Node) (ast.Node, error) {
+	feed, ok := asMapping(node)
+	if !ok {
+		// left for decoding to report
+		return node, nil
+	}
+	feed = inherit(feed, d.layer.feed, "auth", "headers")
+
+	values := slices.Clone(feed.Values)
+	for i, v := range values {
+		if keyName(v) != "filters" {
+			continue
+		}
+		seq, ok := v.Value.(*ast.SequenceNode)
+		if !ok {
+			break
+		}
+
+		filters := ast.Sequence(seq.GetToken(), seq.IsFlowStyle)
+		for _, f := range seq.Values {
+			m, ok := asMapping(f)
+			if !ok {
+				filters.Values = append(filters.Values, f)
+				continue
+			}
+
+			use := lookupValue(m, "use")
+			if use == nil {
+				filters.Values = append(filters.Values, inherit(m, d.layer.filter))
+				continue
+			}
+			if len(m.Values) != 1 {
+				return nil, nodeError(d.filename, use.Key, fmt.Errorf("use can't be combined with other filter settings"))
+			}
+			name := use.Value.GetToken().Value
+			set, ok := d.layer.filterSets[name]
+			if !ok {
+				return nil, nodeError(d.filename, use.Value, fmt.Errorf("unknown filter set %s", name))
+			}
+			for _, sf := range set.Values {
+				if sm, ok := asMapping(sf); ok {
+					sf = inherit(sm, d.layer.filter)
+				}
+				filters.Values = append(filters.Values, sf)
+			}
+		}
+		values[i] = ast.MappingValue(v.GetToken(), v.Key, filters)
+	}
+
+	return ast.Mapping(feed.GetToken(), feed.IsFlowStyle, values...), nil
+}
+
+// inherit returns node with any keys it lacks filled in from defaults.
+// Mappings under the nested keys are merged a key at a time.  Neither
+// argument is modified.
+func inherit(node, defaults *ast.MappingNode, nested ...string) *ast.MappingNode {
+	if defaults == nil || len(defaults.Values) == 0 {
+		return node
+	}
+	if node == nil {
+		return defaults
+	}
+
+	values := slices.Clone(node.Values)
+	for i, v := range values {
+		if !slices.Contains(nested, keyName(v)) {
+			continue
+		}
+		m, ok := asMapping(v.Value)
+		if !ok {
+			continue
+		}
+		dv := lookupValue(defaults, keyName(v))
+		if dv == nil {
+			continue
+		}
+		dm, ok := asMapping(dv.Value)
+		if !ok {
+			continue
+		}
+		values[i] = ast.MappingValue(v.GetToken(), v.Key, inherit(m, dm))
+	}
+
+	for _, dv := range defaults.Values {
+		if lookupValue(node, keyName(dv)) == nil {
+			values = append(values, dv)
+		}
+	}
+
+	return ast.Mapping(node.GetToken(), node.IsFlowStyle, values...)
+}
+
+// asMapping returns node as a mapping.  The parser gives a mapping with a
+// single key as a bare MappingValueNode.
+func asMapping(node ast.Node) (*ast.MappingNode, bool) {
+	switch n := node.(type) {
+	case *ast.MappingNode:
+		return n, true
+	case *ast.MappingValueNode:
+		return ast.Mapping(n.Key.GetToken(), false, n), true
+	}
+	return nil, false
+}
+
+func keyName(v *ast.MappingValueNode) string {
+	return v.Key.GetToken().Value
+}
+
+func lookupValue(m *ast.MappingNode, key string) *ast.MappingValueNode {
+	if m == nil {
+		return nil
+	}
+	for _, v := range m.Values {
+		if keyName(v) == key {
+			return v
+		}
+	}
+	return nil
+}
+
+func lookup(m *ast.MappingNode, key string) ast.Node {
+	if v := lookupValue(m, key); v != nil {
+		return v.Value
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package subscription
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+)
+
+// fieldError is a problem with the value at a path in a subscription
+// document, like $.feeds[0].filters[2].title_regex.
+type fieldError struct {
+	path string
+	err  error
+}
+
+func (e *fieldError) Error() string {
+	return fmt.Sprintf("%s: %v", e.path, e.err)
+}
+
+// The yaml package prefixes errors with [line:column] and follows them with
+// an annotated excerpt of the source.
+var yamlErrorPosition = regexp.MustCompile(`^\[(\d+):(\d+)\] ([^\n]*)`)
+
+// locate rewrites a fieldError or yaml decoding error to point at the line
+// and column of the offending value beneath root.
+func locate(root ast.Node, filename string, err error) error {
+	var fe *fieldError
+	if !errors.As(err, &fe) {
+		m := yamlErrorPosition.FindStringSubmatch(err.Error())
+		if m == nil {
+			if filename != "" {
+				return fmt.Errorf("%s: %v", filename, err)
+			}
+			return err
+		}
+		line, _ := strconv.Atoi(m[1])
+		column, _ := strconv.Atoi(m[2])
+		return at(filename, line, column, errors.New(m[3]))
+	}
+
+	line, column, ok := position(root, fe.path)
+	if !ok {
+		if filename != "" {
+			return fmt.Errorf("%s: %v", filename, fe)
+		}
+		return fe
+	}
+	return at(filename, line, column, fe.err)
+}
+
+// nodeError reports err at the position of node.
+func nodeError(filename string, node ast.Node, err error) error {
+	pos := node.GetToken().Position
+	return at(filename, pos.Line, pos.Column, err)
+}
+
+func at(filename string, line, column int, err error) error {
+	if filename != "" {
+		return fmt.Errorf("%s:%d:%d: %v", filename, line, column, err)
+	}
+	return fmt.Errorf("line %d, column %d: %v", line, column, err)
+}
+
+// source describes where the value at path is defined, for messages that
+// refer back to it.
+func source(root ast.Node, filename string, path string) string {
+	line, column, ok := position(root, path)
+	if !ok {
+		return filename
+	}
+	if filename == "" {
+		return fmt.Sprintf("line %d, column %d", line, column)
+	}
+	return fmt.Sprintf("%s:%d:%d", filename, line, column)
+}
+
+func position(root ast.Node, path string) (int, int, bool) {
+	if root == nil {
+		return 0, 0, false
+	}
+
+	p, err := yaml.PathString(path)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	node, err := p.FilterNode(root)
+	if err != nil || node == nil {
+		return 0, 0, false
+	}
+
+	pos := node.GetToken().Position
+	return pos.Line, pos.Column, true
+}
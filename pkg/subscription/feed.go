@@ -2,205 +2,685 @@ package subscription
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
+	"net/http"
 	"os"
-	"regexp"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
-	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
 
 	"jaypod/pkg/rss"
 )
 
-type Wrapper struct {
-	Feeds []*Feed
+type Feed struct {
+	Name      string
+	Url       string
+	Collision string
+	UserAgent string `yaml:"user_agent"`
+	// Queued episodes of higher priority feeds are downloaded first
+	Priority int
+	// How often to poll the feed, e.g. 30m, 6h or 2d.  Without one the
+	// daemon's interval applies, stretched by any hints the feed gives.
+	PollInterval string `yaml:"poll_interval"`
+	// MIME types of enclosures to consider, like audio/* or video/mp4.  A
+	// bare major type such as video means all of its subtypes.
+	MediaTypes []string `yaml:"media_types"`
+	// Which episodes to download the first time the feed is polled: all
+	// (the default), none, latest N or since YYYY-MM-DD.  The rest can be
+	// fetched later with backfill.
+	Initial string
+	// Artwork to save alongside downloads
+	Artwork *Artwork
+	Auth    *Auth
+	Headers map[string]string
+	// Hosts besides the feed's own that its auth and headers are sent to,
+	// like the CDN its private enclosures are served from
+	AuthHosts []string `yaml:"auth_hosts"`
+	Filters   []*Filter
+
+	pollInterval time.Duration
+	mediaTypes   []string
+	// the initial policy: latest < 0 means none, 0 all
+	initialLatest int
+	initialSince  time.Time
+
+	// Url, Auth and Headers with secret references expanded
+	requestUrl string
+	header     http.Header
+	// file:line:column the feed was defined at
+	source string
 }
 
-type Feed struct {
-	Name    string
-	Url     string
-	Filters []*Filter
+type Artwork struct {
+	// The channel's image, as cover.jpg (or .png and so on, as the image
+	// is) in each directory episodes are saved to.  It's fetched again
+	// when the feed's image changes.
+	Cover bool
+	// Each episode's own image, if it has one, named after its file
+	Episodes bool
+}
+
+type Auth struct {
+	Type     string
+	Username string
+	Password string
+	Token    string
 }
 
+// Enclosures considered by feeds that don't give media_types
+var DefaultMediaTypes = []string{"audio/*"}
+
+// Initial policies
+const (
+	InitialAll    = "all"
+	InitialNone   = "none"
+	InitialLatest = "latest"
+	InitialSince  = "since"
+)
+
+// What to do when a download's filename is already taken by a file with
+// different contents.  Identical contents are always treated as a duplicate
+// and skipped.
+const (
+	CollisionSkip         = "skip"
+	CollisionOverwrite    = "overwrite"
+	CollisionSuffixNumber = "suffix-number"
+	CollisionSuffixDate   = "suffix-date"
+)
+
 type Filter struct {
-	TitleExpression       string `yaml:"title_regex"`
-	TitleRegexp           *regexp.Regexp
-	DescriptionExpression string `yaml:"description_regex"`
-	DescriptionRegexp     *regexp.Regexp
-	FilenameExpression    string `yaml:"filename_regex"`
-	FilenameRegexp        *regexp.Regexp
-	Subdir                string
-	Skip                  bool
-	Filename              string
-	FilenameTemplate      *template.Template
-	Incoming              bool
-	dest                  string
-}
-
-func ParseDir(dir string) ([]*Feed, error) {
-
-	files, err := os.ReadDir(dir)
-	if err != nil {
-		return nil, err
+	Condition `yaml:",inline"`
+	// full (the default), contains or prefix
+	Match      string
+	IgnoreCase bool `yaml:"ignore_case"`
+	// regex (the default) or glob
+	Syntax           string
+	Subdir           string
+	SubdirTemplate   *template.Template
+	Skip             bool
+	Filename         string
+	FilenameTemplate *template.Template
+	Incoming         bool
+	// Which enclosure to download, when an episode has several
+	Prefer *Preference
+	// Files of the episode's details to write next to it: json, nfo or
+	// markdown
+	Sidecars []string
+	dest     string
+}
+
+// Sidecar formats
+const (
+	// every field of the feed item
+	SidecarJson = "json"
+	// Kodi and Jellyfin episode details
+	SidecarNfo = "nfo"
+	// the title, date and description, for reading
+	SidecarMarkdown = "markdown"
+)
+
+// SidecarExtension is the extension sidecar files of a format are saved
+// with.
+func SidecarExtension(kind string) string {
+	if kind == SidecarMarkdown {
+		return "md"
+	}
+	return kind
+}
+
+// ParseDir loads every .yaml file in dir and its subdirectories.  Files
+// whose names start with an underscore aren't subscriptions: _defaults.yaml
+// holds defaults for its directory and those below it, and others are only
+// read when included.  It returns the feeds and smart playlists the files
+// define.  Problems with individual files, feeds or playlists are
+// collected into the returned error, with file:line:column locations, and
+// those that could be loaded are still returned.
+func ParseDir(dir string) ([]*Feed, []*Playlist, error) {
+
+	if _, err := os.ReadDir(dir); err != nil {
+		return nil, nil, err
 	}
 
+	var errs []error
 	feeds := []*Feed{}
-	for _, file := range files {
-		if file.IsDir() {
-			continue
+	names := map[string]*Feed{}
+	urls := map[string]*Feed{}
+	playlists := []*Playlist{}
+	playlistNames := map[string]*Playlist{}
+	layers := map[string]*layer{}
+
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: unreadable: %v", path, err))
+			return nil
 		}
 
-		if !strings.HasSuffix(file.Name(), ".yaml") {
-			continue
+		if entry.IsDir() {
+			if path != dir && strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+			layers[path] = dirLayer(path, layers[filepath.Dir(path)], &errs)
+			return nil
 		}
 
-		path := dir + "/" + file.Name()
+		if !strings.HasSuffix(entry.Name(), ".yaml") || strings.HasPrefix(entry.Name(), "_") {
+			return nil
+		}
 
 		feedsYaml, err := os.ReadFile(path)
 		if err != nil {
-			slog.Error("Unreadable file",
-				"filename", path,
-				"error", err)
+			errs = append(errs, fmt.Errorf("%s: unreadable: %v", path, err))
+			return nil
 		}
 
-		newFeeds, err := ParseFeeds(feedsYaml)
+		newFeeds, err := parseFeeds(feedsYaml, path, layers[filepath.Dir(path)])
 		if err != nil {
-			slog.Error("Error parsing file",
-				"filename", path,
-				"error", err)
+			errs = append(errs, err)
+		}
+
+		for _, feed := range newFeeds {
+			if prev, ok := names[feed.Name]; ok {
+				errs = append(errs, fmt.Errorf("%s: duplicate feed name %s, first defined at %s",
+					feed.source, feed.Name, prev.source))
+				continue
+			}
+			if prev, ok := urls[feed.Url]; ok {
+				errs = append(errs, fmt.Errorf("%s: feed %s has the same url as %s at %s",
+					feed.source, feed.Name, prev.Name, prev.source))
+				continue
+			}
+			names[feed.Name] = feed
+			urls[feed.Url] = feed
+			feeds = append(feeds, feed)
 		}
-		feeds = append(feeds, newFeeds...)
+
+		newPlaylists, err := parsePlaylists(feedsYaml, path)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, p := range newPlaylists {
+			if prev, ok := playlistNames[p.Name]; ok {
+				errs = append(errs, fmt.Errorf("%s: duplicate playlist name %s, first defined at %s",
+					p.source, p.Name, prev.source))
+				continue
+			}
+			playlistNames[p.Name] = p
+			playlists = append(playlists, p)
+		}
+		return nil
+	})
+
+	return feeds, playlists, errors.Join(errs...)
+}
+
+// dirLayer adds the directory's _defaults.yaml, if it has one, to the
+// layer inherited from its parent.
+func dirLayer(dir string, parent *layer, errs *[]error) *layer {
+	path := filepath.Join(dir, "_defaults.yaml")
+
+	contents, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return parent
 	}
-	return feeds, nil
+	if err != nil {
+		*errs = append(*errs, fmt.Errorf("%s: unreadable: %v", path, err))
+		return parent
+	}
+
+	d, err := readDocument(contents, path, parent, nil)
+	if err == nil {
+		err = d.settingsOnly()
+	}
+	if err != nil {
+		*errs = append(*errs, err)
+		return parent
+	}
+	return d.layer
 }
 
+// ParseFeeds parses a single subscription document.  Feeds with problems
+// are left out of the result and described in the error.
 func ParseFeeds(doc []byte) ([]*Feed, error) {
-	var w Wrapper
+	return parseFeeds(doc, "", nil)
+}
 
-	if err := yaml.Unmarshal(doc, &w); err != nil {
+func parseFeeds(doc []byte, filename string, base *layer) ([]*Feed, error) {
+	d, err := readDocument(doc, filename, base, nil)
+	if err != nil {
 		return []*Feed{}, err
 	}
 
-	for _, feed := range w.Feeds {
-		for _, filter := range feed.Filters {
-			//			fmt.Printf("filter: %+v\n", filter)
+	root, err := d.feeds()
+	if err != nil || root == nil {
+		return []*Feed{}, err
+	}
 
-			if filter.TitleExpression != "" {
-				re, err := regexp.Compile("^" + filter.TitleExpression + "$")
-				if err != nil {
-					return []*Feed{}, fmt.Errorf("error parsing regexp %s for feed %s", filter.TitleExpression, feed.Url)
-				}
-				filter.TitleRegexp = re
-			}
+	var errs []error
+	feeds := []*Feed{}
+	for i, node := range root.Values[0].Value.(*ast.SequenceNode).Values {
+		path := fmt.Sprintf("$.feeds[%d]", i)
 
-			if filter.DescriptionExpression != "" {
-				re, err := regexp.Compile("^" + filter.DescriptionExpression + "$")
-				if err != nil {
-					return []*Feed{}, fmt.Errorf("error parsing regexp %s for feed %s", filter.DescriptionExpression, feed.Url)
-				}
-				filter.DescriptionRegexp = re
-			}
+		feed := &Feed{}
+		if err := d.dec.DecodeFromNode(node, feed); err != nil {
+			errs = append(errs, locate(nil, filename, err))
+			continue
+		}
+		feed.source = source(root, filename, path+".name")
 
-			if filter.FilenameExpression != "" {
-				re, err := regexp.Compile("^" + filter.FilenameExpression + "$")
-				if err != nil {
-					return []*Feed{}, fmt.Errorf("error parsing regexp %s for feed %s", filter.FilenameExpression, feed.Url)
-				}
-				filter.FilenameRegexp = re
+		if err := feed.compile(path); err != nil {
+			var fe *fieldError
+			if errors.As(err, &fe) && feed.Name != "" {
+				fe.err = fmt.Errorf("%v (feed %s)", fe.err, feed.Name)
 			}
+			errs = append(errs, locate(root, filename, err))
+			continue
+		}
+		feeds = append(feeds, feed)
+	}
 
-			if filter.Subdir != "" {
-				filter.dest = fmt.Sprintf("%s/%s", feed.Name, filter.Subdir)
-			} else {
-				filter.dest = feed.Name
-			}
+	return feeds, errors.Join(errs...)
+}
 
-			if filter.Filename != "" {
-				t, err := template.New(filter.dest).Option("missingkey=zero").Parse(filter.Filename)
-				if err != nil {
-					return []*Feed{}, fmt.Errorf("error parsing filename %s for feed %s", filter.Filename, feed.Url)
-				}
-				filter.FilenameTemplate = t
-			}
+// compile checks a feed's settings and prepares its filters.
+func (feed *Feed) compile(path string) error {
+	if feed.Name == "" {
+		return &fieldError{path: path, err: fmt.Errorf("feed has no name")}
+	}
+	if feed.Url == "" {
+		return &fieldError{path: path, err: fmt.Errorf("feed has no url")}
+	}
 
+	switch feed.Collision {
+	case "":
+		feed.Collision = CollisionSuffixNumber
+	case CollisionSkip, CollisionOverwrite, CollisionSuffixNumber, CollisionSuffixDate:
+	default:
+		return &fieldError{path: path + ".collision",
+			err: fmt.Errorf("unknown collision policy %s", feed.Collision)}
+	}
+
+	if feed.PollInterval != "" {
+		d, err := parseInterval(feed.PollInterval)
+		if err != nil {
+			return &fieldError{path: path + ".poll_interval", err: err}
 		}
+		feed.pollInterval = d
 	}
 
-	return w.Feeds, nil
-}
+	if err := feed.compileInitial(); err != nil {
+		return &fieldError{path: path + ".initial", err: err}
+	}
 
-func (f *Feed) MatchAndMap(podcast *rss.RssItem) (bool, string, string, bool) {
-	for _, filter := range f.Filters {
-		match, dest, filebasename, incoming := filter.matchAndMap(podcast)
-		if match {
-			return match, dest, filebasename, incoming
+	if len(feed.MediaTypes) == 0 {
+		feed.MediaTypes = DefaultMediaTypes
+	}
+	feed.mediaTypes = nil
+	for j, t := range feed.MediaTypes {
+		pattern, err := mediaPattern(t)
+		if err != nil {
+			return &fieldError{path: fmt.Sprintf("%s.media_types[%d]", path, j), err: err}
 		}
+		feed.mediaTypes = append(feed.mediaTypes, pattern)
 	}
-	return false, "", "", false
+
+	if feed.Auth != nil {
+		switch feed.Auth.Type {
+		case "basic", "bearer":
+		default:
+			return &fieldError{path: path + ".auth.type",
+				err: fmt.Errorf("unknown auth type %s", feed.Auth.Type)}
+		}
+	}
+
+	for j, filter := range feed.Filters {
+		if err := filter.compile(fmt.Sprintf("%s.filters[%d]", path, j), feed.Name); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func (f *Filter) matchAndMap(podcast *rss.RssItem) (bool, string, string, bool) {
+// compile checks a filter's settings and prepares its condition and
+// templates.  dest is the name of the feed it belongs to.
+func (filter *Filter) compile(fpath string, dest string) error {
+	opts, err := filter.matchOptions(fpath)
+	if err != nil {
+		return err
+	}
+	if err := filter.Condition.compile(fpath, opts); err != nil {
+		return err
+	}
 
-	//	fmt.Printf("comparing %+v to {%s, %s}\n", f, title, description)
+	filter.dest = dest
 
-	subst := map[string]string{}
-	for k, v := range podcast.Attrs() {
-		subst[k] = v
+	for j, kind := range filter.Sidecars {
+		switch kind {
+		case SidecarJson, SidecarNfo, SidecarMarkdown:
+		default:
+			return &fieldError{path: fmt.Sprintf("%s.sidecars[%d]", fpath, j),
+				err: fmt.Errorf("unknown sidecar %s", kind)}
+		}
+	}
+
+	if filter.Prefer != nil {
+		if err := filter.Prefer.compile(fpath + ".prefer"); err != nil {
+			return err
+		}
 	}
 
-	if f.TitleRegexp != nil {
-		matches := f.TitleRegexp.FindStringSubmatch(podcast.Title())
-		if matches == nil {
-			return false, "", "", false
+	if filter.Subdir != "" {
+		t, err := template.New(filter.dest).Funcs(templateFuncs).Option("missingkey=zero").Parse(filter.Subdir)
+		if err != nil {
+			return &fieldError{path: fpath + ".subdir",
+				err: fmt.Errorf("error parsing subdir %s: %v", filter.Subdir, err)}
 		}
+		filter.SubdirTemplate = t
+	}
 
-		for i, m := range matches {
-			if i > 0 {
-				subst[f.TitleRegexp.SubexpNames()[i]] = m
-			}
+	if filter.Filename != "" {
+		t, err := template.New(filter.dest).Funcs(templateFuncs).Option("missingkey=zero").Parse(filter.Filename)
+		if err != nil {
+			return &fieldError{path: fpath + ".filename",
+				err: fmt.Errorf("error parsing filename %s: %v", filter.Filename, err)}
+		}
+		filter.FilenameTemplate = t
+	}
+
+	return nil
+}
+
+// compileInitial parses the feed's initial policy.
+func (feed *Feed) compileInitial() error {
+	feed.initialLatest, feed.initialSince = 0, time.Time{}
+	policy, arg, _ := strings.Cut(strings.TrimSpace(feed.Initial), " ")
+	arg = strings.TrimSpace(arg)
+	switch {
+	case (policy == "" || policy == InitialAll) && arg == "":
+	case policy == InitialNone && arg == "":
+		feed.initialLatest = -1
+	case policy == InitialLatest:
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("bad initial policy %q, expected latest and a number of episodes", feed.Initial)
+		}
+		feed.initialLatest = n
+	case policy == InitialSince:
+		t, err := parseDay(arg)
+		if err != nil {
+			return fmt.Errorf("bad initial policy %q, expected since and a date", feed.Initial)
+		}
+		feed.initialSince = t
+	default:
+		return fmt.Errorf("unknown initial policy %q", feed.Initial)
+	}
+	return nil
+}
+
+// InitiallyWanted says whether a matched episode should be downloaded the
+// first time the feed is polled, given how many matched episodes are newer.
+func (feed *Feed) InitiallyWanted(podcast *rss.RssItem, newer int) bool {
+	switch {
+	case feed.initialLatest < 0:
+		return false
+	case feed.initialLatest > 0:
+		return newer < feed.initialLatest
+	case !feed.initialSince.IsZero():
+		return !podcast.PubDate.Before(feed.initialSince)
+	}
+	return true
+}
+
+// InitiallyWantsOlder says whether the initial policy could want episodes
+// published before oldest, given that matched episodes have been found so
+// far, so that older pages of the feed are worth reading the first time
+// it's polled.
+func (feed *Feed) InitiallyWantsOlder(oldest time.Time, matched int) bool {
+	switch {
+	case feed.initialLatest < 0:
+		return false
+	case feed.initialLatest > 0:
+		return matched < feed.initialLatest
+	case !feed.initialSince.IsZero():
+		return oldest.After(feed.initialSince)
+	}
+	return true
+}
+
+// Interval is the feed's own poll interval, or zero if it doesn't have one.
+func (feed *Feed) Interval() time.Duration {
+	return feed.pollInterval
+}
+
+// parseInterval parses a Go duration, also allowing whole days like "2d".
+func parseInterval(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n > 0 {
+			return time.Duration(n) * 24 * time.Hour, nil
 		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("bad interval %q", s)
+	}
+	return d, nil
+}
 
+// mediaPattern turns a media_types entry into a pattern for path.Match.
+func mediaPattern(t string) (string, error) {
+	pattern := strings.ToLower(strings.TrimSpace(t))
+	if !strings.Contains(pattern, "/") {
+		pattern += "/*"
+	}
+	if _, err := path.Match(pattern, ""); err != nil || strings.Count(pattern, "/") != 1 {
+		return "", fmt.Errorf("bad media type %s", t)
 	}
+	return pattern, nil
+}
 
-	if f.DescriptionRegexp != nil {
-		matches := f.DescriptionRegexp.FindStringSubmatch(podcast.Description())
-		if matches == nil {
-			return false, "", "", false
+// Accepts says whether the feed wants enclosures of a MIME type.
+func (feed *Feed) Accepts(mimeType string) bool {
+	patterns := feed.mediaTypes
+	if patterns == nil {
+		patterns = DefaultMediaTypes
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, mimeType); ok {
+			return true
 		}
+	}
+	return false
+}
 
-		for i, m := range matches {
-			if i > 0 {
-				subst[f.DescriptionRegexp.SubexpNames()[i]] = m
-			}
+// Considers says whether an enclosure of a MIME type might be wanted: it's
+// of a type the feed accepts, or its type can't be told until it's
+// downloaded, when it's checked again.
+func (feed *Feed) Considers(mimeType string) bool {
+	return mimeType == "" || feed.Accepts(mimeType)
+}
+
+// Enclosures returns the versions of an episode that are worth
+// downloading, best first: those of a type the feed accepts, ordered by
+// the preference of the first filter the episode matches, and then those
+// whose type isn't known.
+func (feed *Feed) Enclosures(podcast *rss.RssItem) []rss.RssEnclosure {
+	var accepted, unknown []rss.RssEnclosure
+	for _, e := range podcast.AllEnclosures() {
+		if t := e.Type(); t == "" {
+			unknown = append(unknown, e)
+		} else if feed.Accepts(t) {
+			accepted = append(accepted, e)
 		}
+	}
 
+	if filter := feed.filterFor(podcast); filter != nil {
+		return append(filter.Prefer.choose(podcast, accepted), filter.Prefer.choose(podcast, unknown)...)
 	}
+	return append(accepted, unknown...)
+}
 
-	if f.FilenameRegexp != nil {
-		matches := f.FilenameRegexp.FindStringSubmatch(podcast.FileBaseName())
-		if matches == nil {
-			return false, "", "", false
+// Files groups the enclosures worth downloading into the files an episode
+// has, each with its versions best first.  The episode itself comes first:
+// its first enclosure along with any alternate enclosures, enclosures of
+// the same major type and those whose type isn't known.  Enclosures of
+// another major type, like a PDF alongside an mp3, are files of their own,
+// again with any of the same major type as fallbacks.  If no version of
+// the episode itself will do, there are no files.
+func (feed *Feed) Files(podcast *rss.RssItem) [][]rss.RssEnclosure {
+	major := func(mimeType string) string {
+		m, _, _ := strings.Cut(mimeType, "/")
+		return m
+	}
+	main := major(podcast.Enclosure.Type())
+
+	var episode []rss.RssEnclosure
+	var files [][]rss.RssEnclosure
+	others := map[string]int{}
+	for _, e := range feed.Enclosures(podcast) {
+		m := major(e.Type())
+		if e.Alternate || m == "" || m == main {
+			episode = append(episode, e)
+		} else if i, ok := others[m]; ok {
+			files[i] = append(files[i], e)
+		} else {
+			others[m] = len(files)
+			files = append(files, []rss.RssEnclosure{e})
 		}
+	}
+	if len(episode) == 0 {
+		return nil
+	}
+	return append([][]rss.RssEnclosure{episode}, files...)
+}
 
-		for i, m := range matches {
-			if i > 0 {
-				subst[f.FilenameRegexp.SubexpNames()[i]] = m
-			}
+// Sidecars returns the sidecar formats to write for an episode.
+func (feed *Feed) Sidecars(podcast *rss.RssItem) []string {
+	if filter := feed.filterFor(podcast); filter != nil {
+		return filter.Sidecars
+	}
+	return nil
+}
+
+// filterFor returns the first filter an episode matches, or nil.
+func (feed *Feed) filterFor(podcast *rss.RssItem) *Filter {
+	for _, filter := range feed.Filters {
+		if filter.Condition.match(podcast, map[string]string{}) {
+			return filter
 		}
+	}
+	return nil
+}
+
+func (f *Filter) matchOptions(path string) (matchOptions, error) {
+	opts := matchOptions{mode: f.Match, ignoreCase: f.IgnoreCase}
 
+	switch f.Match {
+	case "", MatchFull, MatchContains, MatchPrefix:
+	default:
+		return opts, &fieldError{path: path + ".match", err: fmt.Errorf("unknown match mode %s", f.Match)}
+	}
+
+	switch f.Syntax {
+	case "", SyntaxRegex:
+	case SyntaxGlob:
+		opts.glob = true
+	default:
+		return opts, &fieldError{path: path + ".syntax", err: fmt.Errorf("unknown syntax %s", f.Syntax)}
+	}
+
+	return opts, nil
+}
+
+func (f *Feed) MatchAndMap(podcast *rss.RssItem) (bool, string, string, bool) {
+	for _, filter := range f.Filters {
+		match, dest, filebasename, incoming := filter.matchAndMap(podcast)
+		if match {
+			return match, dest, filebasename, incoming
+		}
+	}
+	return false, "", "", false
+}
+
+func (f *Filter) matchAndMap(podcast *rss.RssItem) (bool, string, string, bool) {
+
+	//	fmt.Printf("comparing %+v to {%s, %s}\n", f, title, description)
+
+	subst := map[string]string{}
+	for k, v := range podcast.Attrs() {
+		subst[k] = v
+	}
+
+	if !f.Condition.match(podcast, subst) {
+		return false, "", "", false
 	}
 
 	if f.Skip {
 		return true, "", "", false
 	}
 
+	dest := f.dest
+	if f.SubdirTemplate != nil {
+		var b bytes.Buffer
+		if err := f.SubdirTemplate.Execute(&b, subst); err != nil {
+			slog.Warn("subdir template failed, skipping",
+				"title", podcast.Title(),
+				"error", err)
+			return true, "", "", false
+		}
+
+		subdir, err := cleanSubdir(b.String())
+		if err != nil {
+			slog.Warn("bad subdir, skipping",
+				"title", podcast.Title(),
+				"subdir", b.String(),
+				"error", err)
+			return true, "", "", false
+		}
+		if subdir != "" {
+			dest = dest + "/" + subdir
+		}
+	}
+
 	if f.FilenameTemplate == nil {
-		return true, f.dest, "", f.Incoming
+		return true, dest, "", f.Incoming
 	}
 
 	var b bytes.Buffer
-	f.FilenameTemplate.Execute(&b, subst)
-	return true, f.dest, b.String(), f.Incoming
+	if err := f.FilenameTemplate.Execute(&b, subst); err != nil {
+		slog.Warn("filename template failed, using default name",
+			"title", podcast.Title(),
+			"error", err)
+		return true, dest, "", f.Incoming
+	}
+	return true, dest, b.String(), f.Incoming
+}
+
+// cleanSubdir tidies a rendered subdir and makes sure it stays beneath the
+// feed's directory.
+func cleanSubdir(subdir string) (string, error) {
+	if strings.HasPrefix(subdir, "/") || strings.HasPrefix(subdir, "\\") {
+		return "", fmt.Errorf("absolute path")
+	}
+
+	var parts []string
+	for _, part := range strings.FieldsFunc(subdir, func(r rune) bool { return r == '/' || r == '\\' }) {
+		part = strings.TrimSpace(part)
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			return "", fmt.Errorf("path escapes destination")
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, "/"), nil
 }
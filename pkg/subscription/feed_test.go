@@ -1,7 +1,12 @@
 package subscription
 
 import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"jaypod/pkg/rss"
 )
@@ -176,3 +181,739 @@ func makeRssItem(title, description string) *rss.RssItem {
 		MyDescription: description,
 	}
 }
+
+const predicateYaml = `
+feeds:
+  - name: "News/Daily"
+    url: http://example.com/rss
+    filters:
+      - episode_type: trailer
+        skip: true
+      - max_duration: "2m"
+        skip: true
+      - before: "2020-01-01"
+        skip: true
+      - season: "2-3"
+        episode: "-10"
+        subdir: "Early"
+      - mime_type: "video/*"
+        subdir: "Video"
+      - min_size: "100MB"
+        subdir: "Long"
+      - subdir: "Main"
+`
+
+func TestPredicates(t *testing.T) {
+	feeds, err := ParseFeeds([]byte(predicateYaml))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	recent := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+
+	var expected = []struct {
+		item  *rss.RssItem
+		match bool
+		dest  string
+	}{
+		{&rss.RssItem{EpisodeType: "trailer", Duration: "30:00", PubDate: recent}, true, ""},
+		{&rss.RssItem{Duration: "1:45", PubDate: recent}, true, ""},
+		{&rss.RssItem{Duration: "45:00", PubDate: time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)}, true, ""},
+		{&rss.RssItem{Duration: "45:00", PubDate: recent, Season: "2", Episode: "7"}, true, "News/Daily/Early"},
+		{&rss.RssItem{Duration: "45:00", PubDate: recent, Season: "2", Episode: "11", Enclosure: rss.RssEnclosure{Length: "20000000"}}, true, "News/Daily/Main"},
+		{&rss.RssItem{Duration: "2700", PubDate: recent, Enclosure: rss.RssEnclosure{EnclosureType: "video/mp4"}}, true, "News/Daily/Video"},
+		{&rss.RssItem{Duration: "1:45:00", PubDate: recent, Enclosure: rss.RssEnclosure{Length: "209715200"}}, true, "News/Daily/Long"},
+		// unknown duration and size satisfy neither bound
+		{&rss.RssItem{PubDate: recent, Enclosure: rss.RssEnclosure{Length: "0"}}, true, "News/Daily/Main"},
+	}
+
+	for i, x := range expected {
+		match, dest, _, _ := feeds[0].MatchAndMap(x.item)
+		if match != x.match {
+			t.Errorf("expected[%d] - expected match %v, got %v", i, x.match, match)
+		}
+		if dest != x.dest {
+			t.Errorf("expected[%d] - expected dest %v, got %v", i, x.dest, dest)
+		}
+	}
+
+	for _, bad := range []string{`min_duration: "long"`, `season: "two"`, `episode_type: "teaser"`, `max_size: "big"`, `after: "yesterday"`} {
+		doc := "feeds:\n  - name: x\n    url: http://example.com/rss\n    filters:\n      - " + bad + "\n"
+		if _, err := ParseFeeds([]byte(doc)); err == nil {
+			t.Errorf("expected error for %s", bad)
+		}
+	}
+}
+
+func TestZeroBounds(t *testing.T) {
+	feeds, err := ParseFeeds([]byte(`
+feeds:
+  - name: Show
+    url: http://example.com/rss
+    filters:
+      - max_size: "0"
+        subdir: "Empty"
+      - min_duration: "0"
+        subdir: "Timed"
+      - subdir: "Other"
+`))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	var expected = []struct {
+		item *rss.RssItem
+		dest string
+	}{
+		// a bound of zero is a bound, not the absence of one
+		{&rss.RssItem{Duration: "45:00", Enclosure: rss.RssEnclosure{Length: "20000000"}}, "Show/Timed"},
+		{&rss.RssItem{Enclosure: rss.RssEnclosure{Length: "20000000"}}, "Show/Other"},
+	}
+
+	for i, x := range expected {
+		_, dest, _, _ := feeds[0].MatchAndMap(x.item)
+		if dest != x.dest {
+			t.Errorf("expected[%d] - expected dest %v, got %v", i, x.dest, dest)
+		}
+	}
+}
+
+const conditionYaml = `
+feeds:
+  - name: "Comedy/WTF"
+    url: http://wtfpod.libsyn.com/rss
+    filters:
+      - title_regex: "Episode (?P<epnum>\d*) - (?P<eptitle>.*)"
+        not:
+          description_regex: ".*[Rr]erun.*"
+        filename: "{{.epnum}} {{.eptitle}}"
+      - any:
+          - title_regex: "(?P<guest>.*) from (?P<year>\d{4})"
+          - all:
+              - title_regex: "Bonus.*"
+              - max_duration: "30m"
+        subdir: "Extras"
+        filename: "{{.guest}}"
+`
+
+func TestConditions(t *testing.T) {
+	feeds, err := ParseFeeds([]byte(conditionYaml))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	var expected = []struct {
+		item         *rss.RssItem
+		match        bool
+		dest         string
+		filebasename string
+	}{
+		{makeRssItem("Episode 1512 - Da'Vine Joy Randolph", ""), true, "Comedy/WTF", "1512 Da'Vine Joy Randolph"},
+		{makeRssItem("Episode 1513 - Wayne Kramer", "A rerun from 2014"), false, "", ""},
+		{makeRssItem("Wayne Kramer from 2014", ""), true, "Comedy/WTF/Extras", "Wayne Kramer"},
+		{&rss.RssItem{MyTitle: "Bonus: Outtakes", Duration: "12:00"}, true, "Comedy/WTF/Extras", ""},
+		{&rss.RssItem{MyTitle: "Bonus: Full Set", Duration: "1:12:00"}, false, "", ""},
+	}
+
+	for i, x := range expected {
+		match, dest, filebasename, _ := feeds[0].MatchAndMap(x.item)
+		if match != x.match {
+			t.Errorf("expected[%d] - expected match %v, got %v", i, x.match, match)
+		}
+		if dest != x.dest {
+			t.Errorf("expected[%d] - expected dest %v, got %v", i, x.dest, dest)
+		}
+		if filebasename != x.filebasename {
+			t.Errorf("expected[%d] - expected filebasename %v, got %v", i, x.filebasename, filebasename)
+		}
+	}
+}
+
+func TestConditionErrorLocation(t *testing.T) {
+	doc := `
+feeds:
+  - name: "Comedy/WTF"
+    url: http://wtfpod.libsyn.com/rss
+    filters:
+      - any:
+          - title_regex: "Episode ("
+`
+	_, err := ParseFeeds([]byte(doc))
+	if err == nil {
+		t.Fatalf("expected error for bad regexp")
+	}
+	if !strings.Contains(err.Error(), "line 7, column 26") {
+		t.Errorf("expected error to point at line 7, column 26, got %v", err)
+	}
+}
+
+func TestMatchModes(t *testing.T) {
+	var modes = []struct {
+		options string
+		expr    string
+		title   string
+		match   bool
+	}{
+		{"", "Ask Tom", "Ask Tom #12", false},
+		{"", "Ask Tom.*", "Ask Tom #12", true},
+		{"match: full", "Ask Tom.*", "ask tom #12", false},
+		{"ignore_case: true", "Ask Tom.*", "ask tom #12", true},
+		{"match: prefix", "Ask Tom", "Ask Tom #12", true},
+		{"match: prefix", "Tom", "Ask Tom #12", false},
+		{"match: contains", "Tom #\\d+", "Ask Tom #12", true},
+		{"match: contains", "Tom #\\d+", "Ask Mike #12", false},
+		{"match: contains\n        ignore_case: true", "JOHN GENTLE", "The John Gentle Hour", true},
+		{"syntax: glob", "Ask Tom*", "Ask Tom #12", true},
+		{"syntax: glob", "Ask Tom", "Ask Tom #12", false},
+		{"syntax: glob", "Ask Tom #?2", "Ask Tom #12", true},
+		{"syntax: glob", "Ask Tom #[!1]2", "Ask Tom #12", false},
+		{"syntax: glob", "S&W (*)", "S&W (Live)", true},
+		{"syntax: glob\n        match: contains", "*Horsem[ae]n*", "BEST SHOW: FOUR HORSEMEN", false},
+		{"syntax: glob\n        match: contains\n        ignore_case: true", "Horsem[ae]n", "BEST SHOW: FOUR HORSEMEN", true},
+	}
+
+	for i, x := range modes {
+		doc := "feeds:\n  - name: x\n    url: http://example.com/rss\n    filters:\n      - title_regex: \"" +
+			strings.ReplaceAll(x.expr, `\`, `\\`) + "\"\n"
+		if x.options != "" {
+			doc += "        " + x.options + "\n"
+		}
+
+		feeds, err := ParseFeeds([]byte(doc))
+		if err != nil {
+			t.Fatalf("modes[%d] - parse error: %v", i, err)
+		}
+
+		match, _, _, _ := feeds[0].MatchAndMap(makeRssItem(x.title, ""))
+		if match != x.match {
+			t.Errorf("modes[%d] - %q with %q against %q: expected match %v, got %v",
+				i, x.expr, x.options, x.title, x.match, match)
+		}
+	}
+
+	for _, bad := range []string{"match: fuzzy", "syntax: pcre"} {
+		doc := "feeds:\n  - name: x\n    url: http://example.com/rss\n    filters:\n      - " + bad + "\n"
+		if _, err := ParseFeeds([]byte(doc)); err == nil {
+			t.Errorf("expected error for %s", bad)
+		}
+	}
+}
+
+func TestSubdirTemplates(t *testing.T) {
+	var subdirs = []struct {
+		subdir   string
+		title    string
+		expected string
+	}{
+		{"Main", "Episode 3", "Shows/Main"},
+		{"{{.year}}/{{.month}}", "Episode 3", "Shows/2024/03"},
+		{"Season {{.season | default \"Unknown\"}}", "Episode 3", "Shows/Season 2"},
+		{"Season {{.season | pad 2}}", "Episode 3", "Shows/Season 02"},
+		{"{{.show}}", "Ask Tom: Episode 3", "Shows/Ask Tom"},
+		{"{{.show}}", "Episode 3", "Shows"},
+		{"{{.show}}", "../..: Episode 3", ""},
+		{"{{.show}}", "/etc: Episode 3", ""},
+		{"./{{.show}}//x", "Ask Tom: Episode 3", "Shows/Ask Tom/x"},
+	}
+
+	for i, x := range subdirs {
+		doc := "feeds:\n  - name: Shows\n    url: http://example.com/rss\n    filters:\n      - title_regex: \"((?P<show>.*): )?Episode.*\"\n        subdir: '" + x.subdir + "'\n"
+		feeds, err := ParseFeeds([]byte(doc))
+		if err != nil {
+			t.Fatalf("subdirs[%d] - parse error: %v", i, err)
+		}
+
+		item := &rss.RssItem{
+			MyTitle: rss.NonNamespaceString(x.title),
+			Season:  "2",
+			PubDate: time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC),
+		}
+		_, dest, _, _ := feeds[0].MatchAndMap(item)
+		if dest != x.expected {
+			t.Errorf("subdirs[%d] - %s with %q: expected %q, got %q", i, x.subdir, x.title, x.expected, dest)
+		}
+	}
+}
+
+func TestParseDirProblems(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.yaml": `
+feeds:
+  - name: "Comedy/WTF"
+    url: http://wtfpod.libsyn.com/rss
+    filters:
+      - title_regex: "Episode.*"
+`,
+		"b.yaml": `
+feeds:
+  - name: "Comedy/WTF"
+    url: http://wtfpod.libsyn.com/rss2
+  - name: "Comedy/Typo"
+    url: http://typo.example.com/rss
+    filters:
+      - titel_regex: "Episode.*"
+`,
+		"c.yaml": `
+feeds:
+  - name: "Comedy/Again"
+    url: http://wtfpod.libsyn.com/rss
+  - name: "Comedy/Template"
+    url: http://template.example.com/rss
+    filters:
+      - filename: "{{.epnum"
+  - name: "Comedy/Fine"
+    url: http://fine.example.com/rss
+`,
+		"notes.txt": "not yaml",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0666); err != nil {
+			t.Fatalf("failed writing %s: %v", name, err)
+		}
+	}
+
+	feeds, _, err := ParseDir(dir)
+	if len(feeds) != 2 || feeds[0].Name != "Comedy/WTF" || feeds[1].Name != "Comedy/Fine" {
+		t.Errorf("expected the two good feeds, got %+v", feeds)
+	}
+
+	if err == nil {
+		t.Fatalf("expected problems")
+	}
+
+	expected := []string{
+		filepath.Join(dir, "b.yaml") + `:8:9: unknown field "titel_regex"`,
+		filepath.Join(dir, "c.yaml") + ":8:19: error parsing filename",
+		filepath.Join(dir, "c.yaml") + ":3:11: feed Comedy/Again has the same url as Comedy/WTF at " + filepath.Join(dir, "a.yaml") + ":3:11",
+	}
+	for _, x := range expected {
+		if !strings.Contains(err.Error(), x) {
+			t.Errorf("expected problem %q in:\n%v", x, err)
+		}
+	}
+}
+
+func TestMediaTypes(t *testing.T) {
+	doc := `
+defaults:
+  media_types: [audio, application/pdf]
+feeds:
+  - name: "Audio"
+    url: http://example.com/audio
+    media_types: []
+  - name: "Notes"
+    url: http://example.com/notes
+  - name: "Video"
+    url: http://example.com/video
+    media_types: ["video/mp4", "Audio/*"]
+`
+	feeds, err := ParseFeeds([]byte(doc))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	var expected = []struct {
+		feed     int
+		mimeType string
+		accepts  bool
+	}{
+		{0, "audio/mpeg", true},
+		{0, "video/mp4", false},
+		{0, "", false},
+		{1, "audio/x-m4a", true},
+		{1, "application/pdf", true},
+		{1, "video/mp4", false},
+		{2, "video/mp4", true},
+		{2, "video/webm", false},
+		{2, "audio/ogg", true},
+	}
+
+	for i, x := range expected {
+		if feeds[x.feed].Accepts(x.mimeType) != x.accepts {
+			t.Errorf("expected[%d] - expected %s accepts %s: %v", i, feeds[x.feed].Name, x.mimeType, x.accepts)
+		}
+	}
+
+	bad := "feeds:\n  - name: x\n    url: http://example.com/rss\n    media_types: [\"video/[\"]\n"
+	if _, err := ParseFeeds([]byte(bad)); err == nil || !strings.Contains(err.Error(), "bad media type") {
+		t.Errorf("expected bad media type error, got %v", err)
+	}
+}
+
+func TestPreferences(t *testing.T) {
+	doc := `
+feeds:
+  - name: "Show"
+    url: http://example.com/rss
+    media_types: [audio, video]
+    filters:
+      - title_regex: "Small.*"
+        prefer:
+          quality: smallest
+      - title_regex: "Best.*"
+        prefer:
+          quality: highest
+          bitrate: "-200k"
+      - title_regex: "Format.*"
+        prefer:
+          formats: [m4a, "video/*"]
+          max_size: 60MB
+      - title_regex: "M4a.*"
+        prefer:
+          formats: [m4a]
+      - title_regex: ".*"
+`
+	feeds, err := ParseFeeds([]byte(doc))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	item := func(title string) *rss.RssItem {
+		return &rss.RssItem{
+			MyTitle:  rss.NonNamespaceString(title),
+			Duration: "1:00:00",
+			Enclosures: []rss.RssEnclosure{
+				{Url: "http://x/128.mp3", EnclosureType: "audio/mpeg", Length: "57600000"},
+				{Url: "http://x/notes.pdf", EnclosureType: "application/pdf", Length: "1000"},
+				{Url: "http://x/256.m4a", EnclosureType: "audio/mp4", Length: "115200000"},
+				{Url: "http://x/64.mp3", EnclosureType: "audio/mpeg", Length: "28800000"},
+				{Url: "http://x/video.mp4", EnclosureType: "video/mp4"},
+				{Url: "http://x/download"},
+			},
+		}
+	}
+
+	var expected = []struct {
+		title string
+		urls  string
+	}{
+		// the download's type isn't known until it's fetched, so it comes last
+		{"Anything", "128.mp3 256.m4a 64.mp3 video.mp4 download"},
+		{"Small", "64.mp3 128.mp3 256.m4a video.mp4 download"},
+		// the 256k m4a is over the bitrate limit
+		{"Best", "128.mp3 64.mp3 video.mp4 download"},
+		// and over the size limit
+		{"Format", "video.mp4 128.mp3 64.mp3 download"},
+		// audio/mp4 is saved as mp4, but still known as m4a
+		{"M4a", "256.m4a 128.mp3 64.mp3 video.mp4 download"},
+	}
+
+	for i, x := range expected {
+		var urls []string
+		for _, e := range feeds[0].Enclosures(item(x.title)) {
+			urls = append(urls, strings.TrimPrefix(e.Url, "http://x/"))
+		}
+		if strings.Join(urls, " ") != x.urls {
+			t.Errorf("expected[%d] - expected %s, got %v", i, x.urls, urls)
+		}
+	}
+
+	for _, bad := range []string{
+		"prefer:\n          quality: best\n",
+		"prefer:\n          bitrate: fast\n",
+		"prefer:\n          max_size: huge\n",
+		"prefer:\n          formats: [\"audio/[\"]\n",
+	} {
+		doc := "feeds:\n  - name: x\n    url: http://example.com/rss\n    filters:\n      - " + bad
+		if _, err := ParseFeeds([]byte(doc)); err == nil || !strings.Contains(err.Error(), "line 6") {
+			t.Errorf("expected located error for %q, got %v", bad, err)
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	doc := `
+feeds:
+  - name: "Show"
+    url: http://example.com/rss
+    media_types: [audio, video, application/pdf]
+`
+	feeds, err := ParseFeeds([]byte(doc))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	rc, err := rss.ParseRss([]byte(`<rss xmlns:podcast="https://podcastindex.org/namespace/1.0"><channel><item>
+  <enclosure url="http://x/128.mp3" type="audio/mpeg"/>
+  <enclosure url="http://x/notes.pdf" type="application/pdf"/>
+  <enclosure url="http://x/64.mp3" type="audio/mpeg"/>
+  <enclosure url="http://x/transcript.pdf" type="application/pdf"/>
+  <enclosure url="http://x/download"/>
+  <podcast:alternateEnclosure type="video/mp4">
+    <podcast:source uri="http://x/video.mp4"/>
+  </podcast:alternateEnclosure>
+</item></channel></rss>`))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	item := rc.Feed.Items[0]
+
+	files := func() []string {
+		var files []string
+		for _, f := range feeds[0].Files(item) {
+			var urls []string
+			for _, e := range f {
+				urls = append(urls, strings.TrimPrefix(e.Url, "http://x/"))
+			}
+			files = append(files, strings.Join(urls, " "))
+		}
+		return files
+	}
+
+	// the video is an alternate of the episode, the pdfs a file of their own
+	expected := []string{"128.mp3 64.mp3 video.mp4 download", "notes.pdf transcript.pdf"}
+	if got := files(); !slices.Equal(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	// the download may yet turn out to be the episode
+	feeds[0].mediaTypes = []string{"application/pdf"}
+	expected = []string{"download", "notes.pdf transcript.pdf"}
+	if got := files(); !slices.Equal(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	item.Enclosures, item.Alternates = item.Enclosures[:4], nil
+	if got := files(); len(got) != 0 {
+		t.Errorf("expected no files without the episode, got %q", got)
+	}
+}
+
+func TestInitialPolicy(t *testing.T) {
+	day := func(d int) *rss.RssItem {
+		return &rss.RssItem{PubDate: time.Date(2024, 1, d, 6, 0, 0, 0, time.Local)}
+	}
+
+	var policies = []struct {
+		initial string
+		// whether days 1, 2 and 3 are wanted, with 2, 1 and 0 newer
+		wanted []bool
+		err    string
+	}{
+		{"", []bool{true, true, true}, ""},
+		{"all", []bool{true, true, true}, ""},
+		{"none", []bool{false, false, false}, ""},
+		{"latest 2", []bool{false, true, true}, ""},
+		{"since 2024-01-02", []bool{false, true, true}, ""},
+		{"latest", nil, "expected latest and a number of episodes"},
+		{"since yesterday", nil, "expected since and a date"},
+		{"newest 3", nil, `unknown initial policy "newest 3"`},
+	}
+
+	for i, x := range policies {
+		feeds, err := ParseFeeds([]byte("feeds:\n  - name: x\n    url: http://example.com/rss\n    initial: " + x.initial + "\n"))
+		if x.err != "" {
+			if err == nil || !strings.Contains(err.Error(), "line 4, column 14: ") || !strings.Contains(err.Error(), x.err) {
+				t.Errorf("policies[%d] - expected error %q, got %v", i, x.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("policies[%d] - parse error: %v", i, err)
+			continue
+		}
+		for d, wanted := range x.wanted {
+			if got := feeds[0].InitiallyWanted(day(d+1), 2-d); got != wanted {
+				t.Errorf("policies[%d] - expected day %d wanted %v, got %v", i, d+1, wanted, got)
+			}
+		}
+		// whether older pages could hold wanted episodes, when the
+		// oldest seen so far is from day 1
+		if got := feeds[0].InitiallyWantsOlder(day(1).PubDate, 3); got != x.wanted[0] {
+			t.Errorf("policies[%d] - expected older pages wanted %v, got %v", i, x.wanted[0], got)
+		}
+		// and when too few have matched for latest
+		want := x.wanted[0] || strings.HasPrefix(x.initial, "latest")
+		if got := feeds[0].InitiallyWantsOlder(day(1).PubDate, 1); got != want {
+			t.Errorf("policies[%d] - expected older pages wanted with one match %v, got %v", i, want, got)
+		}
+	}
+}
+
+func TestDefaultsAndFilterSets(t *testing.T) {
+	doc := `
+defaults:
+  collision: skip
+  headers:
+    X-Client: podfetch
+  filter:
+    incoming: true
+    filename: "{{.epnum}} {{.eptitle}}"
+filter_sets:
+  no-trailers:
+    - episode_type: trailer
+      skip: true
+feeds:
+  - name: "Comedy/WTF"
+    url: http://wtfpod.libsyn.com/rss
+    headers:
+      X-Token: abc
+    filters:
+      - use: no-trailers
+      - title_regex: "Episode (?P<epnum>\\d+) - (?P<eptitle>.*)"
+  - name: "Comedy/Other"
+    url: http://other.example.com/rss
+    collision: overwrite
+    filters:
+      - title_regex: ".*"
+        incoming: false
+`
+	feeds, err := ParseFeeds([]byte(doc))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	wtf, other := feeds[0], feeds[1]
+	if wtf.Collision != CollisionSkip || other.Collision != CollisionOverwrite {
+		t.Errorf("expected collision defaults skip/overwrite, got %s/%s", wtf.Collision, other.Collision)
+	}
+	if wtf.Headers["X-Client"] != "podfetch" || wtf.Headers["X-Token"] != "abc" {
+		t.Errorf("expected merged headers, got %v", wtf.Headers)
+	}
+	if len(wtf.Filters) != 2 || !wtf.Filters[0].Skip {
+		t.Fatalf("expected filter set spliced in first, got %+v", wtf.Filters)
+	}
+
+	trailer := makeRssItem("Episode 1 - Trailer", "")
+	trailer.EpisodeType = "trailer"
+	if match, dest, _, _ := wtf.MatchAndMap(trailer); !match || dest != "" {
+		t.Errorf("expected trailer to be skipped, got %v %q", match, dest)
+	}
+
+	match, dest, basename, incoming := wtf.MatchAndMap(makeRssItem("Episode 12 - Hello", ""))
+	if !match || dest != "Comedy/WTF" || basename != "12 Hello" || !incoming {
+		t.Errorf("expected default filename and incoming, got %v %q %q %v", match, dest, basename, incoming)
+	}
+
+	if _, _, _, incoming := other.MatchAndMap(makeRssItem("Anything", "")); incoming {
+		t.Errorf("expected filter to override incoming default")
+	}
+
+	for _, bad := range []string{
+		"feeds:\n  - name: x\n    url: http://example.com/rss\n    filters:\n      - use: missing\n",
+		"filter_sets:\n  a:\n    - title_regex: \"(\"\n",
+		"defaults:\n  url: http://example.com/rss\n",
+		"defaults:\n  filter:\n    titel_regex: x\n",
+		"feeds:\n  - name: x\n    url: http://example.com/rss\n    filters:\n      - use: a\n        skip: true\nfilter_sets:\n  a: []\n",
+		"feed:\n  - name: x\n",
+	} {
+		if _, err := ParseFeeds([]byte(bad)); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestParseDirNested(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"_defaults.yaml": `
+defaults:
+  priority: 1
+  filter:
+    incoming: true
+`,
+		"_shared.yaml": `
+filter_sets:
+  everything:
+    - title_regex: ".*"
+`,
+		"top.yaml": `
+include: [_shared.yaml]
+feeds:
+  - name: Top
+    url: http://top.example.com/rss
+    filters:
+      - use: everything
+`,
+		"Comedy/_defaults.yaml": `
+include: [../_shared.yaml]
+defaults:
+  priority: 5
+`,
+		"Comedy/wtf.yaml": `
+feeds:
+  - name: Comedy/WTF
+    url: http://wtfpod.libsyn.com/rss
+    filters:
+      - use: everything
+        `,
+		"Comedy/Late/night.yaml": `
+feeds:
+  - name: Comedy/Late
+    url: http://late.example.com/rss
+    priority: 9
+`,
+		"Loop/_defaults.yaml": "include: [_loop.yaml]\n",
+		"Loop/_loop.yaml":     "include: [_defaults.yaml]\n",
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatalf("failed making %s: %v", name, err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0666); err != nil {
+			t.Fatalf("failed writing %s: %v", name, err)
+		}
+	}
+
+	feeds, _, err := ParseDir(dir)
+	if err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Errorf("expected include cycle problem, got %v", err)
+	}
+
+	priorities := map[string]int{}
+	for _, feed := range feeds {
+		priorities[feed.Name] = feed.Priority
+	}
+	expected := map[string]int{"Top": 1, "Comedy/WTF": 5, "Comedy/Late": 9}
+	if len(priorities) != len(expected) {
+		t.Fatalf("expected feeds %v, got %v", expected, priorities)
+	}
+	for name, priority := range expected {
+		if priorities[name] != priority {
+			t.Errorf("expected %s to have priority %d, got %d", name, priority, priorities[name])
+		}
+	}
+
+	for _, feed := range feeds {
+		if feed.Name != "Comedy/WTF" {
+			continue
+		}
+		if match, _, _, incoming := feed.MatchAndMap(makeRssItem("Episode 1", "")); !match || !incoming {
+			t.Errorf("expected inherited filter set and incoming default, got %v %v", match, incoming)
+		}
+	}
+}
+
+func TestNumRange(t *testing.T) {
+	var ranges = []struct {
+		r        string
+		value    string
+		expected bool
+	}{
+		{"3", "3", true},
+		{"3", "4", false},
+		{"1-5", "5", true},
+		{"1-5", "6", false},
+		{"10-", "99", true},
+		{"10-", "9", false},
+		{"-4", "0", true},
+		{"-4", "5", false},
+		// zero is a bound like any other
+		{"0", "0", true},
+		{"0", "1", false},
+		{"0-2", "3", false},
+		{"3", "", false},
+	}
+
+	for i, x := range ranges {
+		r, err := parseRange(x.r)
+		if err != nil {
+			t.Fatalf("ranges[%d] - failed parsing %q: %v", i, x.r, err)
+		}
+		if r.contains(x.value) != x.expected {
+			t.Errorf("ranges[%d] - expected %q in %q to be %v", i, x.value, x.r, x.expected)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package subscription
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"github.com/goccy/go-yaml/parser"
+)
+
+// Playlist is a smart playlist, defined alongside the feeds, gathering
+// downloaded episodes from across the library.  It's saved as name.m3u8 in
+// the output directory.
+type Playlist struct {
+	Name string
+	// Globs of directories, relative to the output directory, whose
+	// episodes it takes, like Comedy/*.  Directories beneath a match are
+	// included too.
+	Dirs []string
+	// Globs of feed names whose episodes it takes
+	Feeds []string
+	// Only episodes published within this long, like 7d or 36h
+	Within string
+	// The most episodes it holds, keeping the most recently published
+	Limit int
+	// oldest (the default) or newest first, by pubDate
+	Order string
+
+	within time.Duration
+	// file:line:column the playlist was defined at
+	source string
+}
+
+const (
+	OrderOldest = "oldest"
+	OrderNewest = "newest"
+)
+
+// ParsePlaylists parses the smart playlists of a single subscription
+// document.
+func ParsePlaylists(doc []byte) ([]*Playlist, error) {
+	return parsePlaylists(doc, "")
+}
+
+func parsePlaylists(doc []byte, filename string) ([]*Playlist, error) {
+	file, err := parser.ParseBytes(doc, 0)
+	if err != nil || len(file.Docs) == 0 || file.Docs[0].Body == nil {
+		return nil, nil
+	}
+	root, ok := asMapping(file.Docs[0].Body)
+	if !ok {
+		return nil, nil
+	}
+	v := lookupValue(root, "playlists")
+	if v == nil || v.Value.Type() == ast.NullType {
+		return nil, nil
+	}
+	seq, ok := v.Value.(*ast.SequenceNode)
+	if !ok {
+		return nil, nodeError(filename, v.Value, fmt.Errorf("playlists must be a list"))
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(nil), yaml.Strict())
+	// registers any anchors
+	var ignored ast.Node
+	dec.DecodeFromNode(root, &ignored)
+
+	var errs []error
+	playlists := []*Playlist{}
+	for i, node := range seq.Values {
+		ppath := fmt.Sprintf("$.playlists[%d]", i)
+
+		p := &Playlist{}
+		if err := dec.DecodeFromNode(node, p); err != nil {
+			errs = append(errs, locate(nil, filename, err))
+			continue
+		}
+		p.source = source(root, filename, ppath+".name")
+
+		if err := p.compile(ppath); err != nil {
+			errs = append(errs, locate(root, filename, err))
+			continue
+		}
+		playlists = append(playlists, p)
+	}
+	return playlists, errors.Join(errs...)
+}
+
+func (p *Playlist) compile(ppath string) error {
+	if p.Name == "" {
+		return &fieldError{path: ppath, err: fmt.Errorf("playlist has no name")}
+	}
+	if strings.ContainsAny(p.Name, `/\`) || strings.HasPrefix(p.Name, ".") {
+		return &fieldError{path: ppath + ".name", err: fmt.Errorf("bad playlist name %s", p.Name)}
+	}
+
+	for j, d := range p.Dirs {
+		if _, err := path.Match(d, ""); err != nil || d == "" {
+			return &fieldError{path: fmt.Sprintf("%s.dirs[%d]", ppath, j), err: fmt.Errorf("bad glob %s", d)}
+		}
+		p.Dirs[j] = strings.Trim(path.Clean(d), "/")
+	}
+	for j, f := range p.Feeds {
+		if _, err := path.Match(f, ""); err != nil || f == "" {
+			return &fieldError{path: fmt.Sprintf("%s.feeds[%d]", ppath, j), err: fmt.Errorf("bad glob %s", f)}
+		}
+	}
+
+	if p.Within != "" {
+		d, err := parseInterval(p.Within)
+		if err != nil {
+			return &fieldError{path: ppath + ".within", err: err}
+		}
+		p.within = d
+	}
+
+	if p.Limit < 0 {
+		return &fieldError{path: ppath + ".limit", err: fmt.Errorf("bad limit %d", p.Limit)}
+	}
+
+	switch p.Order {
+	case "":
+		p.Order = OrderOldest
+	case OrderOldest, OrderNewest:
+	default:
+		return &fieldError{path: ppath + ".order", err: fmt.Errorf("unknown order %s", p.Order)}
+	}
+	return nil
+}
+
+// Includes says whether an episode of a feed, saved in dir, belongs in the
+// playlist by where it came from.  A playlist with neither dirs nor feeds
+// takes everything.
+func (p *Playlist) Includes(feed string, dir string) bool {
+	if len(p.Dirs) == 0 && len(p.Feeds) == 0 {
+		return true
+	}
+	for _, f := range p.Feeds {
+		if ok, _ := path.Match(f, feed); ok {
+			return true
+		}
+	}
+	for d := path.Clean(filepath.ToSlash(dir)); d != "." && d != "/"; d = path.Dir(d) {
+		for _, glob := range p.Dirs {
+			if ok, _ := path.Match(glob, d); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Recent says whether an episode published at pubDate is recent enough
+// for the playlist, as of now.
+func (p *Playlist) Recent(pubDate time.Time, now time.Time) bool {
+	return p.within == 0 || !pubDate.Before(now.Add(-p.within))
+}
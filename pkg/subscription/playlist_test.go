@@ -0,0 +1,96 @@
+package subscription
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlaylists(t *testing.T) {
+	playlists, err := ParsePlaylists([]byte(`
+playlists:
+  - name: Comedy this week
+    dirs: [Comedy/*]
+    within: 7d
+  - name: Daily news
+    feeds: [News/*]
+    limit: 5
+    order: newest
+  - name: Everything
+  - name: Bad/Name
+  - name: Bad order
+    order: sideways
+  - name: Bad within
+    within: soon
+`))
+	if len(playlists) != 3 {
+		t.Fatalf("expected three good playlists, got %+v", playlists)
+	}
+	for _, x := range []string{"line 11, column 11: bad playlist name Bad/Name", "line 13, column 12: unknown order sideways", `line 15, column 13: bad interval "soon"`} {
+		if err == nil || !strings.Contains(err.Error(), x) {
+			t.Errorf("expected problem %q, got %v", x, err)
+		}
+	}
+
+	var includes = []struct {
+		playlist int
+		feed     string
+		dir      string
+		included bool
+	}{
+		{0, "Comedy/WTF", "Comedy/WTF", true},
+		{0, "WTF", "Comedy/WTF/Specials", true},
+		{0, "Comedy/WTF", "Comedy", false},
+		{0, "News/Daily", "News/Daily", false},
+		{1, "News/Daily", "Elsewhere", true},
+		{1, "Comedy/WTF", "News/Daily", false},
+		{2, "Anything", "Anywhere", true},
+	}
+	for i, x := range includes {
+		if got := playlists[x.playlist].Includes(x.feed, x.dir); got != x.included {
+			t.Errorf("includes[%d] - expected %v, got %v", i, x.included, got)
+		}
+	}
+
+	now := time.Now()
+	if !playlists[0].Recent(now.Add(-6*24*time.Hour), now) || playlists[0].Recent(now.Add(-8*24*time.Hour), now) {
+		t.Errorf("expected only the last 7 days to be recent")
+	}
+	if playlists[2].Order != OrderOldest || !playlists[2].Recent(time.Time{}, now) {
+		t.Errorf("expected defaults of oldest first and any age, got %+v", playlists[2])
+	}
+}
+
+func TestParseDirPlaylists(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"Comedy.yaml":         "playlists:\n  - name: Recent\n    within: 3d\n",
+		"News/b.yaml":         "feeds: []\nplaylists:\n  - name: Recent\n",
+		"News/_defaults.yaml": "playlists:\n  - name: Hidden\n",
+		"broken.yaml":         "playlists: [\n",
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatalf("failed making %s: %v", name, err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0666); err != nil {
+			t.Fatalf("failed writing %s: %v", name, err)
+		}
+	}
+
+	_, playlists, err := ParseDir(dir)
+	if len(playlists) != 1 || playlists[0].Name != "Recent" {
+		t.Errorf("expected one playlist, got %+v", playlists)
+	}
+	for _, x := range []string{
+		filepath.Join(dir, "News/b.yaml") + ":3:11: duplicate playlist name Recent, first defined at " + filepath.Join(dir, "Comedy.yaml") + ":2:11",
+		filepath.Join(dir, "News/_defaults.yaml") + ":1:1: playlists can't be defined here",
+	} {
+		if err == nil || !strings.Contains(err.Error(), x) {
+			t.Errorf("expected problem %q, got %v", x, err)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package subscription
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"jaypod/pkg/rss"
+)
+
+// numRange is an inclusive range parsed from "3", "1-5", "10-" or "-4".
+// Bounds left out are open.
+type numRange struct {
+	min, max       int
+	hasMin, hasMax bool
+}
+
+func parseRange(s string) (*numRange, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	lo, hi, isRange := strings.Cut(s, "-")
+	if !isRange {
+		hi = lo
+	}
+
+	r := &numRange{}
+	var err error
+	if lo = strings.TrimSpace(lo); lo != "" {
+		if r.min, err = strconv.Atoi(lo); err != nil {
+			return nil, fmt.Errorf("bad range %q", s)
+		}
+		r.hasMin = true
+	}
+	if hi = strings.TrimSpace(hi); hi != "" {
+		if r.max, err = strconv.Atoi(hi); err != nil {
+			return nil, fmt.Errorf("bad range %q", s)
+		}
+		r.hasMax = true
+	}
+	return r, nil
+}
+
+func (r *numRange) contains(value string) bool {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return false
+	}
+	return (!r.hasMin || n >= r.min) && (!r.hasMax || n <= r.max)
+}
+
+// parseLength parses a duration as either a Go duration ("90m", "1h30m"),
+// a clock value ("1:30:00") or plain seconds.
+func parseLength(s string) (time.Duration, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+
+	item := rss.RssItem{Duration: s}
+	if d, ok := item.DurationValue(); ok {
+		return d, nil
+	}
+	return 0, fmt.Errorf("bad duration %q", s)
+}
+
+// parseSize parses a byte count with an optional KB, MB or GB suffix.
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		mult   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			mult = unit.mult
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// parseDay parses a date bound as either YYYY-MM-DD in local time or a full
+// RFC 3339 timestamp.
+func parseDay(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// predicates are the non-regexp tests a filter can apply to an episode.
+// An episode whose feed leaves out the duration, size, season or episode
+// number never satisfies a bound on it, so a filter like max_duration: 2m
+// with skip: true won't swallow episodes of unknown length.
+type predicates struct {
+	minDuration, maxDuration       time.Duration
+	hasMinDuration, hasMaxDuration bool
+	after, before                  time.Time
+	season, episode                *numRange
+	episodeType                    string
+	mimeType                       string
+	minSize, maxSize               int64
+	hasMinSize, hasMaxSize         bool
+}
+
+func (c *Condition) compilePredicates(at string) (*predicates, error) {
+	p := &predicates{}
+	var err error
+
+	if c.MinDuration != "" {
+		if p.minDuration, err = parseLength(c.MinDuration); err != nil {
+			return nil, &fieldError{path: at + ".min_duration", err: fmt.Errorf("min_duration: %v", err)}
+		}
+		p.hasMinDuration = true
+	}
+	if c.MaxDuration != "" {
+		if p.maxDuration, err = parseLength(c.MaxDuration); err != nil {
+			return nil, &fieldError{path: at + ".max_duration", err: fmt.Errorf("max_duration: %v", err)}
+		}
+		p.hasMaxDuration = true
+	}
+	if c.After != "" {
+		if p.after, err = parseDay(c.After); err != nil {
+			return nil, &fieldError{path: at + ".after", err: fmt.Errorf("after: bad date %q", c.After)}
+		}
+	}
+	if c.Before != "" {
+		if p.before, err = parseDay(c.Before); err != nil {
+			return nil, &fieldError{path: at + ".before", err: fmt.Errorf("before: bad date %q", c.Before)}
+		}
+	}
+	if p.season, err = parseRange(c.Season); err != nil {
+		return nil, &fieldError{path: at + ".season", err: fmt.Errorf("season: %v", err)}
+	}
+	if p.episode, err = parseRange(c.Episode); err != nil {
+		return nil, &fieldError{path: at + ".episode", err: fmt.Errorf("episode: %v", err)}
+	}
+
+	switch strings.ToLower(c.EpisodeType) {
+	case "", "full", "trailer", "bonus":
+		p.episodeType = strings.ToLower(c.EpisodeType)
+	default:
+		return nil, &fieldError{path: at + ".episode_type", err: fmt.Errorf("episode_type: unknown type %q", c.EpisodeType)}
+	}
+
+	if c.MimeType != "" {
+		if _, err := path.Match(c.MimeType, ""); err != nil {
+			return nil, &fieldError{path: at + ".mime_type", err: fmt.Errorf("mime_type: bad pattern %q", c.MimeType)}
+		}
+		p.mimeType = c.MimeType
+	}
+
+	if c.MinSize != "" {
+		if p.minSize, err = parseSize(c.MinSize); err != nil {
+			return nil, &fieldError{path: at + ".min_size", err: fmt.Errorf("min_size: %v", err)}
+		}
+		p.hasMinSize = true
+	}
+	if c.MaxSize != "" {
+		if p.maxSize, err = parseSize(c.MaxSize); err != nil {
+			return nil, &fieldError{path: at + ".max_size", err: fmt.Errorf("max_size: %v", err)}
+		}
+		p.hasMaxSize = true
+	}
+
+	return p, nil
+}
+
+func (p *predicates) match(podcast *rss.RssItem) bool {
+	if p.hasMinDuration || p.hasMaxDuration {
+		d, ok := podcast.DurationValue()
+		if !ok {
+			return false
+		}
+		if p.hasMinDuration && d < p.minDuration {
+			return false
+		}
+		if p.hasMaxDuration && d > p.maxDuration {
+			return false
+		}
+	}
+
+	if !p.after.IsZero() && podcast.Date().Before(p.after) {
+		return false
+	}
+	if !p.before.IsZero() && !podcast.Date().Before(p.before) {
+		return false
+	}
+
+	if p.season != nil && !p.season.contains(podcast.Season) {
+		return false
+	}
+	if p.episode != nil && !p.episode.contains(podcast.Episode) {
+		return false
+	}
+
+	if p.episodeType != "" && podcast.Kind() != p.episodeType {
+		return false
+	}
+
+	if p.mimeType != "" {
+		if ok, _ := path.Match(p.mimeType, podcast.Type()); !ok {
+			return false
+		}
+	}
+
+	if p.hasMinSize || p.hasMaxSize {
+		size := podcast.Length()
+		if size == 0 {
+			return false
+		}
+		if p.hasMinSize && size < p.minSize {
+			return false
+		}
+		if p.hasMaxSize && size > p.maxSize {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,179 @@
+package subscription
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"jaypod/pkg/rss"
+)
+
+const (
+	QualitySmallest = "smallest"
+	QualityHighest  = "highest"
+)
+
+// Preference chooses between an episode's enclosures when it has more than
+// one.  Enclosures outside the bitrate range or over the maximum size are
+// left out, though ones whose bitrate or size isn't known are kept.  The
+// rest are ordered by format, then by quality, and the feed's own order
+// breaks ties.  Whichever comes first is downloaded, and the others are
+// tried in turn if it can't be.
+type Preference struct {
+	// MIME types, like audio/mp4 or video/*, or extensions like mp3, best
+	// first.  Formats not listed come after those that are.
+	Formats []string
+	// Bits per second, like 64k-128k
+	Bitrate string
+	MaxSize string `yaml:"max_size"`
+	// smallest or highest
+	Quality string
+
+	minBitrate, maxBitrate int64
+	maxSize                int64
+}
+
+func (p *Preference) compile(ppath string) error {
+	for j, f := range p.Formats {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if _, err := path.Match(f, ""); err != nil || f == "" {
+			return &fieldError{path: fmt.Sprintf("%s.formats[%d]", ppath, j),
+				err: fmt.Errorf("bad format %s", p.Formats[j])}
+		}
+		p.Formats[j] = f
+	}
+
+	if p.Bitrate != "" {
+		lo, hi, isRange := strings.Cut(p.Bitrate, "-")
+		if !isRange {
+			hi = lo
+		}
+		var err error
+		if p.minBitrate, err = parseBitrate(lo); err == nil {
+			p.maxBitrate, err = parseBitrate(hi)
+		}
+		if err != nil {
+			return &fieldError{path: ppath + ".bitrate", err: fmt.Errorf("bad bitrate range %q", p.Bitrate)}
+		}
+	}
+
+	if p.MaxSize != "" {
+		var err error
+		if p.maxSize, err = parseSize(p.MaxSize); err != nil {
+			return &fieldError{path: ppath + ".max_size", err: err}
+		}
+	}
+
+	switch p.Quality {
+	case "", QualitySmallest, QualityHighest:
+	default:
+		return &fieldError{path: ppath + ".quality", err: fmt.Errorf("unknown quality %s", p.Quality)}
+	}
+
+	return nil
+}
+
+// parseBitrate parses bits per second with an optional k or m (decimal)
+// suffix.  An empty bound is zero, meaning open.
+func parseBitrate(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "bps"), "b")
+	if s == "" {
+		return 0, nil
+	}
+
+	mult := 1.0
+	if n, ok := strings.CutSuffix(s, "k"); ok {
+		s, mult = n, 1e3
+	} else if n, ok := strings.CutSuffix(s, "m"); ok {
+		s, mult = n, 1e6
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad bitrate %q", s)
+	}
+	return int64(n * mult), nil
+}
+
+// choose orders the enclosures of an episode by preference, leaving out
+// those it rules out.  A nil preference keeps the feed's order.
+func (p *Preference) choose(podcast *rss.RssItem, enclosures []rss.RssEnclosure) []rss.RssEnclosure {
+	if p == nil {
+		return enclosures
+	}
+
+	chosen := slices.DeleteFunc(slices.Clone(enclosures), func(e rss.RssEnclosure) bool {
+		if b := podcast.Bitrate(e); b > 0 {
+			if (p.minBitrate > 0 && b < p.minBitrate) || (p.maxBitrate > 0 && b > p.maxBitrate) {
+				return true
+			}
+		}
+		return p.maxSize > 0 && e.Size() > p.maxSize
+	})
+
+	slices.SortStableFunc(chosen, func(a, b rss.RssEnclosure) int {
+		if c := p.formatRank(a) - p.formatRank(b); c != 0 {
+			return c
+		}
+		switch p.Quality {
+		case QualitySmallest:
+			return compareKnown(size(podcast, a), size(podcast, b), false)
+		case QualityHighest:
+			return compareKnown(quality(podcast, a), quality(podcast, b), true)
+		}
+		return 0
+	})
+	return chosen
+}
+
+// formatRank is where an enclosure's format comes in the preferred
+// formats, or after all of them.
+func (p *Preference) formatRank(e rss.RssEnclosure) int {
+	mimeType := e.Type()
+	extensions := rss.ExtensionsForType(mimeType)
+	for i, f := range p.Formats {
+		if strings.Contains(f, "/") {
+			if ok, _ := path.Match(f, mimeType); ok {
+				return i
+			}
+		} else if slices.Contains(extensions, f) {
+			return i
+		}
+	}
+	return len(p.Formats)
+}
+
+// size and quality are what enclosures are compared by: bytes, or failing
+// that bitrate; and bitrate, video height, then bytes.  Unknown values are
+// zero.
+func size(podcast *rss.RssItem, e rss.RssEnclosure) []int64 {
+	return []int64{e.Size(), podcast.Bitrate(e)}
+}
+
+func quality(podcast *rss.RssItem, e rss.RssEnclosure) []int64 {
+	return []int64{podcast.Bitrate(e), e.HeightValue(), e.Size()}
+}
+
+// compareKnown compares measures in order of importance, ascending or
+// descending, skipping those that either side doesn't know.  When nothing
+// can be compared, the side knowing more comes first.
+func compareKnown(a, b []int64, descending bool) int {
+	known := 0
+	for i := range a {
+		switch {
+		case a[i] == 0 && b[i] != 0:
+			known++
+		case b[i] == 0 && a[i] != 0:
+			known--
+		case a[i] != b[i]:
+			if (a[i] < b[i]) != descending {
+				return -1
+			}
+			return 1
+		}
+	}
+	return known
+}
@@ -0,0 +1,135 @@
+package subscription
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+)
+
+// Secrets maps the names used in ${NAME} references within feed urls, auth
+// and headers to their values, so that subscription files can be committed
+// without credentials in them.  Names missing from the secrets file are
+// looked up in the environment.
+type Secrets map[string]string
+
+var secretRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+func LoadSecrets(filename string) (Secrets, error) {
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secrets file: %v", err)
+	}
+
+	s := Secrets{}
+	if err := yaml.Unmarshal(contents, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse secrets file: %v", err)
+	}
+	return s, nil
+}
+
+func (s Secrets) expand(value string) (string, error) {
+	var missing []string
+	expanded := secretRef.ReplaceAllStringFunc(value, func(ref string) string {
+		name := secretRef.FindStringSubmatch(ref)[1]
+		if v, ok := s[name]; ok {
+			return v
+		}
+		if v, ok := os.LookupEnv(name); ok {
+			return v
+		}
+		missing = append(missing, name)
+		return ""
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("no secret or environment variable named %s", missing[0])
+	}
+	return expanded, nil
+}
+
+// Resolve expands secret references in the feed's url, auth and headers.
+// It must be called before the feed is fetched.
+func (f *Feed) Resolve(secrets Secrets) error {
+	u, err := secrets.expand(f.Url)
+	if err != nil {
+		return fmt.Errorf("url for feed %s: %v", f.Name, err)
+	}
+
+	header := http.Header{}
+	for k, v := range f.Headers {
+		ev, err := secrets.expand(v)
+		if err != nil {
+			return fmt.Errorf("header %s for feed %s: %v", k, f.Name, err)
+		}
+		header.Set(k, ev)
+	}
+
+	if f.Auth != nil {
+		switch f.Auth.Type {
+		case "basic":
+			user, err := secrets.expand(f.Auth.Username)
+			if err != nil {
+				return fmt.Errorf("auth username for feed %s: %v", f.Name, err)
+			}
+			pass, err := secrets.expand(f.Auth.Password)
+			if err != nil {
+				return fmt.Errorf("auth password for feed %s: %v", f.Name, err)
+			}
+			header.Set("Authorization", "Basic "+
+				base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+		case "bearer":
+			token, err := secrets.expand(f.Auth.Token)
+			if err != nil {
+				return fmt.Errorf("auth token for feed %s: %v", f.Name, err)
+			}
+			header.Set("Authorization", "Bearer "+token)
+		}
+	}
+
+	f.requestUrl = u
+	f.header = header
+	return nil
+}
+
+// RequestUrl is the feed url with any secrets filled in.  It should not be
+// logged.
+func (f *Feed) RequestUrl() string {
+	if f.requestUrl == "" {
+		return f.Url
+	}
+	return f.requestUrl
+}
+
+// Authorize adds the feed's auth and custom headers to a request for
+// either the feed itself or one of its enclosures, if it's to the feed's
+// own host or one of its auth_hosts.  Otherwise it removes them, since a
+// redirect elsewhere carries over the original request's headers.
+func (f *Feed) Authorize(req *http.Request) {
+	trusted := f.trusts(req.URL.Hostname())
+	for k, v := range f.header {
+		if trusted {
+			req.Header[k] = v
+		} else {
+			req.Header.Del(k)
+		}
+	}
+}
+
+// trusts says whether the feed's auth and headers may be sent to host.
+func (f *Feed) trusts(host string) bool {
+	if u, err := url.Parse(f.RequestUrl()); err == nil && strings.EqualFold(u.Hostname(), host) {
+		return true
+	}
+	for _, h := range f.AuthHosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package subscription
+
+import (
+	"net/http"
+	"testing"
+)
+
+const authYaml = `
+feeds:
+  - name: "Comedy/TheBestShow"
+    url: "https://www.patreon.com/rss/TheBestShow?auth=${PATREON_TOKEN}"
+    headers:
+      X-Client: "${CLIENT_ID}"
+    auth:
+      type: basic
+      username: jay
+      password: "${SUPERCAST_PASSWORD}"
+    auth_hosts: [media.patreon.com]
+`
+
+func TestResolveSecrets(t *testing.T) {
+	feeds, err := ParseFeeds([]byte(authYaml))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	t.Setenv("CLIENT_ID", "podfetch-test")
+	secrets := Secrets{
+		"PATREON_TOKEN":      "abc123",
+		"SUPERCAST_PASSWORD": "hunter2",
+	}
+
+	if err := feeds[0].Resolve(secrets); err != nil {
+		t.Fatalf("resolve error: %v", err)
+	}
+
+	if feeds[0].RequestUrl() != "https://www.patreon.com/rss/TheBestShow?auth=abc123" {
+		t.Errorf("wrong request url: %s", feeds[0].RequestUrl())
+	}
+
+	req, _ := http.NewRequest("GET", feeds[0].RequestUrl(), nil)
+	feeds[0].Authorize(req)
+
+	if req.Header.Get("X-Client") != "podfetch-test" {
+		t.Errorf("wrong X-Client header: %q", req.Header.Get("X-Client"))
+	}
+
+	user, pass, ok := req.BasicAuth()
+	if !ok || user != "jay" || pass != "hunter2" {
+		t.Errorf("wrong basic auth: %v %q %q", ok, user, pass)
+	}
+
+	var hosts = []struct {
+		url     string
+		trusted bool
+	}{
+		{"https://WWW.patreon.com/file/ep1.mp3", true},
+		{"https://media.patreon.com/file/ep1.mp3", true},
+		{"https://cdn.example.com/ep1.mp3", false},
+		{"https://patreon.com.example.com/ep1.mp3", false},
+	}
+	for i, x := range hosts {
+		req, _ := http.NewRequest("GET", x.url, nil)
+		// as carried over from the original request by a redirect
+		req.Header.Set("X-Client", "podfetch-test")
+		feeds[0].Authorize(req)
+		_, _, ok := req.BasicAuth()
+		if ok != x.trusted || (req.Header.Get("X-Client") != "") != x.trusted {
+			t.Errorf("hosts[%d] - expected auth sent %v, got headers %v", i, x.trusted, req.Header)
+		}
+	}
+
+	delete(secrets, "PATREON_TOKEN")
+	if err := feeds[0].Resolve(secrets); err == nil {
+		t.Errorf("expected error for missing secret")
+	}
+}
@@ -0,0 +1,105 @@
+package subscription
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+)
+
+// templateFuncs are available to filename templates.  Functions taking a
+// value take it last, so they can be used in pipelines:
+//
+//	{{.episode | pad 4}} {{.title | slug | truncate 40}}
+//	{{.pubdate | dateIn "Europe/London" "2006-01-02"}}
+var templateFuncs = template.FuncMap{
+	"lower":    strings.ToLower,
+	"upper":    strings.ToUpper,
+	"title":    titleCase,
+	"slug":     slug,
+	"trim":     strings.TrimSpace,
+	"replace":  replace,
+	"truncate": truncate,
+	"pad":      pad,
+	"date":     formatDate,
+	"dateIn":   formatDateIn,
+	"default":  defaultValue,
+}
+
+func titleCase(s string) string {
+	words := strings.Fields(s)
+	for i, w := range words {
+		r := []rune(strings.ToLower(w))
+		r[0] = unicode.ToUpper(r[0])
+		words[i] = string(r)
+	}
+	return strings.Join(words, " ")
+}
+
+func slug(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteRune('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+func replace(old, new, s string) string {
+	return strings.ReplaceAll(s, old, new)
+}
+
+func truncate(n int, s string) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return strings.TrimSpace(string(r[:n]))
+}
+
+// pad zero-pads a number to at least n digits.  Values that aren't
+// numbers are returned unchanged.
+func pad(n int, s string) string {
+	num, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return s
+	}
+	return fmt.Sprintf("%0*d", n, num)
+}
+
+// formatDate reformats an RFC 3339 timestamp, like .pubdate, with a Go
+// time layout, keeping the timestamp's own offset.
+func formatDate(layout string, s string) (string, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return "", fmt.Errorf("date: %v", err)
+	}
+	return t.Format(layout), nil
+}
+
+func formatDateIn(zone string, layout string, s string) (string, error) {
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return "", fmt.Errorf("dateIn: %v", err)
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return "", fmt.Errorf("dateIn: %v", err)
+	}
+	return t.In(loc).Format(layout), nil
+}
+
+func defaultValue(def string, s string) string {
+	if strings.TrimSpace(s) == "" {
+		return def
+	}
+	return s
+}
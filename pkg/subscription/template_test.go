@@ -0,0 +1,49 @@
+package subscription
+
+import (
+	"testing"
+	"time"
+
+	"jaypod/pkg/rss"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	item := &rss.RssItem{
+		MyTitle: "  Episode 7 - The Return of the Son of Nothing  ",
+		Episode: "7",
+		Season:  "2",
+		PubDate: time.Date(2024, 3, 4, 1, 30, 0, 0, time.UTC),
+	}
+
+	var templates = []struct {
+		filename string
+		expected string
+	}{
+		{`{{.season}}x{{.episode}}`, "2x7"},
+		{`{{.season | pad 2}}x{{.episode | pad 3}}`, "02x007"},
+		{`{{.episode | pad 4}}`, "0007"},
+		{`{{.eptitle | pad 4}}`, "Nothing"},
+		{`{{.title | trim | lower}}`, "episode 7 - the return of the son of nothing"},
+		{`{{.title | upper | trim}}`, "EPISODE 7 - THE RETURN OF THE SON OF NOTHING"},
+		{`{{.eptitle | title}}`, "Nothing"},
+		{`{{.title | slug}}`, "episode-7-the-return-of-the-son-of-nothing"},
+		{`{{.title | trim | truncate 12}}`, "Episode 7 -"},
+		{`{{.title | trim | replace "Son" "Daughter"}}`, "Episode 7 - The Return of the Daughter of Nothing"},
+		{`{{.pubdate | date "2006/Jan/02 15:04"}}`, "2024/Mar/04 01:30"},
+		{`{{.pubdate | dateIn "America/New_York" "2006-01-02"}}`, "2024-03-03"},
+		{`{{.itunestitle | default "untitled"}}`, "untitled"},
+	}
+
+	for i, x := range templates {
+		doc := "feeds:\n  - name: x\n    url: http://example.com/rss\n    filters:\n      - title_regex: \".*of (?P<eptitle>\\\\w+)\\\\s*\"\n        filename: '" + x.filename + "'\n"
+		feeds, err := ParseFeeds([]byte(doc))
+		if err != nil {
+			t.Fatalf("templates[%d] - parse error: %v", i, err)
+		}
+
+		_, _, basename, _ := feeds[0].MatchAndMap(item)
+		if basename != x.expected {
+			t.Errorf("templates[%d] - %s: expected %q, got %q", i, x.filename, x.expected, basename)
+		}
+	}
+}